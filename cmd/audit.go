@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+)
+
+// auditLog runs the audit command: audit [-actor A] [-entity E] [-id ID]
+// [-from T] [-to T] [-limit N]. It prints the newest entries first, one
+// per line.
+func auditLog(ctx context.Context, database db.Database, args []string) error {
+	var query db.AuditQuery
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	flags.StringVar(&query.Actor, "actor", "", "only entries of the actor, e.g. chat:42 or seed")
+	flags.StringVar(&query.Entity, "entity", "", "only entries of the entity kind: user, course, lesson, enrollment or collection")
+	flags.StringVar(&query.EntityID, "id", "", "only entries of the entity with the ID")
+	from := flags.String("from", "", "only entries at or after the time, RFC 3339 or a date")
+	to := flags.String("to", "", "only entries at or before the time, RFC 3339 or a date")
+	flags.IntVar(&query.Limit, "limit", db.DefaultAuditLimit, "maximum number of entries")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var err error
+	if query.From, err = parseTime(*from, false); err != nil {
+		return fmt.Errorf("from: %w", err)
+	}
+	if query.To, err = parseTime(*to, true); err != nil {
+		return fmt.Errorf("to: %w", err)
+	}
+
+	entries, err := database.GetAuditLog(ctx, query)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		changes, err := json.Marshal(entry.Changes)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.At.Format(time.RFC3339), entry.Actor, entry.Action, entry.Entity, entry.EntityID, changes)
+	}
+	return nil
+}
+
+// parseTime parses an RFC 3339 time or a UTC date, the zero time when
+// empty. A date is its first moment, or its last one with end set.
+func parseTime(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil || !end {
+		return t, err
+	}
+	return t.Add(24*time.Hour - time.Nanosecond), nil
+}
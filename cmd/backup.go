@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/backup"
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/db/audit"
+)
+
+// export runs the export command: export [-o FILE].
+func export(ctx context.Context, database db.Database, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	out := flags.String("o", backup.FileName(time.Now()), "archive file, - writes to stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var stats backup.Stats
+	var err error
+	if *out == "-" {
+		stats, err = backup.Write(ctx, database, os.Stdout)
+	} else {
+		stats, err = backup.WriteFile(ctx, database, *out)
+	}
+	if err != nil {
+		return err
+	}
+	printStats(os.Stderr, "exported", stats)
+	return nil
+}
+
+// restore runs the restore command: restore [-mode merge|replace] FILE.
+func restore(ctx context.Context, database db.Database, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	mode := flags.String("mode", string(backup.Merge), "merge keeps records missing from the archive, replace removes them but keeps the audit log")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: restore [-mode merge|replace] FILE")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stats, err := backup.Restore(audit.WithActor(ctx, "restore"), audit.New(database), f, backup.Mode(*mode))
+	if err != nil {
+		return err
+	}
+	printStats(os.Stdout, "restored", stats)
+	return nil
+}
+
+func printStats(w *os.File, verb string, stats backup.Stats) {
+	collections := make([]string, 0, len(stats))
+	for collection := range stats {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+	for _, collection := range collections {
+		fmt.Fprintf(w, "%s %d %s\n", verb, stats[collection], collection)
+	}
+}
@@ -1,86 +1,269 @@
 package main
 
 import (
+	"context"
+	"errors"
+	_ "expvar"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/DanilLagunov/diploma/pkg/backup"
 	"github.com/DanilLagunov/diploma/pkg/bot"
+	"github.com/DanilLagunov/diploma/pkg/config"
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/db/audit"
 	"github.com/DanilLagunov/diploma/pkg/db/mongo"
+	"github.com/DanilLagunov/diploma/pkg/db/retry"
+	"github.com/DanilLagunov/diploma/pkg/db/sql"
 )
 
 func main() {
-	db, err := mongo.New(
-		fmt.Sprintf("mongodb+srv://%s:%s@diploma.g0hbuep.mongodb.net/?retryWrites=true&w=majority",
-			os.Getenv("MONGO_USER"),
-			os.Getenv("MONGO_PASSWORD")),
-		os.Getenv("MONGO_DB"),
-		os.Getenv("MONGO_USERS_COLLECTION"),
-		os.Getenv("MONGO_COURSES_COLLECTION"),
-		os.Getenv("MONGO_LESSONS_COLLECTION"))
+	cfg, args, err := config.Load(os.Args[1:])
 	if err != nil {
-		log.Panic(err)
-	}
-
-	// lessnon1, _ := db.CreateLesson(
-	// 	context.TODO(),
-	// 	"Склад числа.",
-	// 	"https://youtu.be/a1M-tWI000k",
-	// 	"https://docs.google.com/forms/d/e/1FAIpQLSfOxe6ueK2op-wii75bDVcSdTKJNxWvyH8s-TFGFM2SVbgMvA/viewform",
-	// 	90,
-	// )
-	// lessnon2, _ := db.CreateLesson(
-	// 	context.TODO(),
-	// 	"Додавання та віднімання.",
-	// 	"https://youtu.be/K37RnNkGGcI",
-	// 	"https://docs.google.com/forms/d/e/1FAIpQLSfOxe6ueK2op-wii75bDVcSdTKJNxWvyH8s-TFGFM2SVbgMvA/viewform",
-	// 	75,
-	// )
-	// lessnon3, _ := db.CreateLesson(
-	// 	context.TODO(),
-	// 	"Прості числа.",
-	// 	"https://youtu.be/LQ4brH4zN1M",
-	// 	"https://docs.google.com/forms/d/e/1FAIpQLSfOxe6ueK2op-wii75bDVcSdTKJNxWvyH8s-TFGFM2SVbgMvA/viewform",
-	// 	80,
-	// )
-
-	// db.CreateUser(context.TODO(), "user1@gmail.com", "user")
-	// db.CreateCourse(context.TODO(), "Математика для початківців", "Курс математики для учнів початкових класів.", []models.Lesson{lessnon1, lessnon2, lessnon3})
-
-	token := os.Getenv("BOT_TOKEN")
-
-	bot.New(db, token)
+		log.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var command string
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "migrate", "seed", "import", "export", "restore", "audit":
+		err = runCommand(ctx, cfg, command, args)
+	case "":
+		if err = cfg.Validate(); err != nil {
+			err = fmt.Errorf("config: %w", err)
+		} else {
+			go func() {
+				<-ctx.Done()
+				// A second signal kills the process at once.
+				stop()
+				log.Println("shutting down")
+			}()
+			err = serve(ctx, cfg)
+		}
+	default:
+		log.Fatalf("unknown command: %q", command)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runCommand runs a maintenance command on the database of the selected
+// tenant.
+func runCommand(ctx context.Context, cfg config.Config, command string, args []string) error {
+	tenant, err := cfg.SelectedTenant()
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	dbConfig := tenant.Database(cfg.Database)
+	if err := dbConfig.Validate(); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	database, err := newDatabase(dbConfig)
+	if err != nil {
+		return err
+	}
+	defer closeDatabase(database)
+
+	if command == "migrate" {
+		return migrate(ctx, database, args)
+	}
+	if err := autoMigrate(ctx, database); err != nil {
+		return err
+	}
+	if err := database.BindTenant(ctx, tenant.ID); err != nil {
+		return err
+	}
+	switch command {
+	case "export":
+		return export(ctx, database, args)
+	case "restore":
+		return restore(ctx, database, args)
+	case "audit":
+		return auditLog(ctx, database, args)
+	default:
+		return seedCourses(ctx, database, args)
+	}
+}
+
+// serve runs a bot for every tenant until ctx is done or all bots stop.
+// Then it shuts down in order: the bots finish the updates they received,
+// the servers and backups stop, and the caches and database clients are
+// closed last. It fails when no bot could be started.
+func serve(ctx context.Context, cfg config.Config) (err error) {
+	type tenantBot struct {
+		bot      *bot.Bot
+		database db.Database
+		dir      string
+	}
+	var (
+		bots      []tenantBot
+		databases []db.Database
+	)
+	defer func() {
+		for _, b := range bots {
+			b.bot.Close()
+		}
+		for _, database := range databases {
+			closeDatabase(database)
+		}
+	}()
+
+	var server *bot.WebhookServer
+	if cfg.Bot.Mode == config.ModeWebhook {
+		server = bot.NewWebhookServer(cfg.Bot.Webhook)
+	}
+	for _, tenant := range cfg.ServedTenants() {
+		database, err := newDatabase(tenant.Database(cfg.Database))
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", tenant.ID, err)
+		}
+		databases = append(databases, database)
+		if err := autoMigrate(ctx, database); err != nil {
+			return fmt.Errorf("tenant %s: %w", tenant.ID, err)
+		}
+		if err := database.BindTenant(ctx, tenant.ID); err != nil {
+			return fmt.Errorf("tenant %s: %w", tenant.ID, err)
+		}
+
+		dir := cfg.Backup.Dir
+		if cfg.Backup.Interval > 0 && len(cfg.Tenants) > 0 {
+			dir = filepath.Join(dir, tenant.ID)
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return err
+			}
+		}
+
+		b, err := bot.New(audit.New(retry.New(database, cfg.Database.Retry)), cfg.Bot, tenant, server)
+		if err != nil {
+			log.Printf("bot: %s", err)
+			continue
+		}
+		bots = append(bots, tenantBot{bot: b, database: database, dir: dir})
+	}
+	if len(bots) == 0 {
+		return errors.New("no bot started")
+	}
+
+	// Servers fail only on start, e.g. when the address is taken.
+	serverErr := make(chan error, 2)
+	var metrics *http.Server
+	if cfg.Metrics.Addr != "" {
+		metrics = &http.Server{Addr: cfg.Metrics.Addr, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := metrics.ListenAndServe(); err != http.ErrServerClosed {
+				serverErr <- fmt.Errorf("metrics server: %w", err)
+			}
+		}()
+	}
+	if server != nil {
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				serverErr <- fmt.Errorf("webhook server: %w", err)
+			}
+		}()
+	}
+
+	// The bots and backups get their own contexts, so they are stopped in
+	// order instead of all at once.
+	runCtx, stopBots := context.WithCancel(context.Background())
+	defer stopBots()
+	backupCtx, stopBackups := context.WithCancel(context.Background())
+	defer stopBackups()
+
+	var running, background sync.WaitGroup
+	for _, b := range bots {
+		if cfg.Backup.Interval > 0 {
+			background.Add(1)
+			go func(b tenantBot) {
+				defer background.Done()
+				backup.Schedule(backupCtx, b.database, b.dir, cfg.Backup.Interval, cfg.Backup.Keep)
+			}(b)
+		}
+		running.Add(1)
+		go func(b tenantBot) {
+			defer running.Done()
+			if err := b.bot.Run(runCtx); err != nil {
+				log.Printf("bot: %s", err)
+			}
+		}(b)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-stopped:
+		err = errors.New("all bots stopped")
+	case err = <-serverErr:
+	}
+
+	// The webhook server stops accepting updates first, so the pools drain
+	// only what they have.
+	if server != nil {
+		shutdown(server.Shutdown, cfg.Bot.ShutdownTimeout, "webhook server")
+	}
+	stopBots()
+	<-stopped
+	if metrics != nil {
+		shutdown(metrics.Shutdown, cfg.Bot.ShutdownTimeout, "metrics server")
+	}
+	stopBackups()
+	background.Wait()
+	return err
 }
 
-// lessnon1, _ := db.CreateLesson(
-// 	context.TODO(),
-// 	"Введення до вищої математики.",
-// 	"https://youtu.be/Jkb7enPFW88",
-// 	"https://docs.google.com/forms/d/e/1FAIpQLSfOxe6ueK2op-wii75bDVcSdTKJNxWvyH8s-TFGFM2SVbgMvA/viewform",
-// 	90,
-// )
-// lessnon2, _ := db.CreateLesson(
-// 	context.TODO(),
-// 	"Інтеграли.",
-// 	"https://youtu.be/j2FK5MGg35k",
-// 	"https://docs.google.com/forms/d/e/1FAIpQLSfOxe6ueK2op-wii75bDVcSdTKJNxWvyH8s-TFGFM2SVbgMvA/viewform",
-// 	75,
-// )
-// lessnon3, _ := db.CreateLesson(
-// 	context.TODO(),
-// 	"Будова організму. Клітини.",
-// 	"https://youtu.be/HOG_jVteKEk",
-// 	"https://docs.google.com/forms/d/e/1FAIpQLSfOxe6ueK2op-wii75bDVcSdTKJNxWvyH8s-TFGFM2SVbgMvA/viewform",
-// 	80,
-// )
-// lessnon4, _ := db.CreateLesson(
-// 	context.TODO(),
-// 	"Будова організму. Тканини.",
-// 	"https://youtu.be/HZyF2XTMDxk",
-// 	"https://docs.google.com/forms/d/e/1FAIpQLSfOxe6ueK2op-wii75bDVcSdTKJNxWvyH8s-TFGFM2SVbgMvA/viewform",
-// 	65,
-// )
-
-// db.CreateUser(context.TODO(), "raccoo@gmail.com", "raccoo")
-// db.CreateCourse(context.TODO(), "Вища математика", "Курс вищої математики для студентів вищих навчальних закладів.", []models.Lesson{lessnon1, lessnon2})
-// db.CreateCourse(context.TODO(), "Біологія", "Курс з біології для учнів середньої та старшої школи.", []models.Lesson{lessnon3, lessnon4})
+// shutdown stops a server, waiting up to timeout for its requests.
+func shutdown(stop func(ctx context.Context) error, timeout time.Duration, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := stop(ctx); err != nil {
+		log.Printf("%s: %s", name, err)
+	}
+}
+
+// closeDatabase releases the connections of backends that hold them.
+func closeDatabase(database db.Database) {
+	closer, ok := database.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		log.Printf("close database: %s", err)
+	}
+}
+
+// autoMigrate applies pending migrations of backends that have them.
+func autoMigrate(ctx context.Context, database db.Database) error {
+	if _, ok := database.(migratable); !ok {
+		return nil
+	}
+	return migrate(ctx, database, []string{"up"})
+}
+
+// newDatabase creating the storage backend selected by the config.
+func newDatabase(cfg config.Database) (db.Database, error) {
+	switch cfg.Driver {
+	case config.DriverMongo:
+		return mongo.New(cfg.Mongo)
+	case config.DriverPostgres, config.DriverSQLite:
+		return sql.New(cfg.Driver, cfg.DSN.Value)
+	default:
+		return nil, fmt.Errorf("unknown database driver: %q", cfg.Driver)
+	}
+}
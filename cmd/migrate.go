@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/migrations"
+)
+
+// migratable is implemented by backends with registered migrations.
+type migratable interface {
+	Migrator(out io.Writer) (*migrations.Migrator, error)
+}
+
+// migrate runs the migrate command: migrate [up|down|status] [-to N] [-dry-run].
+func migrate(ctx context.Context, database db.Database, args []string) error {
+	command := "up"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := flags.Int("to", 0, "target version; up applies up to it, down rolls back to it")
+	dryRun := flags.Bool("dry-run", false, "print the plan without applying it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	m, ok := database.(migratable)
+	if !ok {
+		return errors.New("the database has no migrations")
+	}
+	migrator, err := m.Migrator(os.Stdout)
+	if err != nil {
+		return err
+	}
+	migrator.DryRun = *dryRun
+
+	switch command {
+	case "up":
+		return migrator.Up(ctx, *to)
+	case "down":
+		return migrator.Down(ctx, *to)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			if status.Applied {
+				fmt.Printf("%s\tapplied %s\n", status.Migration, status.AppliedAt.Format("2006-01-02 15:04:05"))
+			} else {
+				fmt.Printf("%s\tpending\n", status.Migration)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command: %q", command)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/db/audit"
+	"github.com/DanilLagunov/diploma/pkg/seed"
+)
+
+// seedCourses runs the seed command: seed [-dry-run] FILE.
+func seedCourses(ctx context.Context, database db.Database, args []string) error {
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only validate the file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: seed [-dry-run] FILE")
+	}
+
+	file, err := seed.Read(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := file.Validate(); err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Printf("%s is valid: %d courses\n", flags.Arg(0), len(file.Courses))
+		return nil
+	}
+
+	result, err := seed.Import(audit.WithActor(ctx, "seed"), audit.New(database), file)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("courses: %d created, %d updated, %d unchanged\n",
+		result.Courses.Created, result.Courses.Updated, result.Courses.Unchanged)
+	fmt.Printf("lessons: %d created, %d updated, %d unchanged\n",
+		result.Lessons.Created, result.Lessons.Updated, result.Lessons.Unchanged)
+	return nil
+}
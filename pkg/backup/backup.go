@@ -0,0 +1,298 @@
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/db/audit"
+	"github.com/DanilLagunov/diploma/pkg/models"
+)
+
+// An archive is gzip compressed JSON lines: a header, one line per record
+// in db.Collections order, and a trailer with record counts that marks
+// the archive as complete.
+
+const (
+	// Format identifies backup archives.
+	Format = "diploma-backup"
+	// Version of the archive layout. Restore reads archives up to it.
+	Version = 1
+)
+
+var (
+	ErrFormat    = errors.New("not a backup archive")
+	ErrVersion   = errors.New("unsupported backup version")
+	ErrTruncated = errors.New("backup archive is truncated")
+)
+
+// Mode selects how Restore treats existing data.
+type Mode string
+
+const (
+	// Merge replaces records present in the archive and keeps the rest.
+	Merge Mode = "merge"
+	// Replace removes all data but the audit log before restoring the
+	// archive.
+	Replace Mode = "replace"
+)
+
+// Header is the first line of an archive.
+type Header struct {
+	Format      string    `json:"format"`
+	Version     int       `json:"version"`
+	CreatedAt   time.Time `json:"created_at"`
+	Collections []string  `json:"collections"`
+}
+
+// Stats counts records by collection.
+type Stats map[string]int
+
+type line struct {
+	Collection string          `json:"collection,omitempty"`
+	Record     json.RawMessage `json:"record,omitempty"`
+	// End is set on the trailer with the number of records written.
+	End *Stats `json:"end,omitempty"`
+}
+
+// Write exports every collection into an archive written to w.
+func Write(ctx context.Context, database db.Database, w io.Writer) (Stats, error) {
+	zw := gzip.NewWriter(w)
+	enc := json.NewEncoder(zw)
+
+	header := Header{Format: Format, Version: Version, CreatedAt: time.Now().UTC(), Collections: db.Collections}
+	if err := enc.Encode(header); err != nil {
+		return nil, err
+	}
+	stats := Stats{}
+	for _, collection := range db.Collections {
+		stats[collection] = 0
+		err := database.Export(ctx, collection, func(record interface{}) error {
+			data, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			stats[collection]++
+			return enc.Encode(line{Collection: collection, Record: data})
+		})
+		if err != nil {
+			return nil, fmt.Errorf("export %s: %w", collection, err)
+		}
+	}
+	if err := enc.Encode(line{End: &stats}); err != nil {
+		return nil, err
+	}
+	return stats, zw.Close()
+}
+
+// restoreBatch is the number of records imported in one transaction.
+const restoreBatch = 500
+
+// reader reads the lines of an archive after its header.
+type reader struct {
+	zr      *gzip.Reader
+	scanner *bufio.Scanner
+}
+
+func newReader(r io.Reader) (*reader, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrFormat, err)
+	}
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var header Header
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &header) != nil || header.Format != Format {
+		zr.Close()
+		return nil, ErrFormat
+	}
+	if header.Version < 1 || header.Version > Version {
+		zr.Close()
+		return nil, fmt.Errorf("%w: %d", ErrVersion, header.Version)
+	}
+	return &reader{zr: zr, scanner: scanner}, nil
+}
+
+// next returns the next record, or the written stats of the trailer.
+func (r *reader) next() (collection string, record interface{}, end *Stats, err error) {
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return "", nil, nil, fmt.Errorf("%w: %s", ErrTruncated, err)
+		}
+		return "", nil, nil, ErrTruncated
+	}
+	var l line
+	if err := json.Unmarshal(r.scanner.Bytes(), &l); err != nil {
+		return "", nil, nil, fmt.Errorf("%w: %s", ErrFormat, err)
+	}
+	if l.End != nil {
+		return "", nil, l.End, nil
+	}
+	record, err = db.DecodeRecord(l.Collection, l.Record)
+	return l.Collection, record, nil, err
+}
+
+func (r *reader) Close() error {
+	return r.zr.Close()
+}
+
+// Verify reads the whole archive and checks that it is complete, without
+// writing anything.
+func Verify(r io.Reader) (Stats, error) {
+	archive, err := newReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	stats := Stats{}
+	for {
+		collection, _, end, err := archive.next()
+		if err != nil {
+			return nil, err
+		}
+		if end != nil {
+			return stats, checkEnd(stats, *end)
+		}
+		stats[collection]++
+	}
+}
+
+// Restore loads an archive. It is verified first, so nothing is written
+// when it is invalid or incomplete. In replace mode every collection but
+// the audit log is cleared, then the records are imported in transactions
+// of up to restoreBatch records, or one by one when the database has no
+// transactions. The restore itself is recorded in the audit log. A restore
+// that fails on the way keeps the batches written before, restoring the
+// archive again in merge mode completes it.
+func Restore(ctx context.Context, database db.Database, r io.ReadSeeker, mode Mode) (Stats, error) {
+	if mode != Merge && mode != Replace {
+		return nil, fmt.Errorf("unknown restore mode: %q", mode)
+	}
+	if _, err := Verify(r); err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	archive, err := newReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	w := &writer{database: database}
+	if mode == Replace {
+		for i := len(db.Collections) - 1; i >= 0; i-- {
+			collection := db.Collections[i]
+			// The audit log is append only, it is merged even here.
+			if collection == db.CollectionAudit {
+				continue
+			}
+			err := w.write(ctx, func(ctx context.Context, tx db.Database) error {
+				return tx.Clear(ctx, collection)
+			})
+			if err != nil {
+				return nil, fmt.Errorf("clear %s: %w", collection, err)
+			}
+		}
+	}
+
+	stats := Stats{}
+	var batch []interface{}
+	var batchCollection string
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		records := batch
+		err := w.write(ctx, func(ctx context.Context, tx db.Database) error {
+			for _, record := range records {
+				if err := tx.Import(ctx, record); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("import %s: %w", batchCollection, err)
+		}
+		stats[batchCollection] += len(records)
+		batch = nil
+		return nil
+	}
+	for {
+		collection, record, end, err := archive.next()
+		if err != nil {
+			return nil, err
+		}
+		if end != nil {
+			break
+		}
+		if collection != batchCollection || len(batch) == restoreBatch {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			batchCollection = collection
+		}
+		batch = append(batch, record)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]models.AuditChange, len(stats))
+	for collection, count := range stats {
+		changes[collection] = models.AuditChange{After: count}
+	}
+	err = database.AppendAudit(ctx, models.AuditEntry{
+		Actor:    audit.ActorFrom(ctx),
+		Action:   "Restore",
+		Entity:   audit.EntityBackup,
+		EntityID: string(mode),
+		Changes:  changes,
+		At:       time.Now().UTC(),
+	})
+	if err != nil {
+		return stats, fmt.Errorf("record restore: %w", err)
+	}
+	return stats, nil
+}
+
+// writer runs the writes of a restore in transactions while the database
+// supports them.
+type writer struct {
+	database db.Database
+	noTx     bool
+}
+
+// write runs fn in a transaction, or directly on the database when it has
+// no transactions. fn only touches tx and its arguments, so a retried
+// transaction does the same writes again.
+func (w *writer) write(ctx context.Context, fn func(ctx context.Context, tx db.Database) error) error {
+	if !w.noTx {
+		err := w.database.WithTransaction(ctx, fn)
+		if !errors.Is(err, db.ErrNoTransactions) {
+			return err
+		}
+		log.Printf("restore: %s, writing without transactions", err)
+		w.noTx = true
+	}
+	return fn(ctx, w.database)
+}
+
+func checkEnd(read, written Stats) error {
+	for collection, count := range written {
+		if read[collection] != count {
+			return fmt.Errorf("%w: %s has %d of %d records", ErrTruncated, collection, read[collection], count)
+		}
+	}
+	return nil
+}
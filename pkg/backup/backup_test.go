@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/db/sql"
+	"github.com/DanilLagunov/diploma/pkg/models"
+)
+
+func newDatabase(t *testing.T) *sql.Database {
+	d, err := sql.New(sql.DriverSQLite, "file:"+filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	migrator, err := d.Migrator(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Up(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// archive writes an archive of a database with n lessons.
+func archive(t *testing.T, n int) []byte {
+	ctx := context.Background()
+	source := newDatabase(t)
+	for i := 0; i < n; i++ {
+		lesson := models.Lesson{ID: fmt.Sprintf("l%d", i), Title: fmt.Sprintf("Урок %d", i), EstimatedTime: 1}
+		if err := source.Import(ctx, lesson); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := Write(ctx, source, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func countLessons(t *testing.T, database db.Database) int {
+	count := 0
+	err := database.Export(context.Background(), db.CollectionLessons, func(interface{}) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+// noTransactions is a database without transactions, like a standalone
+// MongoDB server.
+type noTransactions struct {
+	db.Database
+}
+
+func (noTransactions) WithTransaction(ctx context.Context, fn func(ctx context.Context, tx db.Database) error) error {
+	return db.ErrNoTransactions
+}
+
+func TestRestore(t *testing.T) {
+	// More lessons than fit one batch.
+	data := archive(t, restoreBatch+10)
+
+	for name, wrap := range map[string]func(db.Database) db.Database{
+		"transactions":    func(d db.Database) db.Database { return d },
+		"no transactions": func(d db.Database) db.Database { return noTransactions{d} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			target := newDatabase(t)
+			stale := models.Lesson{ID: "stale", Title: "Старий"}
+			if err := target.Import(context.Background(), stale); err != nil {
+				t.Fatal(err)
+			}
+			history := models.AuditEntry{Actor: "admin", Action: "CreateLesson", Entity: "lesson", EntityID: "stale", At: time.Now().UTC()}
+			if err := target.AppendAudit(context.Background(), history); err != nil {
+				t.Fatal(err)
+			}
+			stats, err := Restore(context.Background(), wrap(target), bytes.NewReader(data), Replace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats[db.CollectionLessons] != restoreBatch+10 {
+				t.Errorf("stats %v", stats)
+			}
+			if n := countLessons(t, target); n != restoreBatch+10 {
+				t.Errorf("%d lessons restored", n)
+			}
+			entries, err := target.GetAuditLog(context.Background(), db.AuditQuery{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 || entries[0].Action != "Restore" || entries[1].Action != "CreateLesson" {
+				t.Errorf("audit log after replace %+v, want the history kept and the restore recorded", entries)
+			}
+		})
+	}
+}
+
+func TestRestoreTruncated(t *testing.T) {
+	// The archive without its trailer.
+	zr, err := gzip.NewReader(bytes.NewReader(archive(t, 3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines = lines[:bytes.LastIndexByte(lines[:len(lines)-1], '\n')+1]
+	var truncated bytes.Buffer
+	zw := gzip.NewWriter(&truncated)
+	zw.Write(lines)
+	zw.Close()
+
+	target := newDatabase(t)
+	_, err = Restore(context.Background(), target, bytes.NewReader(truncated.Bytes()), Merge)
+	if !errors.Is(err, ErrTruncated) {
+		t.Fatalf("error %v, want %v", err, ErrTruncated)
+	}
+	if n := countLessons(t, target); n != 0 {
+		t.Errorf("%d lessons restored from a truncated archive", n)
+	}
+}
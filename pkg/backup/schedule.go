@@ -0,0 +1,95 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+)
+
+const (
+	filePrefix = "backup-"
+	fileSuffix = ".jsonl.gz"
+	timeLayout = "20060102T150405Z"
+)
+
+// FileName returns the archive name for a backup taken at t.
+// Names sort in time order.
+func FileName(t time.Time) string {
+	return filePrefix + t.UTC().Format(timeLayout) + fileSuffix
+}
+
+// WriteFile writes an archive to path. The file appears under its name
+// only when complete, so a crash never leaves a partial archive behind.
+func WriteFile(ctx context.Context, database db.Database, path string) (Stats, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	stats, err := Write(ctx, database, tmp)
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	return stats, os.Rename(tmp.Name(), path)
+}
+
+// Schedule writes a backup into dir every interval until ctx is done,
+// keeping the newest keep archives. A keep of 0 keeps every archive.
+func Schedule(ctx context.Context, database db.Database, dir string, interval time.Duration, keep int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			path := filepath.Join(dir, FileName(t))
+			if _, err := WriteFile(ctx, database, path); err != nil {
+				log.Printf("backup: %s", err)
+				continue
+			}
+			log.Printf("backup written to %s", path)
+			if err := Prune(dir, keep); err != nil {
+				log.Printf("backup retention: %s", err)
+			}
+		}
+	}
+}
+
+// Prune removes all but the newest keep archives in dir.
+func Prune(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var archives []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, filePrefix) && strings.HasSuffix(name, fileSuffix) {
+			archives = append(archives, name)
+		}
+	}
+	sort.Strings(archives)
+	for len(archives) > keep {
+		if err := os.Remove(filepath.Join(dir, archives[0])); err != nil {
+			return fmt.Errorf("remove %s: %w", archives[0], err)
+		}
+		archives = archives[1:]
+	}
+	return nil
+}
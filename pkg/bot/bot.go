@@ -3,107 +3,260 @@ package bot
 import (
 	"context"
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/DanilLagunov/diploma/pkg/cache"
 	"github.com/DanilLagunov/diploma/pkg/cache/memcache"
+	"github.com/DanilLagunov/diploma/pkg/config"
 	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/db/audit"
+	"github.com/DanilLagunov/diploma/pkg/models"
+	"github.com/DanilLagunov/diploma/pkg/request"
 	"github.com/DanilLagunov/diploma/pkg/utils"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
+const (
+	coursesPageSize = 5
+	searchLimit     = 5
+	// apiTimeout bounds a Telegram API request on top of the long polling
+	// wait, so a shutdown never waits for a hung request.
+	apiTimeout = 30 * time.Second
+)
+
+// queueMetrics publishes the update pool stats of every tenant.
+var queueMetrics = expvar.NewMap("bot_queues")
+
+// Bot serves one tenant. The database and cache hold only its data.
 type Bot struct {
-	api   *tgbotapi.BotAPI
-	db    db.Database
-	cache cache.Cache
+	api    *tgbotapi.BotAPI
+	db     db.Database
+	cache  cache.Cache
+	tenant models.Tenant
+	cfg    config.Bot
+	router *Router
+	// dialogs keeps the multi-step dialogs of the chats in the database.
+	dialogs *FSM
+	// pool handles updates concurrently, in order within a chat.
+	pool *Pool
+	// server receives the updates in the webhook mode.
+	server *WebhookServer
 }
 
-func New(db db.Database, token string) (*Bot, error) {
-	cache := memcache.NewMemCache(60*time.Second, 90*time.Second)
-	api, err := tgbotapi.NewBotAPI(token)
+// New creating a new Bot object. It signs in to Telegram, updates are
+// received once Run is called. In the webhook mode updates come through
+// server, which is not used for long polling.
+func New(db db.Database, cfg config.Bot, tenant config.Tenant, server *WebhookServer) (*Bot, error) {
+	if cfg.Mode == config.ModeWebhook && server == nil {
+		return nil, fmt.Errorf("tenant %s: webhook mode needs a webhook server", tenant.ID)
+	}
+	client := &http.Client{Timeout: cfg.UpdateTimeout + apiTimeout}
+	api, err := tgbotapi.NewBotAPIWithClient(tenant.Token.Value, tgbotapi.APIEndpoint, client)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("tenant %s: %w", tenant.ID, err)
 	}
 
-	api.Debug = true
+	api.Debug = cfg.Debug
 
 	bot := &Bot{
-		api:   api,
-		db:    db,
-		cache: cache,
+		api:    api,
+		db:     db,
+		cache:  memcache.NewMemCache(cfg.Cache),
+		tenant: tenant.Tenant,
+		cfg:    cfg,
+		server: server,
 	}
 
-	log.Printf("Authorized on account %s", bot.api.Self.UserName)
+	log.Printf("Authorized on account %s for tenant %s", bot.api.Self.UserName, tenant.ID)
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+	bot.dialogs = bot.newDialogs(cfg)
+	bot.router = bot.newRouter(cfg)
+	if _, err := bot.api.Request(tgbotapi.NewSetMyCommands(bot.router.Commands()...)); err != nil {
+		log.Printf("set commands: %s", err)
+	}
 
-	updates := bot.api.GetUpdatesChan(u)
+	return bot, nil
+}
 
-	bot.updateController(updates)
+// Run receives and handles updates until ctx is done. Then it stops
+// receiving and waits up to the shutdown timeout for the updates already
+// received; handlers still running after that are cancelled. Handlers do
+// not see ctx, so a shutdown does not cut off a reply half way.
+func (b *Bot) Run(ctx context.Context) error {
+	handlerCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b.pool = NewPool(b.cfg.Workers, b.cfg.QueueSize, func(update tgbotapi.Update) {
+		if handlerCtx.Err() != nil {
+			// The shutdown timeout passed, the update is dropped.
+			return
+		}
+		b.handleUpdate(handlerCtx, update)
+	})
+	queueMetrics.Set(b.tenant.ID, expvar.Func(func() interface{} { return b.pool.Stats() }))
 
-	return bot, nil
+	var err error
+	if b.cfg.Mode == config.ModeWebhook {
+		err = b.serveWebhook(ctx)
+	} else {
+		b.poll(ctx)
+	}
+	b.drain(cancel)
+	return err
 }
 
-func (b *Bot) updateController(updates tgbotapi.UpdatesChannel) {
-	for update := range updates {
-		if update.CallbackQuery != nil {
-			split := strings.Split(update.CallbackQuery.Data, " ")
-			switch split[0] {
-			case "/register":
-				b.courseRegistrationCallback(update, split)
-			case "/lessons":
-				b.courseLessonsCallback(update, split)
-			case "/view":
-				b.viewLessonCallback(update, split)
-			default:
-				continue
-			}
-		} else if update.Message.IsCommand() {
-			switch update.Message.Command() {
-			case "help":
-				b.help(update)
-			case "start":
-				b.start(update)
-			case "contacts":
-				b.contacts(update)
-			case "login":
-				b.login(update)
-			case "courses":
-				b.courses(update)
-			case "mycourses":
-				b.myCourses(update)
-			default:
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
-				msg.Text = "Невідома команда. Для списку команд введіть /help"
+// Close stops the cache cleaner. It is called after Run returns.
+func (b *Bot) Close() {
+	b.cache.Close()
+}
+
+// poll receives updates with long polling until ctx is done.
+func (b *Bot) poll(ctx context.Context) {
+	// Updates are not delivered by getUpdates while a webhook is set.
+	if err := b.deleteWebhook(); err != nil {
+		log.Printf("delete webhook of tenant %s: %s", b.tenant.ID, err)
+	}
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = int(b.cfg.UpdateTimeout.Seconds())
+
+	updates := b.api.GetUpdatesChan(u)
+
+	b.updateController(ctx, updates)
+}
+
+// updateController passes updates to the pool until ctx is done.
+func (b *Bot) updateController(ctx context.Context, updates tgbotapi.UpdatesChannel) {
+	for {
+		select {
+		case <-ctx.Done():
+			b.api.StopReceivingUpdates()
+			return
+		case update, ok := <-updates:
+			if !ok {
+				return
 			}
-		} else if update.Message != nil {
-			switch update.Message.Text {
-			case "Допомога":
-				b.help(update)
-			case "start":
-				b.start(update)
-			case "Контакти":
-				b.contacts(update)
-			case "login":
-				b.login(update)
-			case "Всі курси":
-				b.courses(update)
-			case "Мої курси":
-				b.myCourses(update)
-			default:
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
-				msg.Text = "Невідома команда. Для списку команд введіть /help"
+			if err := b.pool.Submit(ctx, update); err != nil {
+				b.api.StopReceivingUpdates()
+				return
 			}
 		}
 	}
 }
 
-func (b *Bot) start(update tgbotapi.Update) {
+// drain waits for the received updates up to the shutdown timeout. Then it
+// cancels the handlers that are still running, drops the queued updates and
+// waits for the workers, which is bounded by the handler and API timeouts.
+func (b *Bot) drain(cancel context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
+		b.pool.Close()
+		close(done)
+	}()
+	timer := time.NewTimer(b.cfg.ShutdownTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		stats := b.pool.Stats()
+		log.Printf("tenant %s: %d updates not handled in %s, cancelling them", b.tenant.ID, stats.Busy+stats.Queued, b.cfg.ShutdownTimeout)
+		cancel()
+		<-done
+	}
+}
+
+// requestContext returns the context of one update: it has the handler
+// deadline, the sender as user and audit actor, and a logger naming the
+// update.
+func (b *Bot) requestContext(ctx context.Context, update tgbotapi.Update) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, b.cfg.HandlerTimeout)
+	ctx = request.WithUpdateID(ctx, update.UpdateID)
+	prefix := fmt.Sprintf("[%s update=%d", b.tenant.ID, update.UpdateID)
+	if from := update.SentFrom(); from != nil {
+		ctx = request.WithUser(ctx, request.User{ID: from.ID, UserName: from.UserName})
+		ctx = audit.WithActor(ctx, chatActor(from.ID))
+		prefix += fmt.Sprintf(" user=%d", from.ID)
+	}
+	logger := log.New(log.Writer(), prefix+"] ", log.Flags()|log.Lmsgprefix)
+	return request.WithLogger(ctx, logger), cancel
+}
+
+func (b *Bot) handleUpdate(ctx context.Context, update tgbotapi.Update) {
+	ctx, cancel := b.requestContext(ctx, update)
+	defer cancel()
+	b.router.Dispatch(ctx, update)
+}
+
+// newRouter registers the bot commands, keyboard texts and buttons.
+func (b *Bot) newRouter(cfg config.Bot) *Router {
+	r := NewRouter(b.fallback)
+	r.Use(recovery, logging)
+	if cfg.RateLimit.PerMinute > 0 {
+		r.Use(b.rateLimit(cfg.RateLimit))
+	}
+	r.Use(b.auth)
+
+	r.Handle(Route{Command: "start", Aliases: []string{"start"}, Handler: b.start})
+	r.Handle(Route{Command: "login", Usage: "[пошта] [пароль]", Aliases: []string{"login"}, Description: "Вхід до облікового запису", Handler: b.login})
+	r.Handle(Route{Command: "help", Aliases: []string{"Допомога"}, Description: "Допомога", Handler: b.help})
+	r.Handle(Route{Command: "contacts", Aliases: []string{"Контакти"}, Description: "Контакти школи", Handler: b.contacts})
+	r.Handle(Route{Command: "courses", Aliases: []string{"Всі курси"}, Description: "Всі курси школи", Handler: b.courses})
+	r.Handle(Route{Command: "mycourses", Aliases: []string{"Мої курси"}, Description: "Курси, на які ви підписані", Role: RoleUser, Handler: b.myCourses})
+	r.Handle(Route{Command: "search", Usage: "[запит]", Description: "Пошук курсів та уроків", Handler: b.search})
+	r.Handle(Route{Command: "cancel", Description: "Скасувати поточну дію", Handler: b.cancel})
+
+	r.Handle(Route{Callback: "/register", Role: RoleUser, Handler: b.courseRegistrationCallback})
+	r.Handle(Route{Callback: "/lessons", Role: RoleUser, Handler: b.courseLessonsCallback})
+	r.Handle(Route{Callback: "/view", Role: RoleUser, Handler: b.viewLessonCallback})
+	r.Handle(Route{Callback: "/page", Handler: b.coursesPageCallback})
+	r.Handle(Route{Callback: "/course", Handler: b.viewCourseCallback})
+	return r
+}
+
+// newDialogs registers the steps of the multi-step dialogs.
+func (b *Bot) newDialogs(cfg config.Bot) *FSM {
+	f := NewFSM(b.db, cfg.DialogTimeout, b.send)
+	f.Handle("login.email", Step{Prompt: "Введіть пошту:", Handler: b.loginEmail})
+	f.Handle("login.password", Step{Prompt: "Введіть пароль:", Timeout: 2 * time.Minute, Handler: b.loginPassword})
+	return f
+}
+
+// fallback passes texts without a route to the dialog of the chat.
+func (b *Bot) fallback(ctx context.Context, update tgbotapi.Update) {
+	handled, err := b.dialogs.Dispatch(ctx, update)
+	if err != nil {
+		b.handleError(ctx, err)
+		return
+	}
+	if !handled {
+		b.unknownCommand(ctx, update)
+	}
+}
+
+func (b *Bot) cancel(ctx context.Context, update tgbotapi.Update) {
+	cancelled, err := b.dialogs.Cancel(ctx, update.Message.Chat.ID)
+	if err != nil {
+		b.handleError(ctx, err)
+		return
+	}
+	if cancelled {
+		b.reply(ctx, "Дію скасовано.")
+	} else {
+		b.reply(ctx, "Немає дії, яку можна скасувати.")
+	}
+}
+
+func (b *Bot) unknownCommand(ctx context.Context, update tgbotapi.Update) {
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Невідома команда. Для списку команд введіть /help")
+	_, err := b.api.Send(msg)
+	b.handleError(ctx, err)
+}
+
+func (b *Bot) start(ctx context.Context, update tgbotapi.Update) {
 	var userKeyboard = tgbotapi.NewReplyKeyboard(
 		tgbotapi.NewKeyboardButtonRow(
 			tgbotapi.NewKeyboardButton("Всі курси"),
@@ -115,100 +268,246 @@ func (b *Bot) start(update tgbotapi.Update) {
 		),
 	)
 	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
-	msg.Text = "Це бот онлайн школи ApCenter\nДля входу до облікового запису введіть /login [пошта] [пароль]\nДля допомоги введіть /help."
+	msg.Text = "Це бот онлайн школи " + b.tenant.Name + "\nДля входу до облікового запису введіть /login\nДля допомоги введіть /help."
 	msg.ReplyMarkup = userKeyboard
 	_, err := b.api.Send(msg)
-	handleError(err)
+	b.handleError(ctx, err)
 }
 
-func (b *Bot) help(update tgbotapi.Update) {
+func (b *Bot) help(ctx context.Context, update tgbotapi.Update) {
 	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
-	msg.Text = `Для керування ботом ви можете використовувати вбудоване меню або текстові команди:
-	/login [пошта] [пароль] - Вхід до облікового запису
-	/help - Допомога
-	/contacts - Контакти школи
-	/courses - Всі курси школи
-	/mycourses - Курси, на які ви підписані
-	`
+	msg.Text = "Для керування ботом ви можете використовувати вбудоване меню або текстові команди:\n" + b.router.Help()
 	_, err := b.api.Send(msg)
-	handleError(err)
+	b.handleError(ctx, err)
 }
 
-func (b *Bot) contacts(update tgbotapi.Update) {
+func (b *Bot) contacts(ctx context.Context, update tgbotapi.Update) {
 	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
-	msg.Text = "Пошта: school@apcenter.com \nТелефон: +380000000000\nАдреса: проспект Дмитра Яворницького, 35"
+	var text strings.Builder
+	for _, field := range []struct{ label, value string }{
+		{"Пошта", b.tenant.Email},
+		{"Телефон", b.tenant.Phone},
+		{"Адреса", b.tenant.Address},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(&text, "%s: %s\n", field.label, field.value)
+		}
+	}
+	msg.Text = text.String()
+	if msg.Text == "" {
+		msg.Text = "Контакти школи не вказані."
+	}
 	_, err := b.api.Send(msg)
-	handleError(err)
+	b.handleError(ctx, err)
 }
 
-func (b *Bot) login(update tgbotapi.Update) {
-	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
-	split := strings.Split(update.Message.Text, " ")
-	if len(split) < 3 {
-		msg.Text = "Недостатньо аргументів, спробуйте ще раз."
-		_, err := b.api.Send(msg)
-		handleError(err)
+// errWrongPassword is returned by authenticate for a wrong password.
+var errWrongPassword = errors.New("wrong password")
+
+// login binds the chat to an account. Without arguments it asks for the
+// email and the password in a dialog.
+func (b *Bot) login(ctx context.Context, update tgbotapi.Update) {
+	chatID := update.Message.Chat.ID
+	args := strings.Fields(update.Message.CommandArguments())
+	var err error
+	switch len(args) {
+	case 0:
+		err = b.dialogs.Start(ctx, chatID, "login.email", nil)
+	case 1:
+		err = b.dialogs.Start(ctx, chatID, "login.password", map[string]string{"email": args[0]})
+	default:
+		b.replyLogin(ctx, b.authenticate(ctx, chatID, args[0], args[1]))
 		return
 	}
+	b.handleError(ctx, err)
+}
+
+func (b *Bot) loginEmail(ctx context.Context, update tgbotapi.Update, data map[string]string) (string, error) {
+	email := strings.TrimSpace(update.Message.Text)
+	if email == "" {
+		return "login.email", nil
+	}
+	data["email"] = email
+	return "login.password", nil
+}
+
+// loginPassword never stores the password, the message with it is removed
+// from the chat.
+func (b *Bot) loginPassword(ctx context.Context, update tgbotapi.Update, data map[string]string) (string, error) {
+	message := update.Message
+	if _, err := b.api.Request(tgbotapi.NewDeleteMessage(message.Chat.ID, message.MessageID)); err != nil {
+		request.LoggerFrom(ctx).Printf("delete password message: %s", err)
+	}
+	err := b.authenticate(ctx, message.Chat.ID, data["email"], strings.TrimSpace(message.Text))
+	b.replyLogin(ctx, err)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return "login.email", nil
+	case err != nil:
+		return "login.password", nil
+	default:
+		return End, nil
+	}
+}
 
-	user, err := b.cache.GetUser(split[1])
+// authenticate binds the chat to the account when the password matches.
+func (b *Bot) authenticate(ctx context.Context, chatID int64, email, password string) error {
+	user, err := b.cache.GetUser(email)
 	if err != nil {
-		fmt.Printf("cache error: %s", err)
-		user, err = b.db.GetUser(context.TODO(), split[1])
-		if errors.Is(err, db.ErrNotFound) {
-			msg.Text = "Користувача не знайдено, спробуйте ще раз."
-			_, err = b.api.Send(msg)
-			handleError(err)
-			return
+		request.LoggerFrom(ctx).Printf("cache error: %s", err)
+		user, err = b.db.GetUser(ctx, email)
+		if err != nil {
+			return err
 		}
 	}
-	b.cache.SetUser(split[1], user, 0)
+	b.cache.SetUser(email, user, 0)
 
-	if !utils.CheckPasswordHash(split[2], user.Password) {
-		fmt.Println("wrong password")
+	if !utils.CheckPasswordHash(password, user.Password) {
+		return errWrongPassword
 	}
+	return b.db.UpdateUser(ctx, user.Email, chatID)
+}
 
-	err = b.db.UpdateUser(context.TODO(), user.Email, update.Message.Chat.ID)
-	handleError(err)
+// replyLogin tells the sender the result of authenticate.
+func (b *Bot) replyLogin(ctx context.Context, err error) {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		b.reply(ctx, "Користувача не знайдено, спробуйте ще раз.")
+	case errors.Is(err, errWrongPassword):
+		request.LoggerFrom(ctx).Println("wrong password")
+		b.reply(ctx, "Невірний пароль, спробуйте ще раз.")
+	case err != nil:
+		b.handleError(ctx, err)
+	default:
+		b.reply(ctx, "Авторизація успішна!")
+	}
+}
 
-	msg.Text = "Авторизація успішна!"
+func (b *Bot) courses(ctx context.Context, update tgbotapi.Update) {
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
+	text, markup, err := b.coursesPage(ctx, "")
+	if err != nil {
+		b.handleError(ctx, err)
+		return
+	}
+	msg.Text = text
+	if len(markup.InlineKeyboard) > 0 {
+		msg.ReplyMarkup = markup
+	}
 	_, err = b.api.Send(msg)
-	handleError(err)
+	b.handleError(ctx, err)
+}
+
+func (b *Bot) coursesPageCallback(ctx context.Context, update tgbotapi.Update) {
+	args := callbackArgs(update)
+	if len(args) == 0 {
+		return
+	}
+	text, markup, err := b.coursesPage(ctx, args[0])
+	if errors.Is(err, db.ErrNotFound) {
+		// The course the cursor points at is gone, start over.
+		text, markup, err = b.coursesPage(ctx, "")
+	}
+	if err != nil {
+		b.handleError(ctx, err)
+		return
+	}
+	message := update.CallbackQuery.Message
+	edit := tgbotapi.NewEditMessageTextAndMarkup(message.Chat.ID, message.MessageID, text, markup)
+	_, err = b.api.Send(edit)
+	b.handleError(ctx, err)
+}
+
+// coursesPage renders one page of the catalog with a join button per course
+// and Prev/Next buttons that page through the catalog in place.
+func (b *Bot) coursesPage(ctx context.Context, cursor string) (string, tgbotapi.InlineKeyboardMarkup, error) {
+	var markup tgbotapi.InlineKeyboardMarkup
+	page, err := b.db.ListCourses(ctx, db.CourseQuery{
+		Sort:   db.SortByTitle,
+		Limit:  coursesPageSize,
+		Cursor: cursor,
+	})
+	if err != nil {
+		return "", markup, err
+	}
+	if len(page.Courses) == 0 {
+		return "Курсів поки немає.", markup, nil
+	}
+
+	var text strings.Builder
+	for i, course := range page.Courses {
+		fmt.Fprintf(&text, "%d. %s\n%s\nКількість уроків: %d\n\n", i+1, course.Title, course.Description, len(course.LessonIDs))
+		markup.InlineKeyboard = append(markup.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("Приєднатися: %d. %s", i+1, course.Title), fmt.Sprintf("/register %s", course.ID)),
+		))
+	}
+
+	var nav []tgbotapi.InlineKeyboardButton
+	if page.Prev != "" {
+		nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("« Назад", fmt.Sprintf("/page %s", page.Prev)))
+	}
+	if page.Next != "" {
+		nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("Далі »", fmt.Sprintf("/page %s", page.Next)))
+	}
+	if len(nav) > 0 {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, nav)
+	}
+
+	return text.String(), markup, nil
 }
 
-func (b *Bot) courses(update tgbotapi.Update) {
+func (b *Bot) search(ctx context.Context, update tgbotapi.Update) {
 	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
-	courses, err := b.db.GetCourses(context.TODO())
-	handleError(err)
+	query := strings.TrimSpace(update.Message.CommandArguments())
+	if query == "" {
+		msg.Text = "Введіть запит: /search [запит]"
+		_, err := b.api.Send(msg)
+		b.handleError(ctx, err)
+		return
+	}
 
-	for _, course := range courses {
-		var courseRegistration = tgbotapi.NewInlineKeyboardMarkup(
-			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("Приєднатися!", fmt.Sprintf("/register %s", course.ID)),
-			),
-		)
-		msg.Text = fmt.Sprintln(course.Title + "\n" + course.Description + "\nКількість уроків: " + strconv.Itoa(len(course.Lessons)))
-		msg.ReplyMarkup = courseRegistration
+	courses, err := b.db.SearchCourses(ctx, query, searchLimit)
+	if err != nil {
+		b.handleError(ctx, err)
+		return
+	}
+	lessons, err := b.db.SearchLessons(ctx, query, searchLimit)
+	if err != nil {
+		b.handleError(ctx, err)
+		return
+	}
+	if len(courses) == 0 && len(lessons) == 0 {
+		msg.Text = "Нічого не знайдено."
 		_, err = b.api.Send(msg)
-		handleError(err)
+		b.handleError(ctx, err)
+		return
+	}
+
+	var markup tgbotapi.InlineKeyboardMarkup
+	for _, course := range courses {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Курс: "+course.Title, fmt.Sprintf("/course %s", course.ID)),
+		))
+	}
+	for _, lesson := range lessons {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Урок: "+lesson.Title, fmt.Sprintf("/view %s", lesson.ID)),
+		))
 	}
+	msg.Text = fmt.Sprintf("Результати пошуку за запитом \"%s\":", query)
+	msg.ReplyMarkup = markup
+	_, err = b.api.Send(msg)
+	b.handleError(ctx, err)
 }
 
-func (b *Bot) myCourses(update tgbotapi.Update) {
+func (b *Bot) myCourses(ctx context.Context, update tgbotapi.Update) {
 	msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
-	user, err := b.cache.GetUser(fmt.Sprint(update.Message.Chat.ID))
+	user := accountFrom(ctx)
+	courses, err := b.db.GetUserCourses(ctx, user.ChatID)
 	if err != nil {
-		fmt.Printf("cache error: %s", err)
-		user, err = b.db.GetUser(context.TODO(), fmt.Sprint(update.Message.Chat.ID))
-		if errors.Is(err, db.ErrNotFound) {
-			msg.Text = "Ви не авторизовані!"
-			_, err = b.api.Send(msg)
-			handleError(err)
-			return
-		}
+		b.handleError(ctx, err)
+		return
 	}
-	courses, err := b.db.GetUserCourses(context.TODO(), user.ChatID)
-	handleError(err)
 
 	for _, course := range courses {
 		var courseLessons = tgbotapi.NewInlineKeyboardMarkup(
@@ -216,85 +515,225 @@ func (b *Bot) myCourses(update tgbotapi.Update) {
 				tgbotapi.NewInlineKeyboardButtonData("Список уроків", fmt.Sprintf("/lessons %s", course.ID)),
 			),
 		)
-		msg.Text = fmt.Sprintln(course.Title + "\n" + course.Description + "\n" + strconv.Itoa(len(course.Lessons)))
+		msg.Text = fmt.Sprintln(course.Title + "\n" + course.Description + "\n" + strconv.Itoa(len(course.LessonIDs)))
 		msg.ReplyMarkup = courseLessons
 		_, err = b.api.Send(msg)
-		handleError(err)
+		b.handleError(ctx, err)
 	}
 }
 
-func (b *Bot) courseRegistrationCallback(update tgbotapi.Update, split []string) {
+func (b *Bot) courseRegistrationCallback(ctx context.Context, update tgbotapi.Update) {
+	args := callbackArgs(update)
+	if len(args) == 0 {
+		return
+	}
 	msg := tgbotapi.NewMessage(update.CallbackQuery.From.ID, "")
-	user, err := b.cache.GetUser(fmt.Sprint(update.CallbackQuery.From.ID))
+	course, err := b.cache.GetCourse(args[0])
 	if err != nil {
-		fmt.Printf("cache error: %s", err)
-		user, err = b.db.GetUser(context.TODO(), fmt.Sprint(update.CallbackQuery.From.ID))
-		if errors.Is(err, db.ErrNotFound) {
-			msg.Text = "Ви не авторизовані!"
-			_, err = b.api.Send(msg)
-			handleError(err)
+		request.LoggerFrom(ctx).Printf("cache error: %s", err)
+		course, err = b.db.GetCourse(ctx, args[0])
+		if err != nil {
+			b.handleError(ctx, err)
 			return
 		}
 	}
-	course, err := b.cache.GetCourse(split[1])
+	b.cache.SetCourse(args[0], course, 0)
+
+	result, err := b.db.EnrollUser(ctx, update.CallbackQuery.From.ID, course.ID)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		msg.Text = "Ви не авторизовані!"
+	case errors.Is(err, db.ErrArchived):
+		msg.Text = "Запис на цей курс закрито."
+	case err != nil:
+		b.handleError(ctx, err)
+		return
+	case result == db.AlreadyEnrolled:
+		msg.Text = fmt.Sprintf("Ви вже приєдналися до курсу \"%s\".", course.Title)
+	default:
+		msg.Text = fmt.Sprintf("Ви приєдналися до курсу \"%s\"!", course.Title)
+	}
+	_, err = b.api.Send(msg)
+	b.handleError(ctx, err)
+}
+
+func (b *Bot) viewCourseCallback(ctx context.Context, update tgbotapi.Update) {
+	args := callbackArgs(update)
+	if len(args) == 0 {
+		return
+	}
+	course, err := b.db.GetAvailableCourse(ctx, update.CallbackQuery.From.ID, args[0])
+	if errors.Is(err, db.ErrNotFound) {
+		b.reply(ctx, "Курс не знайдено.")
+		return
+	}
 	if err != nil {
-		fmt.Printf("cache error: %s", err)
-		course, err = b.db.GetCourse(context.TODO(), split[1])
-		if errors.Is(err, db.ErrNotFound) {
-			handleError(err)
-			return
-		}
+		b.handleError(ctx, err)
+		return
 	}
-	b.cache.SetCourse(split[1], course, 0)
 
-	err = b.db.UpdateUserCourses(context.TODO(), user.ChatID, course)
-	handleError(err)
+	msg := tgbotapi.NewMessage(update.CallbackQuery.From.ID, "")
+	msg.Text = fmt.Sprintln(course.Title + "\n" + course.Description + "\nКількість уроків: " + strconv.Itoa(len(course.LessonIDs)))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Приєднатися!", fmt.Sprintf("/register %s", course.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("Список уроків", fmt.Sprintf("/lessons %s", course.ID)),
+		),
+	)
+	_, err = b.api.Send(msg)
+	b.handleError(ctx, err)
 }
 
-func (b *Bot) courseLessonsCallback(update tgbotapi.Update, split []string) {
-	lessons, err := b.db.GetCourseLessons(context.TODO(), split[1])
-	handleError(err)
+func (b *Bot) courseLessonsCallback(ctx context.Context, update tgbotapi.Update) {
+	args := callbackArgs(update)
+	if len(args) == 0 {
+		return
+	}
+	lessons, ok := b.enrolledLessons(ctx, args[0])
+	if !ok {
+		return
+	}
 
 	msg := tgbotapi.NewMessage(update.CallbackQuery.From.ID, "")
 	for i, lesson := range lessons {
 		var viewLesson = tgbotapi.NewInlineKeyboardMarkup(
 			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("Перейти до уроку", fmt.Sprintf("/view %s %s", lesson.ID, split[1])),
+				tgbotapi.NewInlineKeyboardButtonData("Перейти до уроку", fmt.Sprintf("/view %s %s", lesson.ID, args[0])),
 			),
 		)
 		msg.Text = fmt.Sprintf("Урок %d. %s", i+1, lesson.Title)
 		msg.ReplyMarkup = viewLesson
-		_, err = b.api.Send(msg)
-		handleError(err)
+		_, err := b.api.Send(msg)
+		b.handleError(ctx, err)
 	}
 }
 
-func (b *Bot) viewLessonCallback(update tgbotapi.Update, split []string) {
-	lesson, err := b.cache.GetLesson(split[1])
-	if err != nil {
-		fmt.Printf("cache error: %s", err)
-		lesson, err = b.db.GetLesson(context.TODO(), split[1])
-		if errors.Is(err, db.ErrNotFound) {
-			handleError(err)
+func (b *Bot) viewLessonCallback(ctx context.Context, update tgbotapi.Update) {
+	args := callbackArgs(update)
+	if len(args) == 0 {
+		return
+	}
+	courseID := ""
+	if len(args) > 1 {
+		courseID = args[1]
+	} else {
+		// Lessons opened from search results are looked up in the courses
+		// of the user.
+		courses, err := b.db.GetUserCourses(ctx, accountFrom(ctx).ChatID)
+		if err != nil {
+			b.handleError(ctx, err)
 			return
 		}
+		for _, course := range courses {
+			if contains(course.LessonIDs, args[0]) {
+				courseID = course.ID
+				break
+			}
+		}
+		if courseID == "" {
+			b.reply(ctx, "Урок доступний лише учасникам курсу.")
+			return
+		}
+	}
+	lessons, ok := b.enrolledLessons(ctx, courseID)
+	if !ok {
+		return
+	}
+	var lesson *models.Lesson
+	for i := range lessons {
+		if lessons[i].ID == args[0] {
+			lesson = &lessons[i]
+			break
+		}
+	}
+	if lesson == nil {
+		b.reply(ctx, "Урок не знайдено.")
+		return
 	}
-	b.cache.SetLesson(split[1], lesson, 0)
 
 	msg := tgbotapi.NewMessage(update.CallbackQuery.From.ID, "")
-	var back = tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("Назад", fmt.Sprintf("/lessons %s", split[2])),
-		),
-	)
 	msg.Text = fmt.Sprintf("%s\nЛекція: %s\nЗавдання: %s\nЧас виконання: %d хвилин", lesson.Title, lesson.Lection, lesson.Task, lesson.EstimatedTime)
-	msg.ReplyMarkup = back
-	_, err = b.api.Send(msg)
-	handleError(err)
+	// Lessons opened from search results have no course to go back to.
+	if len(args) > 1 {
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Назад", fmt.Sprintf("/lessons %s", args[1])),
+			),
+		)
+	}
+	_, err := b.api.Send(msg)
+	b.handleError(ctx, err)
 }
 
-func handleError(err error) {
+// enrolledLessons returns the lessons of the course when the user is
+// enrolled in it, otherwise it replies why they are not shown.
+func (b *Bot) enrolledLessons(ctx context.Context, courseID string) ([]models.Lesson, bool) {
+	user := accountFrom(ctx)
+	if _, err := b.db.GetAvailableCourse(ctx, user.ChatID, courseID); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			b.reply(ctx, "Курс не знайдено.")
+		} else {
+			b.handleError(ctx, err)
+		}
+		return nil, false
+	}
+	enrollment, err := b.db.GetEnrollment(ctx, user.ID, courseID)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		b.handleError(ctx, err)
+		return nil, false
+	}
+	if err != nil || enrollment.Status == models.EnrollmentDropped {
+		b.reply(ctx, "Уроки доступні лише учасникам курсу.")
+		return nil, false
+	}
+	lessons, err := b.db.GetCourseLessons(ctx, courseID)
 	if err != nil {
-		fmt.Printf("ERROR: %s", err)
+		b.handleError(ctx, err)
+		return nil, false
+	}
+	return lessons, true
+}
+
+// contains tells whether ids contain id.
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// handleError logs err. While the database is unavailable the sender is
+// asked to come back later instead of getting no reply.
+func (b *Bot) handleError(ctx context.Context, err error) {
+	if err == nil {
+		return
+	}
+	request.LoggerFrom(ctx).Printf("ERROR: %s", err)
+	if errors.Is(err, db.ErrUnavailable) {
+		b.reply(ctx, "Сервіс тимчасово недоступний, спробуйте пізніше.")
+	}
+}
+
+// send sends text to the chat.
+func (b *Bot) send(ctx context.Context, chatID int64, text string) error {
+	_, err := b.api.Send(tgbotapi.NewMessage(chatID, text))
+	return err
+}
+
+// reply sends text to the sender of the update.
+func (b *Bot) reply(ctx context.Context, text string) {
+	user, ok := request.UserFrom(ctx)
+	if !ok {
+		return
 	}
+	if _, err := b.api.Send(tgbotapi.NewMessage(user.ID, text)); err != nil {
+		request.LoggerFrom(ctx).Printf("ERROR: %s", err)
+	}
+}
+
+// chatActor identifies a Telegram chat in the audit log.
+func chatActor(chatID int64) string {
+	return fmt.Sprintf("chat:%d", chatID)
 }
@@ -0,0 +1,213 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/models"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// End is the state that finishes a dialog.
+const End = ""
+
+// StateStore keeps dialog states between updates. db.Database satisfies it,
+// so dialogs survive restarts; MemoryStore keeps them in the process.
+type StateStore interface {
+	// GetChatState returns db.ErrNotFound when the chat has no dialog.
+	GetChatState(ctx context.Context, chatID int64) (models.ChatState, error)
+	SaveChatState(ctx context.Context, state models.ChatState) error
+	DeleteChatState(ctx context.Context, chatID int64) error
+}
+
+// StepFunc handles the answer to a step. It may change data and returns
+// the next state: the same state to ask again, or End.
+type StepFunc func(ctx context.Context, update tgbotapi.Update, data map[string]string) (string, error)
+
+// Step is a named state of a dialog, e.g. "login.password".
+type Step struct {
+	// Prompt is sent when the dialog enters the step.
+	Prompt string
+	// Timeout is how long the step waits for the answer, the FSM default
+	// when zero.
+	Timeout time.Duration
+	Handler StepFunc
+}
+
+// FSM drives multi-step dialogs, one per chat. The state is stored after
+// every transition, so a dialog goes on where it stopped after a restart.
+type FSM struct {
+	store   StateStore
+	timeout time.Duration
+	send    func(ctx context.Context, chatID int64, text string) error
+	now     func() time.Time
+	steps   map[string]Step
+}
+
+// NewFSM creating a new FSM object.
+func NewFSM(store StateStore, timeout time.Duration, send func(ctx context.Context, chatID int64, text string) error) *FSM {
+	return &FSM{
+		store:   store,
+		timeout: timeout,
+		send:    send,
+		now:     time.Now,
+		steps:   make(map[string]Step),
+	}
+}
+
+// Handle registers a step. It panics when the state is already taken.
+func (f *FSM) Handle(state string, step Step) {
+	if _, ok := f.steps[state]; ok || state == End {
+		panic(fmt.Sprintf("bot: state %q is registered twice", state))
+	}
+	f.steps[state] = step
+}
+
+// Start begins a dialog in state, replacing the dialog the chat was in.
+func (f *FSM) Start(ctx context.Context, chatID int64, state string, data map[string]string) error {
+	if _, ok := f.steps[state]; !ok {
+		return fmt.Errorf("bot: unknown state %q", state)
+	}
+	if data == nil {
+		data = make(map[string]string)
+	}
+	return f.enter(ctx, chatID, state, data)
+}
+
+// Dispatch passes a text message to the dialog of its chat. It reports
+// false when the chat has no dialog.
+func (f *FSM) Dispatch(ctx context.Context, update tgbotapi.Update) (bool, error) {
+	if update.Message == nil || update.Message.IsCommand() {
+		return false, nil
+	}
+	chatID := update.Message.Chat.ID
+	state, err := f.store.GetChatState(ctx, chatID)
+	if errors.Is(err, db.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := f.steps[state.State]
+	if !ok {
+		// Left by a version of the bot that had the step.
+		return false, f.store.DeleteChatState(ctx, chatID)
+	}
+	if f.now().After(state.ExpiresAt) {
+		if err := f.store.DeleteChatState(ctx, chatID); err != nil {
+			return true, err
+		}
+		return true, f.send(ctx, chatID, "Час очікування відповіді минув, почніть спочатку.")
+	}
+
+	if state.Data == nil {
+		state.Data = make(map[string]string)
+	}
+	next, err := step.Handler(ctx, update, state.Data)
+	if err != nil {
+		return true, err
+	}
+	if next == End {
+		return true, f.store.DeleteChatState(ctx, chatID)
+	}
+	if _, ok := f.steps[next]; !ok {
+		return true, fmt.Errorf("bot: %s moved to unknown state %q", state.State, next)
+	}
+	if next == state.State {
+		return true, f.save(ctx, chatID, next, state.Data)
+	}
+	return true, f.enter(ctx, chatID, next, state.Data)
+}
+
+// Cancel ends the dialog of the chat. It reports false when there was none.
+func (f *FSM) Cancel(ctx context.Context, chatID int64) (bool, error) {
+	_, err := f.store.GetChatState(ctx, chatID)
+	if errors.Is(err, db.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, f.store.DeleteChatState(ctx, chatID)
+}
+
+// enter stores the state and sends its prompt.
+func (f *FSM) enter(ctx context.Context, chatID int64, state string, data map[string]string) error {
+	if err := f.save(ctx, chatID, state, data); err != nil {
+		return err
+	}
+	if prompt := f.steps[state].Prompt; prompt != "" {
+		return f.send(ctx, chatID, prompt)
+	}
+	return nil
+}
+
+// save stores the state with a fresh deadline for the answer.
+func (f *FSM) save(ctx context.Context, chatID int64, state string, data map[string]string) error {
+	timeout := f.steps[state].Timeout
+	if timeout <= 0 {
+		timeout = f.timeout
+	}
+	now := f.now()
+	return f.store.SaveChatState(ctx, models.ChatState{
+		ChatID:    chatID,
+		State:     state,
+		Data:      data,
+		ExpiresAt: now.Add(timeout),
+		UpdatedAt: now,
+	})
+}
+
+// MemoryStore is a StateStore for a single process, dialogs are lost on
+// restart.
+type MemoryStore struct {
+	mu     sync.Mutex
+	states map[int64]models.ChatState
+}
+
+// NewMemoryStore creating a new MemoryStore object.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{states: make(map[int64]models.ChatState)}
+}
+
+func (s *MemoryStore) GetChatState(ctx context.Context, chatID int64) (models.ChatState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.states[chatID]
+	if !ok {
+		return state, db.ErrNotFound
+	}
+	state.Data = copyData(state.Data)
+	return state, nil
+}
+
+func (s *MemoryStore) SaveChatState(ctx context.Context, state models.ChatState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state.Data = copyData(state.Data)
+	s.states[state.ChatID] = state
+	return nil
+}
+
+func (s *MemoryStore) DeleteChatState(ctx context.Context, chatID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.states, chatID)
+	return nil
+}
+
+func copyData(data map[string]string) map[string]string {
+	if data == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(data))
+	for k, v := range data {
+		copied[k] = v
+	}
+	return copied
+}
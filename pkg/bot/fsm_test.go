@@ -0,0 +1,195 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/db/sql"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func textUpdate(chatID int64, text string) tgbotapi.Update {
+	return tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: chatID}, Text: text}}
+}
+
+// newLoginFSM returns an FSM with a two-step login dialog and the texts it
+// sent. The password step waits a minute, the email step the default hour.
+func newLoginFSM(store StateStore, done *map[string]string) (*FSM, *[]string) {
+	var sent []string
+	f := NewFSM(store, time.Hour, func(ctx context.Context, chatID int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	})
+	f.Handle("login.email", Step{
+		Prompt: "email?",
+		Handler: func(ctx context.Context, update tgbotapi.Update, data map[string]string) (string, error) {
+			if update.Message.Text == "" {
+				return "login.email", nil
+			}
+			data["email"] = update.Message.Text
+			return "login.password", nil
+		},
+	})
+	f.Handle("login.password", Step{
+		Prompt:  "password?",
+		Timeout: time.Minute,
+		Handler: func(ctx context.Context, update tgbotapi.Update, data map[string]string) (string, error) {
+			data["password"] = update.Message.Text
+			*done = data
+			return End, nil
+		},
+	})
+	return f, &sent
+}
+
+func TestFSMSteps(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	var done map[string]string
+	f, sent := newLoginFSM(store, &done)
+
+	if ok, err := f.Dispatch(ctx, textUpdate(1, "a@b.c")); ok || err != nil {
+		t.Fatalf("Dispatch without a dialog = %v, %v", ok, err)
+	}
+	if err := f.Start(ctx, 1, "login.email", nil); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := f.Dispatch(ctx, textUpdate(1, "")); !ok || err != nil {
+		t.Fatalf("Dispatch = %v, %v", ok, err)
+	}
+	if state, _ := store.GetChatState(ctx, 1); state.State != "login.email" {
+		t.Errorf("state after an empty answer = %q, want login.email", state.State)
+	}
+	if _, err := f.Dispatch(ctx, textUpdate(1, "a@b.c")); err != nil {
+		t.Fatal(err)
+	}
+	state, err := store.GetChatState(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.State != "login.password" || state.Data["email"] != "a@b.c" {
+		t.Errorf("state = %+v", state)
+	}
+	if _, err := f.Dispatch(ctx, textUpdate(1, "secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	if done["email"] != "a@b.c" || done["password"] != "secret" {
+		t.Errorf("dialog finished with %v", done)
+	}
+	if _, err := store.GetChatState(ctx, 1); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("state after End: %v, want %v", err, db.ErrNotFound)
+	}
+	want := []string{"email?", "password?"}
+	if len(*sent) != len(want) || (*sent)[0] != want[0] || (*sent)[1] != want[1] {
+		t.Errorf("sent %q, want %q", *sent, want)
+	}
+	if err := f.Start(ctx, 1, "login.unknown", nil); err == nil {
+		t.Error("Start in an unknown state succeeded")
+	}
+}
+
+func TestFSMStepTimeout(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	var done map[string]string
+	f, sent := newLoginFSM(store, &done)
+	now := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	f.now = func() time.Time { return now }
+
+	if err := f.Start(ctx, 1, "login.email", nil); err != nil {
+		t.Fatal(err)
+	}
+	// The email step has the default timeout.
+	now = now.Add(30 * time.Minute)
+	if _, err := f.Dispatch(ctx, textUpdate(1, "a@b.c")); err != nil {
+		t.Fatal(err)
+	}
+	// The password step has its own.
+	now = now.Add(2 * time.Minute)
+	if ok, err := f.Dispatch(ctx, textUpdate(1, "secret")); !ok || err != nil {
+		t.Fatalf("Dispatch = %v, %v", ok, err)
+	}
+
+	if done != nil {
+		t.Errorf("expired step handled the answer: %v", done)
+	}
+	if _, err := store.GetChatState(ctx, 1); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("state after timeout: %v, want %v", err, db.ErrNotFound)
+	}
+	if last := (*sent)[len(*sent)-1]; last != "Час очікування відповіді минув, почніть спочатку." {
+		t.Errorf("last message %q", last)
+	}
+}
+
+func TestFSMCancel(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	var done map[string]string
+	f, _ := newLoginFSM(store, &done)
+
+	if ok, err := f.Cancel(ctx, 1); ok || err != nil {
+		t.Fatalf("Cancel without a dialog = %v, %v", ok, err)
+	}
+	if err := f.Start(ctx, 1, "login.email", nil); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := f.Cancel(ctx, 1); !ok || err != nil {
+		t.Fatalf("Cancel = %v, %v", ok, err)
+	}
+	if ok, err := f.Dispatch(ctx, textUpdate(1, "a@b.c")); ok || err != nil {
+		t.Errorf("Dispatch after Cancel = %v, %v", ok, err)
+	}
+}
+
+func TestFSMResume(t *testing.T) {
+	ctx := context.Background()
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db")
+	open := func() *sql.Database {
+		d, err := sql.New(sql.DriverSQLite, dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migrator, err := d.Migrator(io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := migrator.Up(ctx, 0); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	d := open()
+	var done map[string]string
+	f, _ := newLoginFSM(d, &done)
+	if err := f.Start(ctx, 1, "login.email", map[string]string{"course": "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Dispatch(ctx, textUpdate(1, "a@b.c")); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	// A restarted bot goes on from the stored step with the stored answers.
+	d = open()
+	defer d.Close()
+	f, sent := newLoginFSM(d, &done)
+	if ok, err := f.Dispatch(ctx, textUpdate(1, "secret")); !ok || err != nil {
+		t.Fatalf("Dispatch = %v, %v", ok, err)
+	}
+	if done["course"] != "c1" || done["email"] != "a@b.c" || done["password"] != "secret" {
+		t.Errorf("resumed dialog finished with %v", done)
+	}
+	if len(*sent) != 0 {
+		t.Errorf("resumed dialog sent %q", *sent)
+	}
+	if _, err := d.GetChatState(ctx, 1); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("state after End: %v, want %v", err, db.ErrNotFound)
+	}
+}
@@ -0,0 +1,173 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/config"
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/models"
+	"github.com/DanilLagunov/diploma/pkg/request"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// maxLimitedUsers bounds the rate limiter state, users with a full bucket
+// are forgotten when it is reached.
+const maxLimitedUsers = 10000
+
+// recovery keeps a panicking handler from taking the bot down.
+func recovery(route *Route, next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, update tgbotapi.Update) {
+		defer func() {
+			if r := recover(); r != nil {
+				request.LoggerFrom(ctx).Printf("panic in %s: %v\n%s", route.Name(), r, debug.Stack())
+			}
+		}()
+		next(ctx, update)
+	}
+}
+
+// logging logs every handled update with its duration.
+func logging(route *Route, next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, update tgbotapi.Update) {
+		start := time.Now()
+		next(ctx, update)
+		request.LoggerFrom(ctx).Printf("%s handled in %s", route.Name(), time.Since(start).Round(time.Millisecond))
+	}
+}
+
+type accountKey struct{}
+
+// accountFrom returns the account loaded by auth.
+func accountFrom(ctx context.Context) models.User {
+	user, _ := ctx.Value(accountKey{}).(models.User)
+	return user
+}
+
+// auth loads the account bound to the chat for routes that need one.
+func (b *Bot) auth(route *Route, next HandlerFunc) HandlerFunc {
+	if route.Role == RoleGuest {
+		return next
+	}
+	return func(ctx context.Context, update tgbotapi.Update) {
+		sender, ok := request.UserFrom(ctx)
+		if !ok {
+			return
+		}
+		user, err := b.db.GetUserByChatID(ctx, sender.ID)
+		if errors.Is(err, db.ErrNotFound) {
+			b.reply(ctx, "Ви не авторизовані!")
+			return
+		}
+		if err != nil {
+			b.handleError(ctx, err)
+			return
+		}
+		next(context.WithValue(ctx, accountKey{}, user), update)
+	}
+}
+
+// rateLimit drops updates of users exceeding the configured rate. The user
+// is told once per limited stretch, callback queries are always answered
+// so the button stops loading.
+func (b *Bot) rateLimit(cfg config.RateLimit) Middleware {
+	limiter := &limiter{
+		rate:    float64(cfg.PerMinute) / 60,
+		burst:   float64(cfg.Burst),
+		now:     time.Now,
+		buckets: make(map[int64]*bucket),
+	}
+	return func(route *Route, next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, update tgbotapi.Update) {
+			sender, ok := request.UserFrom(ctx)
+			if !ok {
+				next(ctx, update)
+				return
+			}
+			allowed, warn := limiter.allow(sender.ID)
+			if allowed {
+				next(ctx, update)
+				return
+			}
+			request.LoggerFrom(ctx).Printf("%s rate limited", route.Name())
+			text := ""
+			if warn {
+				text = rateLimitedText
+			}
+			if update.CallbackQuery != nil {
+				if _, err := b.api.Request(tgbotapi.NewCallback(update.CallbackQuery.ID, text)); err != nil {
+					request.LoggerFrom(ctx).Printf("ERROR: %s", err)
+				}
+				return
+			}
+			if warn {
+				b.reply(ctx, text)
+			}
+		}
+	}
+}
+
+const rateLimitedText = "Забагато запитів, спробуйте трохи пізніше."
+
+// limiter is a token bucket per user.
+type limiter struct {
+	rate  float64 // tokens per second
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[int64]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+	// limited is set once an update was dropped, until one is allowed.
+	limited bool
+}
+
+// allow takes a token of the user. warn is set for the first update
+// dropped since the user was last allowed.
+func (l *limiter) allow(id int64) (allowed, warn bool) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[id]
+	if !ok {
+		if len(l.buckets) >= maxLimitedUsers {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.burst, at: now}
+		l.buckets[id] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.at = now
+	if b.tokens < 1 {
+		warn = !b.limited
+		b.limited = true
+		return false, warn
+	}
+	b.tokens--
+	b.limited = false
+	return true, false
+}
+
+func (l *limiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.at).Seconds()*l.rate
+	if tokens > l.burst {
+		return l.burst
+	}
+	return tokens
+}
+
+// prune forgets users whose bucket is full again.
+func (l *limiter) prune(now time.Time) {
+	for id, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, id)
+		}
+	}
+}
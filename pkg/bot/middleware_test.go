@@ -0,0 +1,29 @@
+package bot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterWarnsOnce(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := &limiter{rate: 1, burst: 1, now: func() time.Time { return now }, buckets: make(map[int64]*bucket)}
+
+	if allowed, _ := l.allow(1); !allowed {
+		t.Fatal("first update dropped")
+	}
+	if allowed, warn := l.allow(1); allowed || !warn {
+		t.Errorf("second update: allowed %v, warn %v, want dropped with a warning", allowed, warn)
+	}
+	if allowed, warn := l.allow(1); allowed || warn {
+		t.Errorf("third update: allowed %v, warn %v, want dropped silently", allowed, warn)
+	}
+
+	now = now.Add(time.Second)
+	if allowed, _ := l.allow(1); !allowed {
+		t.Fatal("update dropped after the refill")
+	}
+	if allowed, warn := l.allow(1); allowed || !warn {
+		t.Errorf("next window: allowed %v, warn %v, want dropped with a warning", allowed, warn)
+	}
+}
@@ -0,0 +1,290 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+var (
+	// ErrPoolClosed is returned by Submit after Close.
+	ErrPoolClosed = errors.New("update pool is closed")
+	// ErrQueueFull is returned by TrySubmit when the queue has no room.
+	ErrQueueFull = errors.New("update queue is full")
+	// ErrChatQueueFull is returned by TrySubmit when the chat of the update
+	// has maxChatQueued updates waiting.
+	ErrChatQueueFull = errors.New("chat update queue is full")
+)
+
+const (
+	// maxChatQueued bounds the updates waiting for one chat, so a flooding
+	// chat can not fill the queue of everyone. Beyond it Submit waits for
+	// the chat and TrySubmit fails.
+	maxChatQueued = 16
+	// fullLogInterval limits the log lines about a full queue.
+	fullLogInterval = time.Minute
+)
+
+// Pool handles updates on a fixed number of workers. Every chat has its own
+// queue and at most one worker at a time, so the updates of one chat are
+// handled in arrival order. Workers take the chats in turns, one update
+// each, so a slow chat holds up only itself.
+type Pool struct {
+	handle  func(update tgbotapi.Update)
+	workers int
+	// slots has room for the updates that may wait, Submit takes a slot
+	// and a worker gives it back when it picks the update.
+	slots chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	mu    sync.Mutex
+	ready *sync.Cond
+	// chats holds the waiting updates of every chat with any, runnable the
+	// chats with updates and no worker, in turn order.
+	chats    map[int64]*chatQueue
+	runnable []int64
+	closed   bool
+
+	busy        int
+	handled     uint64
+	blocked     uint64
+	dropped     uint64
+	lastFullLog time.Time
+}
+
+type chatQueue struct {
+	updates []tgbotapi.Update
+	// running is set while a worker handles an update of the chat.
+	running bool
+	// room is closed when an update leaves the full queue, Submit waits
+	// on it.
+	room chan struct{}
+}
+
+// PoolStats is a snapshot of the pool for the metrics.
+type PoolStats struct {
+	Workers int `json:"workers"`
+	// Capacity is the number of updates that may wait in all queues.
+	Capacity int `json:"capacity"`
+	// Queued is the number of waiting updates, Chats the number of chats
+	// they belong to and MaxChatQueued the longest queue of a chat.
+	Queued        int `json:"queued"`
+	Chats         int `json:"chats"`
+	MaxChatQueued int `json:"max_chat_queued"`
+	Busy          int `json:"busy"`
+	// Handled counts the handled updates, Blocked the updates that waited
+	// for room in the full queue or chat queue and Dropped the updates
+	// refused by TrySubmit.
+	Handled uint64 `json:"handled"`
+	Blocked uint64 `json:"blocked"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// NewPool creating a new Pool object and starts its workers. Up to
+// queueSize updates wait for a worker.
+func NewPool(workers, queueSize int, handle func(update tgbotapi.Update)) *Pool {
+	p := &Pool{
+		handle:  handle,
+		workers: workers,
+		slots:   make(chan struct{}, queueSize),
+		done:    make(chan struct{}),
+		chats:   make(map[int64]*chatQueue),
+	}
+	p.ready = sync.NewCond(&p.mu)
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		for len(p.runnable) == 0 && !p.closed {
+			p.ready.Wait()
+		}
+		if len(p.runnable) == 0 {
+			return
+		}
+		id := p.runnable[0]
+		p.runnable = p.runnable[1:]
+		chat := p.chats[id]
+		update := chat.updates[0]
+		chat.updates = chat.updates[1:]
+		chat.running = true
+		if chat.room != nil {
+			close(chat.room)
+			chat.room = nil
+		}
+		p.busy++
+		<-p.slots
+
+		p.mu.Unlock()
+		p.handle(update)
+		p.mu.Lock()
+
+		p.busy--
+		p.handled++
+		chat.running = false
+		if len(chat.updates) > 0 {
+			p.runnable = append(p.runnable, id)
+			p.ready.Signal()
+		} else {
+			delete(p.chats, id)
+		}
+	}
+}
+
+// Submit queues the update. While the queue or the queue of the chat is
+// full it blocks, which pauses receiving, until there is room or ctx is
+// done.
+func (p *Pool) Submit(ctx context.Context, update tgbotapi.Update) error {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		p.full(true)
+		select {
+		case p.slots <- struct{}{}:
+		case <-p.done:
+			return ErrPoolClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for {
+		room, err := p.enqueue(update, true)
+		if room == nil {
+			return err
+		}
+		select {
+		case <-room:
+		case <-p.done:
+			<-p.slots
+			return ErrPoolClosed
+		case <-ctx.Done():
+			<-p.slots
+			return ctx.Err()
+		}
+	}
+}
+
+// TrySubmit queues the update, or returns ErrQueueFull or ErrChatQueueFull
+// at once when there is no room.
+func (p *Pool) TrySubmit(update tgbotapi.Update) error {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		p.full(false)
+		return ErrQueueFull
+	}
+	_, err := p.enqueue(update, false)
+	return err
+}
+
+// enqueue adds the update to the queue of its chat, it holds a slot. When
+// the chat queue is full a waiting caller gets a channel closed once there
+// is room, keeping the slot; otherwise the slot is given back.
+func (p *Pool) enqueue(update tgbotapi.Update, wait bool) (<-chan struct{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		<-p.slots
+		return nil, ErrPoolClosed
+	}
+	id := chatOf(update)
+	chat, ok := p.chats[id]
+	if !ok {
+		chat = &chatQueue{}
+		p.chats[id] = chat
+	}
+	if len(chat.updates) >= maxChatQueued {
+		if !wait {
+			<-p.slots
+			p.dropped++
+			log.Printf("chat %d has %d updates waiting, update %d refused", id, len(chat.updates), update.UpdateID)
+			return nil, ErrChatQueueFull
+		}
+		p.blocked++
+		if chat.room == nil {
+			chat.room = make(chan struct{})
+		}
+		return chat.room, nil
+	}
+	chat.updates = append(chat.updates, update)
+	if !chat.running && len(chat.updates) == 1 {
+		p.runnable = append(p.runnable, id)
+		p.ready.Signal()
+	}
+	return nil, nil
+}
+
+// full counts an update that found the queue full, and logs it at most
+// once per fullLogInterval.
+func (p *Pool) full(blocking bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if blocking {
+		p.blocked++
+	} else {
+		p.dropped++
+	}
+	if now := time.Now(); now.Sub(p.lastFullLog) >= fullLogInterval {
+		p.lastFullLog = now
+		log.Printf("update queue is full: %d blocked, %d dropped so far", p.blocked, p.dropped)
+	}
+}
+
+// Close stops accepting updates and returns once the queued updates are
+// handled.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+		p.ready.Broadcast()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// Stats returns the current queue depth and counters.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := PoolStats{
+		Workers:  p.workers,
+		Capacity: cap(p.slots),
+		Chats:    len(p.chats),
+		Busy:     p.busy,
+		Handled:  p.handled,
+		Blocked:  p.blocked,
+		Dropped:  p.dropped,
+	}
+	for _, chat := range p.chats {
+		stats.Queued += len(chat.updates)
+		if len(chat.updates) > stats.MaxChatQueued {
+			stats.MaxChatQueued = len(chat.updates)
+		}
+	}
+	return stats
+}
+
+// chatOf returns the chat of the update, updates without a chat are
+// ordered by sender.
+func chatOf(update tgbotapi.Update) int64 {
+	if chat := update.FromChat(); chat != nil {
+		return chat.ID
+	}
+	if from := update.SentFrom(); from != nil {
+		return from.ID
+	}
+	return 0
+}
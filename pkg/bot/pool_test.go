@@ -0,0 +1,268 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func chatUpdate(chatID int64, updateID int) tgbotapi.Update {
+	return tgbotapi.Update{UpdateID: updateID, Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: chatID}}}
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolChatOrder(t *testing.T) {
+	var mu sync.Mutex
+	got := map[int64][]int{}
+	pool := NewPool(4, 64, func(update tgbotapi.Update) {
+		mu.Lock()
+		defer mu.Unlock()
+		got[update.Message.Chat.ID] = append(got[update.Message.Chat.ID], update.UpdateID)
+	})
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		for chat := int64(1); chat <= 3; chat++ {
+			if err := pool.Submit(ctx, chatUpdate(chat, i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	pool.Close()
+
+	for chat := int64(1); chat <= 3; chat++ {
+		if len(got[chat]) != 10 {
+			t.Fatalf("chat %d handled %v", chat, got[chat])
+		}
+		for i, id := range got[chat] {
+			if id != i {
+				t.Errorf("chat %d handled %v, want arrival order", chat, got[chat])
+				break
+			}
+		}
+	}
+}
+
+func TestPoolChatsConcurrent(t *testing.T) {
+	started := make(chan int64, 2)
+	block := make(chan struct{})
+	pool := NewPool(2, 4, func(update tgbotapi.Update) {
+		started <- update.Message.Chat.ID
+		<-block
+	})
+	defer pool.Close()
+	defer close(block)
+	ctx := context.Background()
+	if err := pool.Submit(ctx, chatUpdate(1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Submit(ctx, chatUpdate(2, 2)); err != nil {
+		t.Fatal(err)
+	}
+	// Both chats run while neither handler returns.
+	seen := map[int64]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-started:
+			seen[id] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("chats started: %v", seen)
+		}
+	}
+	if stats := pool.Stats(); stats.Busy != 2 {
+		t.Errorf("Busy = %d, want 2", stats.Busy)
+	}
+}
+
+func TestPoolSubmitBlocks(t *testing.T) {
+	started := make(chan struct{}, 1)
+	block := make(chan struct{})
+	pool := NewPool(1, 1, func(tgbotapi.Update) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-block
+	})
+	defer pool.Close()
+	ctx := context.Background()
+	if err := pool.Submit(ctx, chatUpdate(1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := pool.Submit(ctx, chatUpdate(2, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every slot is taken, so the next Submit waits for the worker.
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := pool.Submit(timeout, chatUpdate(3, 3)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Submit on a full queue = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- pool.Submit(ctx, chatUpdate(3, 3)) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Submit returned %v before a slot was free", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(block)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if stats := pool.Stats(); stats.Blocked != 2 {
+		t.Errorf("Blocked = %d, want 2", stats.Blocked)
+	}
+}
+
+func TestPoolSubmitBlocksOnChat(t *testing.T) {
+	started := make(chan struct{}, 1)
+	block := make(chan struct{})
+	pool := NewPool(1, 2*maxChatQueued, func(tgbotapi.Update) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-block
+	})
+	defer pool.Close()
+	ctx := context.Background()
+	if err := pool.Submit(ctx, chatUpdate(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	for i := 1; i <= maxChatQueued; i++ {
+		if err := pool.Submit(ctx, chatUpdate(1, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The chat is full although the pool has room.
+	done := make(chan error, 1)
+	go func() { done <- pool.Submit(ctx, chatUpdate(1, maxChatQueued+1)) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Submit returned %v while the chat queue was full", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(block)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolTrySubmitFull(t *testing.T) {
+	started := make(chan struct{}, 1)
+	block := make(chan struct{})
+	pool := NewPool(1, maxChatQueued+1, func(tgbotapi.Update) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-block
+	})
+	defer pool.Close()
+	defer close(block)
+	if err := pool.TrySubmit(chatUpdate(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	for i := 1; i <= maxChatQueued; i++ {
+		if err := pool.TrySubmit(chatUpdate(1, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pool.TrySubmit(chatUpdate(1, 100)); !errors.Is(err, ErrChatQueueFull) {
+		t.Errorf("TrySubmit to a full chat = %v, want %v", err, ErrChatQueueFull)
+	}
+	if err := pool.TrySubmit(chatUpdate(2, 101)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.TrySubmit(chatUpdate(3, 102)); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("TrySubmit to a full queue = %v, want %v", err, ErrQueueFull)
+	}
+	if stats := pool.Stats(); stats.Dropped != 2 {
+		t.Errorf("Dropped = %d, want 2", stats.Dropped)
+	}
+}
+
+func TestPoolCloseDrains(t *testing.T) {
+	var mu sync.Mutex
+	handled := 0
+	pool := NewPool(2, 32, func(tgbotapi.Update) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		handled++
+		mu.Unlock()
+	})
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		if err := pool.Submit(ctx, chatUpdate(int64(i%3), i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool.Close()
+
+	if handled != 20 {
+		t.Errorf("handled %d updates before Close returned, want 20", handled)
+	}
+	if err := pool.Submit(ctx, chatUpdate(1, 20)); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("Submit after Close = %v, want %v", err, ErrPoolClosed)
+	}
+	if err := pool.TrySubmit(chatUpdate(1, 21)); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("TrySubmit after Close = %v, want %v", err, ErrPoolClosed)
+	}
+	if stats := pool.Stats(); stats.Handled != 20 || stats.Queued != 0 || stats.Chats != 0 {
+		t.Errorf("Stats after Close = %+v", stats)
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	started := make(chan struct{}, 1)
+	block := make(chan struct{})
+	pool := NewPool(1, 8, func(tgbotapi.Update) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-block
+	})
+	ctx := context.Background()
+	if err := pool.Submit(ctx, chatUpdate(1, 0)); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	for i, chat := range []int64{1, 1, 1, 2, 2, 3} {
+		if err := pool.Submit(ctx, chatUpdate(chat, i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := PoolStats{Workers: 1, Capacity: 8, Queued: 6, Chats: 3, MaxChatQueued: 3, Busy: 1}
+	if stats := pool.Stats(); stats != want {
+		t.Errorf("Stats = %+v, want %+v", stats, want)
+	}
+	close(block)
+	waitFor(t, func() bool { return pool.Stats().Handled == 7 })
+	pool.Close()
+	want = PoolStats{Workers: 1, Capacity: 8, Handled: 7}
+	if stats := pool.Stats(); stats != want {
+		t.Errorf("Stats = %+v, want %+v", stats, want)
+	}
+}
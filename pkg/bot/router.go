@@ -0,0 +1,169 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Role is the access level a route requires.
+type Role int
+
+const (
+	// RoleGuest routes are open to everyone.
+	RoleGuest Role = iota
+	// RoleUser routes need a chat bound to an account with /login.
+	RoleUser
+)
+
+// HandlerFunc handles one update.
+type HandlerFunc func(ctx context.Context, update tgbotapi.Update)
+
+// Middleware wraps the handler of a route.
+type Middleware func(route *Route, next HandlerFunc) HandlerFunc
+
+// Route binds a handler to the ways users reach it.
+type Route struct {
+	// Command without the slash, e.g. "courses".
+	Command string
+	// Usage lists the command arguments shown in /help.
+	Usage string
+	// Aliases are reply keyboard texts that run the route.
+	Aliases []string
+	// Callback is the first word of inline button data, e.g. "/register".
+	Callback string
+	// Description is shown in /help and the Telegram command menu,
+	// commands without one are hidden.
+	Description string
+	Role        Role
+	Handler     HandlerFunc
+}
+
+// Name identifies the route in logs.
+func (r *Route) Name() string {
+	switch {
+	case r.Command != "":
+		return "/" + r.Command
+	case r.Callback != "":
+		return r.Callback
+	default:
+		return "fallback"
+	}
+}
+
+// Router dispatches updates to routes through the middleware chain.
+type Router struct {
+	routes     []*Route
+	commands   map[string]*Route
+	aliases    map[string]*Route
+	callbacks  map[string]*Route
+	middleware []Middleware
+	// notFound handles commands and texts without a route.
+	notFound *Route
+}
+
+// NewRouter creating a new Router object. notFound gets the messages
+// without a route, through the middleware of a guest route.
+func NewRouter(notFound HandlerFunc) *Router {
+	r := &Router{
+		commands:  make(map[string]*Route),
+		aliases:   make(map[string]*Route),
+		callbacks: make(map[string]*Route),
+	}
+	if notFound != nil {
+		r.notFound = &Route{Handler: notFound}
+	}
+	return r
+}
+
+// Use appends middleware, the first one added runs outermost.
+func (r *Router) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Handle registers a route. It panics when a command, alias or callback is
+// already taken, as that is a programming error.
+func (r *Router) Handle(route Route) {
+	route.Command = strings.TrimPrefix(route.Command, "/")
+	registered := &route
+	register := func(index map[string]*Route, key, kind string) {
+		if key == "" {
+			return
+		}
+		if _, ok := index[key]; ok {
+			panic(fmt.Sprintf("bot: %s %q is registered twice", kind, key))
+		}
+		index[key] = registered
+	}
+	register(r.commands, route.Command, "command")
+	for _, alias := range route.Aliases {
+		register(r.aliases, alias, "alias")
+	}
+	register(r.callbacks, route.Callback, "callback")
+	r.routes = append(r.routes, registered)
+}
+
+// Dispatch runs the route matching the update. Messages without a route
+// go to notFound, other updates and callbacks with an unknown prefix are
+// dropped.
+func (r *Router) Dispatch(ctx context.Context, update tgbotapi.Update) {
+	route := r.match(update)
+	if route == nil && update.Message != nil {
+		route = r.notFound
+	}
+	if route == nil {
+		return
+	}
+	handler := route.Handler
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		handler = r.middleware[i](route, handler)
+	}
+	handler(ctx, update)
+}
+
+func (r *Router) match(update tgbotapi.Update) *Route {
+	switch {
+	case update.CallbackQuery != nil:
+		return r.callbacks[strings.SplitN(update.CallbackQuery.Data, " ", 2)[0]]
+	case update.Message == nil:
+		return nil
+	case update.Message.IsCommand():
+		return r.commands[update.Message.Command()]
+	default:
+		return r.aliases[update.Message.Text]
+	}
+}
+
+// Help lists the described commands in registration order.
+func (r *Router) Help() string {
+	var text strings.Builder
+	for _, route := range r.routes {
+		if route.Command == "" || route.Description == "" {
+			continue
+		}
+		text.WriteString("/" + route.Command)
+		if route.Usage != "" {
+			text.WriteString(" " + route.Usage)
+		}
+		text.WriteString(" - " + route.Description + "\n")
+	}
+	return text.String()
+}
+
+// Commands returns the described commands for the Telegram command menu.
+func (r *Router) Commands() []tgbotapi.BotCommand {
+	var commands []tgbotapi.BotCommand
+	for _, route := range r.routes {
+		if route.Command != "" && route.Description != "" {
+			commands = append(commands, tgbotapi.BotCommand{Command: route.Command, Description: route.Description})
+		}
+	}
+	return commands
+}
+
+// callbackArgs returns the words of the callback data after the prefix.
+func callbackArgs(update tgbotapi.Update) []string {
+	return strings.Fields(update.CallbackQuery.Data)[1:]
+}
@@ -0,0 +1,174 @@
+package bot
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/config"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// secretHeader carries the webhook secret in the requests of Telegram.
+const secretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// maxUpdateSize bounds the body of a webhook request.
+const maxUpdateSize = 1 << 20
+
+// readHeaderTimeout bounds the time a client may take to send the headers.
+const readHeaderTimeout = 10 * time.Second
+
+// WebhookHandler receives updates posted by Telegram and passes them to
+// submit. Requests without the secret are rejected. submit must not block,
+// when it fails Telegram sends the update again later.
+func WebhookHandler(secret string, submit func(update tgbotapi.Update) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(secretHeader)), []byte(secret)) != 1 {
+			log.Printf("webhook: request from %s without the secret", remoteAddr(r))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var update tgbotapi.Update
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUpdateSize)).Decode(&update); err != nil {
+			http.Error(w, "bad update", http.StatusBadRequest)
+			return
+		}
+		if err := submit(update); errors.Is(err, ErrChatQueueFull) {
+			// Telegram redelivers the update later.
+			http.Error(w, "too many updates", http.StatusTooManyRequests)
+			return
+		} else if err != nil {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// remoteAddr returns the client address, as seen by the reverse proxy when
+// there is one.
+func remoteAddr(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	return r.RemoteAddr
+}
+
+// WebhookServer is the HTTP server receiving the updates of every tenant.
+type WebhookServer struct {
+	cfg    config.Webhook
+	mux    *http.ServeMux
+	server *http.Server
+
+	mu      sync.Mutex
+	tenants map[string]bool
+}
+
+// NewWebhookServer creating a new WebhookServer object.
+func NewWebhookServer(cfg config.Webhook) *WebhookServer {
+	mux := http.NewServeMux()
+	return &WebhookServer{
+		cfg: cfg,
+		mux: mux,
+		server: &http.Server{
+			Addr:              cfg.Listen,
+			Handler:           mux,
+			ReadHeaderTimeout: readHeaderTimeout,
+		},
+		tenants: make(map[string]bool),
+	}
+}
+
+// ListenAndServe serves until Shutdown, over TLS when a certificate is
+// configured. It returns http.ErrServerClosed after Shutdown.
+func (s *WebhookServer) ListenAndServe() error {
+	if s.cfg.CertFile != "" {
+		return s.server.ListenAndServeTLS(s.cfg.CertFile, s.cfg.KeyFile)
+	}
+	return s.server.ListenAndServe()
+}
+
+// Shutdown stops the server, waiting for the requests in progress until
+// ctx is done.
+func (s *WebhookServer) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// Handle serves the updates of the tenant with handler and returns the
+// public URL Telegram has to post them to. A tenant is handled once.
+func (s *WebhookServer) Handle(tenantID string, handler http.Handler) (string, error) {
+	public, err := url.Parse(s.cfg.URL)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tenants[tenantID] {
+		return "", fmt.Errorf("webhook of tenant %s is already handled", tenantID)
+	}
+	s.tenants[tenantID] = true
+	base := s.cfg.Path
+	if base == "" {
+		base = public.Path
+	}
+	s.mux.Handle(path.Join("/", base, tenantID), handler)
+	public.Path = path.Join("/", public.Path, tenantID)
+	return public.String(), nil
+}
+
+// setWebhook points Telegram at the webhook of the bot. The API client has
+// no secret token parameter, so the request is made by hand.
+func (b *Bot) setWebhook(link string, cfg config.Webhook) error {
+	params := tgbotapi.Params{"url": link}
+	params.AddNonEmpty("secret_token", cfg.Secret.Value)
+	params.AddNonZero("max_connections", cfg.MaxConnections)
+	var err error
+	if cfg.SelfSigned {
+		_, err = b.api.UploadFiles("setWebhook", params, []tgbotapi.RequestFile{
+			{Name: "certificate", Data: tgbotapi.FilePath(cfg.CertFile)},
+		})
+	} else {
+		_, err = b.api.MakeRequest("setWebhook", params)
+	}
+	return err
+}
+
+// deleteWebhook removes the webhook, Telegram keeps the updates until the
+// bot asks for them again.
+func (b *Bot) deleteWebhook() error {
+	_, err := b.api.Request(tgbotapi.DeleteWebhookConfig{})
+	return err
+}
+
+// serveWebhook receives updates from the server until ctx is done.
+func (b *Bot) serveWebhook(ctx context.Context) error {
+	cfg := b.cfg.Webhook
+	link, err := b.server.Handle(b.tenant.ID, WebhookHandler(cfg.Secret.Value, b.pool.TrySubmit))
+	if err != nil {
+		return err
+	}
+	if err := b.setWebhook(link, cfg); err != nil {
+		return err
+	}
+	log.Printf("webhook of tenant %s set to %s", b.tenant.ID, link)
+
+	<-ctx.Done()
+	if err := b.deleteWebhook(); err != nil {
+		log.Printf("delete webhook of tenant %s: %s", b.tenant.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package bot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DanilLagunov/diploma/pkg/config"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestWebhookHandler(t *testing.T) {
+	handled := make(chan int, 1)
+	pool := NewPool(1, 1, func(update tgbotapi.Update) { handled <- update.UpdateID })
+	defer pool.Close()
+	handler := WebhookHandler("secret", pool.TrySubmit)
+
+	tests := []struct {
+		name   string
+		method string
+		secret string
+		body   string
+		want   int
+	}{
+		{"update", http.MethodPost, "secret", `{"update_id": 7}`, http.StatusOK},
+		{"no secret", http.MethodPost, "", `{"update_id": 8}`, http.StatusForbidden},
+		{"wrong secret", http.MethodPost, "wrong", `{"update_id": 8}`, http.StatusForbidden},
+		{"not post", http.MethodGet, "secret", "", http.StatusMethodNotAllowed},
+		{"bad json", http.MethodPost, "secret", `{"update_id":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/acme", strings.NewReader(tt.body))
+			if tt.secret != "" {
+				r.Header.Set(secretHeader, tt.secret)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+	if id := <-handled; id != 7 {
+		t.Errorf("handled update %d, want 7", id)
+	}
+}
+
+func TestWebhookHandlerClosed(t *testing.T) {
+	pool := NewPool(1, 1, func(tgbotapi.Update) {})
+	pool.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/acme", strings.NewReader(`{"update_id": 1}`))
+	r.Header.Set(secretHeader, "secret")
+	w := httptest.NewRecorder()
+	WebhookHandler("secret", pool.TrySubmit).ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestWebhookHandlerFull(t *testing.T) {
+	started := make(chan struct{}, 1)
+	block := make(chan struct{})
+	pool := NewPool(1, 1, func(tgbotapi.Update) {
+		started <- struct{}{}
+		<-block
+	})
+	defer pool.Close()
+	defer close(block)
+	// The worker holds the first update, the second fills the queue.
+	if err := pool.TrySubmit(tgbotapi.Update{UpdateID: 0}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := pool.TrySubmit(tgbotapi.Update{UpdateID: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/acme", strings.NewReader(`{"update_id": 2}`))
+	r.Header.Set(secretHeader, "secret")
+	w := httptest.NewRecorder()
+	WebhookHandler("secret", pool.TrySubmit).ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestWebhookServerHandle(t *testing.T) {
+	server := NewWebhookServer(config.Webhook{URL: "https://example.com/tg/"})
+	link, err := server.Handle("acme", http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "https://example.com/tg/acme" {
+		t.Errorf("link %s", link)
+	}
+	if _, err := server.Handle("acme", http.NotFoundHandler()); err == nil {
+		t.Error("tenant handled twice")
+	}
+	if server.server.ReadHeaderTimeout == 0 {
+		t.Error("no read header timeout")
+	}
+}
+
+func TestWebhookHandlerChatFull(t *testing.T) {
+	started := make(chan struct{}, 1)
+	block := make(chan struct{})
+	pool := NewPool(1, 2*maxChatQueued, func(tgbotapi.Update) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-block
+	})
+	defer pool.Close()
+	defer close(block)
+	chat := &tgbotapi.Chat{ID: 5}
+	if err := pool.TrySubmit(tgbotapi.Update{Message: &tgbotapi.Message{Chat: chat}}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	for i := 1; i <= maxChatQueued; i++ {
+		update := tgbotapi.Update{UpdateID: i, Message: &tgbotapi.Message{Chat: chat}}
+		if err := pool.TrySubmit(update); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body := `{"update_id": 100, "message": {"message_id": 1, "chat": {"id": 5}}}`
+	r := httptest.NewRequest(http.MethodPost, "/acme", strings.NewReader(body))
+	r.Header.Set(secretHeader, "secret")
+	w := httptest.NewRecorder()
+	WebhookHandler("secret", pool.TrySubmit).ServeHTTP(w, r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
@@ -38,4 +38,6 @@ type Cache interface {
 	SetUser(key string, value models.User, duration time.Duration)
 	SetCourse(key string, value models.Course, duration time.Duration)
 	SetLesson(key string, value models.Lesson, duration time.Duration)
+	// Close stops the background cleanup.
+	Close()
 }
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/DanilLagunov/diploma/pkg/cache"
+	"github.com/DanilLagunov/diploma/pkg/config"
 	"github.com/DanilLagunov/diploma/pkg/models"
 )
 
@@ -15,9 +16,11 @@ type MemCache struct {
 	users             map[string]cache.UserItem
 	courses           map[string]cache.CourseItem
 	lessons           map[string]cache.LessonItem
+	stop              chan struct{}
+	closeOnce         sync.Once
 }
 
-func NewMemCache(defaultExpiration, cleanupInterval time.Duration) *MemCache {
+func NewMemCache(cfg config.Cache) *MemCache {
 	users := make(map[string]cache.UserItem)
 	courses := make(map[string]cache.CourseItem)
 	lessons := make(map[string]cache.LessonItem)
@@ -26,11 +29,12 @@ func NewMemCache(defaultExpiration, cleanupInterval time.Duration) *MemCache {
 		users:             users,
 		courses:           courses,
 		lessons:           lessons,
-		defaultExpiration: defaultExpiration,
-		cleanupInterval:   cleanupInterval,
+		defaultExpiration: cfg.DefaultExpiration,
+		cleanupInterval:   cfg.CleanupInterval,
+		stop:              make(chan struct{}),
 	}
 
-	if cleanupInterval > 0 {
+	if cfg.CleanupInterval > 0 {
 		go cache.cleaner()
 	}
 
@@ -164,13 +168,23 @@ func (c *MemCache) SetLesson(key string, value models.Lesson, duration time.Dura
 }
 
 func (c *MemCache) cleaner() {
+	ticker := time.NewTicker(c.cleanupInterval)
+	defer ticker.Stop()
 	for {
-		<-time.After(c.cleanupInterval)
-
-		c.clearExpiredItems()
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.clearExpiredItems()
+		}
 	}
 }
 
+// Close stops the cleaner, the cache stays usable.
+func (c *MemCache) Close() {
+	c.closeOnce.Do(func() { close(c.stop) })
+}
+
 func (c *MemCache) clearExpiredItems() {
 	c.Lock()
 
@@ -0,0 +1,674 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/models"
+	"gopkg.in/yaml.v3"
+)
+
+// Supported storage drivers.
+const (
+	DriverMongo    = "mongo"
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite3"
+)
+
+// Supported ways of receiving bot updates.
+const (
+	ModePolling = "polling"
+	ModeWebhook = "webhook"
+)
+
+// Config of the bot process. Values are loaded from a YAML or JSON file,
+// then environment variables, then command line flags; later sources win.
+type Config struct {
+	Bot      Bot      `yaml:"bot"`
+	Database Database `yaml:"database"`
+	Backup   Backup   `yaml:"backup"`
+	Metrics  Metrics  `yaml:"metrics"`
+	// School is the profile of the school served without tenants.
+	School models.Tenant `yaml:"school"`
+	// Tenants are the schools served by the process. Without tenants the
+	// process serves School with the bot token and database above.
+	Tenants []Tenant `yaml:"tenants"`
+	// Tenant selects the tenant of the maintenance commands. It may be
+	// omitted when there is only one.
+	Tenant string `yaml:"tenant"`
+}
+
+// Tenant configures one school. Every tenant has its own bot and its own
+// database, so catalogs and users of different schools never mix.
+type Tenant struct {
+	models.Tenant `yaml:",inline"`
+	Token         Secret `yaml:"token"`
+	// DSN of the tenant database for the SQL drivers.
+	DSN Secret `yaml:"dsn"`
+	// MongoName is the tenant database name for the mongo driver.
+	MongoName string `yaml:"mongo_name"`
+}
+
+// tenantID limits tenant IDs to names safe in paths and database names.
+var tenantID = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Bot configures the Telegram client.
+type Bot struct {
+	Token Secret `yaml:"token"`
+	Debug bool   `yaml:"debug"`
+	// Mode selects long polling or a webhook for receiving updates.
+	Mode          string        `yaml:"mode"`
+	UpdateTimeout time.Duration `yaml:"update_timeout"`
+	Webhook       Webhook       `yaml:"webhook"`
+	// HandlerTimeout is the deadline of handling one update.
+	HandlerTimeout time.Duration `yaml:"handler_timeout"`
+	RateLimit      RateLimit     `yaml:"rate_limit"`
+	// ShutdownTimeout is how long a shutdown waits for the updates already
+	// received, handlers still running after it are cancelled.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// DialogTimeout is how long a dialog step waits for the answer.
+	DialogTimeout time.Duration `yaml:"dialog_timeout"`
+	// Workers handle updates concurrently, updates of one chat are handled
+	// in order, one at a time.
+	Workers int `yaml:"workers"`
+	// QueueSize is the number of updates waiting for a worker, of all
+	// chats. Receiving updates pauses while the queue is full.
+	QueueSize int   `yaml:"queue_size"`
+	Cache     Cache `yaml:"cache"`
+}
+
+// Webhook configures the HTTP server receiving updates in the webhook mode.
+// Every tenant gets its own path below the URL: URL/<tenant id>.
+type Webhook struct {
+	// URL is the public HTTPS address Telegram posts updates to, such as
+	// the address of a reverse proxy in front of the server.
+	URL string `yaml:"url"`
+	// Listen is the address of the HTTP server.
+	Listen string `yaml:"listen"`
+	// Path is the path the server handles, it defaults to the path of URL.
+	// Set it when the proxy rewrites paths.
+	Path string `yaml:"path"`
+	// Secret is sent by Telegram with every update, requests without it
+	// are rejected.
+	Secret Secret `yaml:"secret"`
+	// CertFile and KeyFile enable TLS on the server. Without them it serves
+	// plain HTTP for a proxy that terminates TLS.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// SelfSigned uploads CertFile to Telegram, which is needed for
+	// self-signed certificates.
+	SelfSigned bool `yaml:"self_signed"`
+	// MaxConnections limits the concurrent requests from Telegram, 0 keeps
+	// the Telegram default.
+	MaxConnections int `yaml:"max_connections"`
+}
+
+// webhookSecret is the character set Telegram allows in secret tokens.
+var webhookSecret = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+// RateLimit limits the updates handled per user, it is off when PerMinute
+// is 0.
+type RateLimit struct {
+	PerMinute int `yaml:"per_minute"`
+	Burst     int `yaml:"burst"`
+}
+
+// Cache configures the in-memory cache.
+type Cache struct {
+	DefaultExpiration time.Duration `yaml:"default_expiration"`
+	CleanupInterval   time.Duration `yaml:"cleanup_interval"`
+}
+
+// Database selects and configures the storage backend.
+type Database struct {
+	Driver string `yaml:"driver"`
+	// DSN is the connection string of the SQL drivers.
+	DSN   Secret `yaml:"dsn"`
+	Mongo Mongo  `yaml:"mongo"`
+	Retry Retry  `yaml:"retry"`
+}
+
+// Retry configures retries of transient database errors and the circuit
+// breaker that fails fast while the database is down.
+type Retry struct {
+	// Attempts per call, 1 disables retries.
+	Attempts   int           `yaml:"attempts"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// Budget limits retries while most calls fail: a failure takes one
+	// token, a success returns a tenth, retries need half of the tokens.
+	Budget int `yaml:"budget"`
+	// BreakerThreshold consecutive failures open the breaker for
+	// BreakerCooldown. A threshold of 0 disables the breaker.
+	BreakerThreshold int           `yaml:"breaker_threshold"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`
+}
+
+// Mongo configures the Mongo backend.
+type Mongo struct {
+	URI            Secret        `yaml:"uri"`
+	Name           string        `yaml:"name"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// BootstrapTimeout bounds applying validators and creating indexes on
+	// startup, which can take long on large collections.
+	BootstrapTimeout time.Duration `yaml:"bootstrap_timeout"`
+	Collections      Collections   `yaml:"collections"`
+}
+
+// Collections names the Mongo collections.
+type Collections struct {
+	Users       string `yaml:"users"`
+	Courses     string `yaml:"courses"`
+	Lessons     string `yaml:"lessons"`
+	Enrollments string `yaml:"enrollments"`
+	Audit       string `yaml:"audit"`
+	States      string `yaml:"states"`
+}
+
+// Backup configures scheduled backups, they are off when Interval is 0.
+type Backup struct {
+	Dir      string        `yaml:"dir"`
+	Interval time.Duration `yaml:"interval"`
+	// Keep is the number of archives kept, 0 keeps all of them.
+	Keep int `yaml:"keep"`
+}
+
+// Metrics configures the HTTP server of the expvar metrics at /debug/vars,
+// it is off when Addr is empty.
+type Metrics struct {
+	Addr string `yaml:"addr"`
+}
+
+// Secret is a value that may be kept in a separate file, such as a mounted
+// Docker or Kubernetes secret. In YAML it is either a plain string or
+// {file: path}. Its String method does not reveal the value.
+type Secret struct {
+	Value string
+	File  string
+}
+
+func (s *Secret) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*s = Secret{Value: node.Value}
+		return nil
+	}
+	var ref struct {
+		File string `yaml:"file"`
+	}
+	if err := node.Decode(&ref); err != nil {
+		return err
+	}
+	*s = Secret{File: ref.File}
+	return nil
+}
+
+func (s Secret) String() string {
+	if s.Value == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+func (s *Secret) resolve() error {
+	if s.File == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.File)
+	if err != nil {
+		return fmt.Errorf("read secret: %w", err)
+	}
+	s.Value = strings.TrimSpace(string(data))
+	return nil
+}
+
+// Default returns the configuration used for values no source sets.
+func Default() Config {
+	return Config{
+		School: models.Tenant{ID: "default"},
+		Bot: Bot{
+			Mode:            ModePolling,
+			UpdateTimeout:   60 * time.Second,
+			HandlerTimeout:  30 * time.Second,
+			DialogTimeout:   10 * time.Minute,
+			ShutdownTimeout: 20 * time.Second,
+			Webhook:         Webhook{Listen: ":8443"},
+			Workers:         8,
+			QueueSize:       512,
+			RateLimit: RateLimit{
+				PerMinute: 30,
+				Burst:     10,
+			},
+			Cache: Cache{
+				DefaultExpiration: 60 * time.Second,
+				CleanupInterval:   90 * time.Second,
+			},
+		},
+		Database: Database{
+			Driver: DriverMongo,
+			Retry: Retry{
+				Attempts:         3,
+				Backoff:          100 * time.Millisecond,
+				MaxBackoff:       2 * time.Second,
+				Budget:           10,
+				BreakerThreshold: 5,
+				BreakerCooldown:  30 * time.Second,
+			},
+			Mongo: Mongo{
+				ConnectTimeout:   10 * time.Second,
+				BootstrapTimeout: time.Minute,
+				Collections: Collections{
+					Users:       "users",
+					Courses:     "courses",
+					Lessons:     "lessons",
+					Enrollments: "enrollments",
+					Audit:       "audit",
+					States:      "chat_states",
+				},
+			},
+		},
+	}
+}
+
+// setting binds one value to its environment variable and flag.
+// Setting a secret's value or file from a source clears the other one,
+// so a later source overrides both.
+type setting struct {
+	env, flag, usage string
+	target           interface{}
+	clears           *string
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"BOT_TOKEN", "bot-token", "Telegram bot token", &c.Bot.Token.Value, &c.Bot.Token.File},
+		{"BOT_TOKEN_FILE", "bot-token-file", "file with the Telegram bot token", &c.Bot.Token.File, &c.Bot.Token.Value},
+		{"BOT_DEBUG", "bot-debug", "log Telegram API requests", &c.Bot.Debug, nil},
+		{"BOT_MODE", "bot-mode", "polling or webhook", &c.Bot.Mode, nil},
+		{"BOT_WEBHOOK_URL", "bot-webhook-url", "public HTTPS address of the webhook", &c.Bot.Webhook.URL, nil},
+		{"BOT_WEBHOOK_LISTEN", "bot-webhook-listen", "address of the webhook server", &c.Bot.Webhook.Listen, nil},
+		{"BOT_WEBHOOK_PATH", "bot-webhook-path", "path of the webhook server, defaults to the path of the URL", &c.Bot.Webhook.Path, nil},
+		{"BOT_WEBHOOK_SECRET", "bot-webhook-secret", "secret token of the webhook", &c.Bot.Webhook.Secret.Value, &c.Bot.Webhook.Secret.File},
+		{"BOT_WEBHOOK_SECRET_FILE", "bot-webhook-secret-file", "file with the secret token of the webhook", &c.Bot.Webhook.Secret.File, &c.Bot.Webhook.Secret.Value},
+		{"BOT_WEBHOOK_CERT_FILE", "bot-webhook-cert-file", "TLS certificate of the webhook server", &c.Bot.Webhook.CertFile, nil},
+		{"BOT_WEBHOOK_KEY_FILE", "bot-webhook-key-file", "TLS key of the webhook server", &c.Bot.Webhook.KeyFile, nil},
+		{"BOT_WEBHOOK_SELF_SIGNED", "bot-webhook-self-signed", "upload the self-signed certificate to Telegram", &c.Bot.Webhook.SelfSigned, nil},
+		{"BOT_WEBHOOK_MAX_CONNECTIONS", "bot-webhook-max-connections", "concurrent webhook requests from Telegram", &c.Bot.Webhook.MaxConnections, nil},
+		{"BOT_UPDATE_TIMEOUT", "bot-update-timeout", "long polling timeout", &c.Bot.UpdateTimeout, nil},
+		{"BOT_HANDLER_TIMEOUT", "bot-handler-timeout", "deadline of handling one update", &c.Bot.HandlerTimeout, nil},
+		{"BOT_SHUTDOWN_TIMEOUT", "bot-shutdown-timeout", "time to finish the received updates on shutdown", &c.Bot.ShutdownTimeout, nil},
+		{"BOT_DIALOG_TIMEOUT", "bot-dialog-timeout", "time a dialog step waits for the answer", &c.Bot.DialogTimeout, nil},
+		{"BOT_WORKERS", "bot-workers", "updates handled concurrently", &c.Bot.Workers, nil},
+		{"BOT_QUEUE_SIZE", "bot-queue-size", "updates waiting for a worker", &c.Bot.QueueSize, nil},
+		{"BOT_RATE_LIMIT", "bot-rate-limit", "updates per minute handled per user, 0 disables the limit", &c.Bot.RateLimit.PerMinute, nil},
+		{"BOT_RATE_BURST", "bot-rate-burst", "updates a user may send at once", &c.Bot.RateLimit.Burst, nil},
+		{"CACHE_EXPIRATION", "cache-expiration", "cache entry lifetime", &c.Bot.Cache.DefaultExpiration, nil},
+		{"CACHE_CLEANUP_INTERVAL", "cache-cleanup-interval", "interval between expired cache entry cleanups, 0 disables them", &c.Bot.Cache.CleanupInterval, nil},
+		{"DB_DRIVER", "db-driver", "storage driver: mongo, postgres or sqlite3", &c.Database.Driver, nil},
+		{"DB_DSN", "db-dsn", "SQL connection string", &c.Database.DSN.Value, &c.Database.DSN.File},
+		{"DB_DSN_FILE", "db-dsn-file", "file with the SQL connection string", &c.Database.DSN.File, &c.Database.DSN.Value},
+		{"DB_RETRY_ATTEMPTS", "db-retry-attempts", "attempts per database call, 1 disables retries", &c.Database.Retry.Attempts, nil},
+		{"DB_RETRY_BACKOFF", "db-retry-backoff", "initial backoff between attempts", &c.Database.Retry.Backoff, nil},
+		{"DB_RETRY_MAX_BACKOFF", "db-retry-max-backoff", "maximum backoff between attempts", &c.Database.Retry.MaxBackoff, nil},
+		{"DB_RETRY_BUDGET", "db-retry-budget", "retry tokens shared by all calls", &c.Database.Retry.Budget, nil},
+		{"DB_BREAKER_THRESHOLD", "db-breaker-threshold", "consecutive failures opening the circuit breaker, 0 disables it", &c.Database.Retry.BreakerThreshold, nil},
+		{"DB_BREAKER_COOLDOWN", "db-breaker-cooldown", "time the circuit breaker stays open", &c.Database.Retry.BreakerCooldown, nil},
+		{"MONGO_URI", "mongo-uri", "Mongo connection string", &c.Database.Mongo.URI.Value, &c.Database.Mongo.URI.File},
+		{"MONGO_URI_FILE", "mongo-uri-file", "file with the Mongo connection string", &c.Database.Mongo.URI.File, &c.Database.Mongo.URI.Value},
+		{"MONGO_DB", "mongo-db", "Mongo database name", &c.Database.Mongo.Name, nil},
+		{"MONGO_CONNECT_TIMEOUT", "mongo-connect-timeout", "Mongo connection timeout", &c.Database.Mongo.ConnectTimeout, nil},
+		{"MONGO_BOOTSTRAP_TIMEOUT", "mongo-bootstrap-timeout", "timeout of creating Mongo validators and indexes", &c.Database.Mongo.BootstrapTimeout, nil},
+		{"MONGO_USERS_COLLECTION", "mongo-users-collection", "users collection", &c.Database.Mongo.Collections.Users, nil},
+		{"MONGO_COURSES_COLLECTION", "mongo-courses-collection", "courses collection", &c.Database.Mongo.Collections.Courses, nil},
+		{"MONGO_LESSONS_COLLECTION", "mongo-lessons-collection", "lessons collection", &c.Database.Mongo.Collections.Lessons, nil},
+		{"MONGO_ENROLLMENTS_COLLECTION", "mongo-enrollments-collection", "enrollments collection", &c.Database.Mongo.Collections.Enrollments, nil},
+		{"MONGO_AUDIT_COLLECTION", "mongo-audit-collection", "audit log collection", &c.Database.Mongo.Collections.Audit, nil},
+		{"MONGO_STATES_COLLECTION", "mongo-states-collection", "dialog states collection", &c.Database.Mongo.Collections.States, nil},
+		{"BACKUP_DIR", "backup-dir", "directory of scheduled backups", &c.Backup.Dir, nil},
+		{"BACKUP_INTERVAL", "backup-interval", "interval between scheduled backups, 0 disables them", &c.Backup.Interval, nil},
+		{"BACKUP_KEEP", "backup-keep", "number of scheduled backups kept, 0 keeps all", &c.Backup.Keep, nil},
+		{"METRICS_ADDR", "metrics-addr", "address of the metrics HTTP server, empty disables it", &c.Metrics.Addr, nil},
+		{"SCHOOL_NAME", "school-name", "name of the school served without tenants", &c.School.Name, nil},
+		{"SCHOOL_EMAIL", "school-email", "contact email of the school", &c.School.Email, nil},
+		{"SCHOOL_PHONE", "school-phone", "contact phone of the school", &c.School.Phone, nil},
+		{"SCHOOL_ADDRESS", "school-address", "address of the school", &c.School.Address, nil},
+		{"TENANT", "tenant", "tenant of the migrate, seed, export, restore and audit commands", &c.Tenant, nil},
+	}
+}
+
+func (s setting) set(value string) error {
+	switch target := s.target.(type) {
+	case *string:
+		*target = value
+	case *int:
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*target = v
+	case *bool:
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*target = v
+	case *time.Duration:
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*target = v
+	default:
+		return fmt.Errorf("unsupported setting type %T", s.target)
+	}
+	if s.clears != nil {
+		*s.clears = ""
+	}
+	return nil
+}
+
+// flagValue records a flag until the file and environment are applied.
+type flagValue struct {
+	setting setting
+	value   *string
+}
+
+func (f flagValue) String() string { return "" }
+
+func (f flagValue) Set(value string) error {
+	*f.value = value
+	return nil
+}
+
+func (f flagValue) IsBoolFlag() bool {
+	_, ok := f.setting.target.(*bool)
+	return ok
+}
+
+// Load reads the configuration for the process started with args, which
+// exclude the program name. The file is given by -config or CONFIG_FILE.
+// It returns the arguments left after the flags.
+func Load(args []string) (Config, []string, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	fs := flag.NewFlagSet("diploma", flag.ContinueOnError)
+	file := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML or JSON configuration file")
+	flags := make([]string, len(settings))
+	for i, s := range settings {
+		fs.Var(flagValue{setting: s, value: &flags[i]}, s.flag, s.usage+" ($"+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	if *file != "" {
+		if err := cfg.loadFile(*file); err != nil {
+			return cfg, nil, err
+		}
+	}
+	// Empty variables are treated as unset.
+	for _, s := range settings {
+		if value := os.Getenv(s.env); value != "" {
+			if err := s.set(value); err != nil {
+				return cfg, nil, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if v, ok := f.Value.(flagValue); ok && err == nil {
+			if setErr := v.setting.set(*v.value); setErr != nil {
+				err = fmt.Errorf("-%s: %w", f.Name, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	secrets := []*Secret{&cfg.Bot.Token, &cfg.Bot.Webhook.Secret, &cfg.Database.DSN, &cfg.Database.Mongo.URI}
+	for i := range cfg.Tenants {
+		secrets = append(secrets, &cfg.Tenants[i].Token, &cfg.Tenants[i].DSN)
+	}
+	for _, secret := range secrets {
+		if err := secret.resolve(); err != nil {
+			return cfg, nil, err
+		}
+	}
+	return cfg, fs.Args(), nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	defer f.Close()
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks that every required field is set.
+func (c Config) Validate() error {
+	if err := c.Bot.Validate(); err != nil {
+		return err
+	}
+	if err := c.Backup.Validate(); err != nil {
+		return err
+	}
+	if err := c.Database.Validate(); err != nil {
+		return err
+	}
+	return c.validateTenants()
+}
+
+// ServedTenants returns the tenants served by the process.
+func (c Config) ServedTenants() []Tenant {
+	if len(c.Tenants) > 0 {
+		return c.Tenants
+	}
+	return []Tenant{{Tenant: c.School, Token: c.Bot.Token}}
+}
+
+// SelectedTenant returns the tenant chosen by the Tenant setting.
+func (c Config) SelectedTenant() (Tenant, error) {
+	tenants := c.ServedTenants()
+	if c.Tenant == "" {
+		if len(tenants) > 1 {
+			return Tenant{}, errors.New("several tenants are configured, select one with -tenant")
+		}
+		return tenants[0], nil
+	}
+	for _, tenant := range tenants {
+		if tenant.ID == c.Tenant {
+			return tenant, nil
+		}
+	}
+	return Tenant{}, fmt.Errorf("unknown tenant: %q", c.Tenant)
+}
+
+// Database returns the database settings of the tenant: base with the
+// tenant DSN or Mongo database name when they are set.
+func (t Tenant) Database(base Database) Database {
+	if t.DSN.Value != "" {
+		base.DSN = t.DSN
+	}
+	if t.MongoName != "" {
+		base.Mongo.Name = t.MongoName
+	}
+	return base
+}
+
+func (c Config) validateTenants() error {
+	ids := make(map[string]bool)
+	tokens := make(map[string]bool)
+	databases := make(map[string]bool)
+	for _, tenant := range c.ServedTenants() {
+		if !tenantID.MatchString(tenant.ID) {
+			return fmt.Errorf("tenant id %q must be lowercase letters, digits, - and _", tenant.ID)
+		}
+		if ids[tenant.ID] {
+			return fmt.Errorf("duplicate tenant id: %q", tenant.ID)
+		}
+		ids[tenant.ID] = true
+		if tenant.Name == "" {
+			return fmt.Errorf("tenant %s: name is required", tenant.ID)
+		}
+		if tenant.Token.Value == "" {
+			return fmt.Errorf("tenant %s: bot token is required", tenant.ID)
+		}
+		if tokens[tenant.Token.Value] {
+			return fmt.Errorf("tenant %s: bot token is used by another tenant", tenant.ID)
+		}
+		tokens[tenant.Token.Value] = true
+
+		database := tenant.Database(c.Database)
+		if err := database.Validate(); err != nil {
+			return fmt.Errorf("tenant %s: %w", tenant.ID, err)
+		}
+		key := database.DSN.Value
+		if database.Driver == DriverMongo {
+			key = database.Mongo.URI.Value + "/" + database.Mongo.Name
+		}
+		if databases[key] {
+			return fmt.Errorf("tenant %s: database is used by another tenant", tenant.ID)
+		}
+		databases[key] = true
+	}
+	return nil
+}
+
+// Validate checks the backup schedule.
+func (b Backup) Validate() error {
+	if b.Interval < 0 || b.Keep < 0 {
+		return errors.New("backup interval and keep must not be negative")
+	}
+	if b.Interval > 0 && b.Dir == "" {
+		return errors.New("backup dir is required for scheduled backups")
+	}
+	return nil
+}
+
+// Validate checks the bot settings. Tokens are checked with the tenants.
+func (b Bot) Validate() error {
+	switch b.Mode {
+	case ModePolling:
+		if b.UpdateTimeout <= 0 {
+			return errors.New("bot update timeout must be positive")
+		}
+	case ModeWebhook:
+		if err := b.Webhook.Validate(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown bot mode: %q", b.Mode)
+	}
+	if b.HandlerTimeout <= 0 {
+		return errors.New("bot handler timeout must be positive")
+	}
+	if b.ShutdownTimeout <= 0 {
+		return errors.New("bot shutdown timeout must be positive")
+	}
+	if b.DialogTimeout <= 0 {
+		return errors.New("bot dialog timeout must be positive")
+	}
+	if b.Workers < 1 || b.QueueSize < 1 {
+		return errors.New("bot workers and queue size must be at least 1")
+	}
+	if b.RateLimit.PerMinute < 0 || b.RateLimit.PerMinute > 0 && b.RateLimit.Burst < 1 {
+		return errors.New("bot rate limit must not be negative and needs a burst of at least 1")
+	}
+	if b.Cache.DefaultExpiration < 0 || b.Cache.CleanupInterval < 0 {
+		return errors.New("cache durations must not be negative")
+	}
+	return nil
+}
+
+// Validate checks the webhook settings.
+func (w Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.New("webhook url must be an https address")
+	}
+	if w.Listen == "" {
+		return errors.New("webhook listen address is required")
+	}
+	if !webhookSecret.MatchString(w.Secret.Value) {
+		return errors.New("webhook secret is required and may only have letters, digits, _ and -")
+	}
+	if (w.CertFile == "") != (w.KeyFile == "") {
+		return errors.New("webhook cert file and key file go together")
+	}
+	if w.SelfSigned && w.CertFile == "" {
+		return errors.New("webhook cert file is required for a self-signed certificate")
+	}
+	if w.MaxConnections < 0 {
+		return errors.New("webhook max connections must not be negative")
+	}
+	return nil
+}
+
+// Validate checks the settings of the selected driver.
+func (d Database) Validate() error {
+	if err := d.Retry.Validate(); err != nil {
+		return err
+	}
+	switch d.Driver {
+	case DriverMongo:
+		return d.Mongo.Validate()
+	case DriverPostgres, DriverSQLite:
+		if d.DSN.Value == "" {
+			return fmt.Errorf("dsn is required for the %s driver", d.Driver)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown database driver: %q", d.Driver)
+	}
+}
+
+// Validate checks the retry and breaker settings.
+func (r Retry) Validate() error {
+	if r.Attempts < 1 {
+		return errors.New("database retry attempts must be at least 1")
+	}
+	if r.Backoff <= 0 || r.MaxBackoff < r.Backoff {
+		return errors.New("database retry backoff must be positive and not above max backoff")
+	}
+	if r.Budget < 0 || r.BreakerThreshold < 0 || r.BreakerCooldown < 0 {
+		return errors.New("database retry budget and breaker settings must not be negative")
+	}
+	return nil
+}
+
+// Validate checks the Mongo settings.
+func (m Mongo) Validate() error {
+	if m.URI.Value == "" {
+		return errors.New("mongo uri is required")
+	}
+	if m.Name == "" {
+		return errors.New("mongo database name is required")
+	}
+	if m.ConnectTimeout <= 0 {
+		return errors.New("mongo connect timeout must be positive")
+	}
+	if m.BootstrapTimeout <= 0 {
+		return errors.New("mongo bootstrap timeout must be positive")
+	}
+	c := m.Collections
+	if c.Users == "" || c.Courses == "" || c.Lessons == "" || c.Enrollments == "" || c.Audit == "" || c.States == "" {
+		return errors.New("mongo collection names must not be empty")
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSchool(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	data := "bot: {token: t}\ndatabase: {driver: sqlite3, dsn: test.db}\nschool: {name: Ліцей, phone: \"+380501234567\"}\n"
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, err := Load([]string{"-config", file, "-school-email", "school@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tenants := cfg.ServedTenants()
+	if len(tenants) != 1 {
+		t.Fatalf("%d tenants served", len(tenants))
+	}
+	school := tenants[0]
+	if school.ID != "default" || school.Name != "Ліцей" || school.Phone != "+380501234567" || school.Email != "school@example.com" {
+		t.Errorf("school %+v", school.Tenant)
+	}
+
+	cfg.School.Name = ""
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "name is required") {
+		t.Errorf("validate without a name: %v", err)
+	}
+}
+
+func TestMongoBootstrapTimeout(t *testing.T) {
+	cfg := Default().Database.Mongo
+	cfg.URI.Value, cfg.Name = "mongodb://localhost", "diploma"
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.BootstrapTimeout = 0
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "bootstrap timeout") {
+		t.Errorf("validate without a bootstrap timeout: %v", err)
+	}
+}
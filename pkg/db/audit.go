@@ -0,0 +1,17 @@
+package db
+
+import "time"
+
+// DefaultAuditLimit is the number of entries returned when AuditQuery.Limit is not set.
+const DefaultAuditLimit = 100
+
+// AuditQuery filters the audit log. Empty fields match everything,
+// From and To bound the entry time inclusively.
+type AuditQuery struct {
+	Actor    string
+	Entity   string
+	EntityID string
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
@@ -0,0 +1,446 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/models"
+)
+
+// Audited entity kinds.
+const (
+	EntityUser       = "user"
+	EntityCourse     = "course"
+	EntityLesson     = "lesson"
+	EntityEnrollment = "enrollment"
+	// EntityCollection is recorded when a whole collection is cleared.
+	EntityCollection = "collection"
+	// EntityBackup is recorded when a backup is restored.
+	EntityBackup = "backup"
+)
+
+// SystemActor is recorded for writes without an actor in the context.
+const SystemActor = "system"
+
+const redacted = "[redacted]"
+
+type actorKey struct{}
+
+// WithActor returns a context whose writes are attributed to actor.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor stored in the context.
+func ActorFrom(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return SystemActor
+}
+
+// Database wraps a db.Database and appends an audit entry with a
+// before/after diff for every successful write. Reads pass through.
+// Every write and its entry are committed in one transaction. A database
+// without transactions, such as a standalone MongoDB server, gets the
+// entry after the write, and a failure to append it is only logged: there
+// a write can succeed without an entry.
+type Database struct {
+	db.Database
+	// noTx is set once the database reported it has no transactions.
+	noTx int32
+	// direct is set while writing outside a transaction.
+	direct bool
+}
+
+// New creating an audited Database.
+func New(database db.Database) *Database {
+	return &Database{Database: database}
+}
+
+// write runs fn with a Database whose writes and entries share one
+// transaction, or directly on the database when it has no transactions.
+// fn may be retried, so it only touches tx.
+func (d *Database) write(ctx context.Context, fn func(ctx context.Context, tx *Database) error) error {
+	if atomic.LoadInt32(&d.noTx) == 0 {
+		err := d.Database.WithTransaction(ctx, func(ctx context.Context, tx db.Database) error {
+			return fn(ctx, New(tx))
+		})
+		if !errors.Is(err, db.ErrNoTransactions) {
+			return err
+		}
+		log.Printf("audit: %s, entries are appended after the writes", err)
+		atomic.StoreInt32(&d.noTx, 1)
+	}
+	return fn(ctx, &Database{Database: d.Database, direct: true})
+}
+
+// USER DB HANDLERS
+
+func (d *Database) CreateUser(ctx context.Context, email, password string) error {
+	return d.write(ctx, func(ctx context.Context, tx *Database) error {
+		if err := tx.Database.CreateUser(ctx, email, password); err != nil {
+			return err
+		}
+		user, err := tx.Database.GetUser(ctx, email)
+		if err != nil {
+			return err
+		}
+		return tx.record(ctx, "CreateUser", EntityUser, user.ID, nil, user)
+	})
+}
+
+// UpdateUser also records the user the chat is taken from.
+func (d *Database) UpdateUser(ctx context.Context, email string, chatID int64) error {
+	return d.write(ctx, func(ctx context.Context, tx *Database) error {
+		before := tx.user(ctx, email)
+		previous, err := tx.Database.GetUserByChatID(ctx, chatID)
+		hadOwner := err == nil && previous.Email != email
+		if err := tx.Database.UpdateUser(ctx, email, chatID); err != nil {
+			return err
+		}
+		if hadOwner {
+			if err := tx.record(ctx, "UpdateUser", EntityUser, previous.ID, previous, tx.user(ctx, previous.Email)); err != nil {
+				return err
+			}
+		}
+		after := tx.user(ctx, email)
+		if user, ok := after.(models.User); ok {
+			return tx.record(ctx, "UpdateUser", EntityUser, user.ID, before, after)
+		}
+		return nil
+	})
+}
+
+func (d *Database) EnrollUser(ctx context.Context, chatId int64, courseID string) (result db.EnrollResult, err error) {
+	err = d.write(ctx, func(ctx context.Context, tx *Database) error {
+		user, err := tx.Database.GetUserByChatID(ctx, chatId)
+		if err != nil {
+			result, err = tx.Database.EnrollUser(ctx, chatId, courseID)
+			return err
+		}
+		before := tx.enrollment(ctx, user.ID, courseID)
+		result, err = tx.Database.EnrollUser(ctx, chatId, courseID)
+		if err != nil {
+			return err
+		}
+		return tx.record(ctx, "EnrollUser", EntityEnrollment, user.ID+":"+courseID, before, tx.enrollment(ctx, user.ID, courseID))
+	})
+	if err != nil {
+		return db.EnrollUnknown, err
+	}
+	return result, nil
+}
+
+// COURSES DB HANDLERS
+
+func (d *Database) CreateCourse(ctx context.Context, title, description string, lessons []models.Lesson) (course models.Course, err error) {
+	err = d.write(ctx, func(ctx context.Context, tx *Database) error {
+		course, err = tx.Database.CreateCourse(ctx, title, description, lessons)
+		if err != nil {
+			return err
+		}
+		return tx.record(ctx, "CreateCourse", EntityCourse, course.ID, nil, course)
+	})
+	return course, err
+}
+
+func (d *Database) SaveCourse(ctx context.Context, course models.Course) error {
+	return d.courseWrite(ctx, "SaveCourse", course.ID, func(ctx context.Context, tx db.Database) error {
+		return tx.SaveCourse(ctx, course)
+	})
+}
+
+func (d *Database) UpdateCourse(ctx context.Context, id string, version int, title, description string) error {
+	return d.courseWrite(ctx, "UpdateCourse", id, func(ctx context.Context, tx db.Database) error {
+		return tx.UpdateCourse(ctx, id, version, title, description)
+	})
+}
+
+func (d *Database) DeleteCourse(ctx context.Context, id string) error {
+	return d.courseWrite(ctx, "DeleteCourse", id, func(ctx context.Context, tx db.Database) error {
+		return tx.DeleteCourse(ctx, id)
+	})
+}
+
+func (d *Database) ArchiveCourse(ctx context.Context, id string) error {
+	return d.courseWrite(ctx, "ArchiveCourse", id, func(ctx context.Context, tx db.Database) error {
+		return tx.ArchiveCourse(ctx, id)
+	})
+}
+
+func (d *Database) RestoreCourse(ctx context.Context, id string) error {
+	return d.courseWrite(ctx, "RestoreCourse", id, func(ctx context.Context, tx db.Database) error {
+		return tx.RestoreCourse(ctx, id)
+	})
+}
+
+func (d *Database) AddCourseLesson(ctx context.Context, courseID, lessonID string) error {
+	return d.courseWrite(ctx, "AddCourseLesson", courseID, func(ctx context.Context, tx db.Database) error {
+		return tx.AddCourseLesson(ctx, courseID, lessonID)
+	})
+}
+
+func (d *Database) RemoveCourseLesson(ctx context.Context, courseID, lessonID string) error {
+	return d.courseWrite(ctx, "RemoveCourseLesson", courseID, func(ctx context.Context, tx db.Database) error {
+		return tx.RemoveCourseLesson(ctx, courseID, lessonID)
+	})
+}
+
+func (d *Database) ReorderCourseLessons(ctx context.Context, courseID string, lessonIDs []string) error {
+	return d.courseWrite(ctx, "ReorderCourseLessons", courseID, func(ctx context.Context, tx db.Database) error {
+		return tx.ReorderCourseLessons(ctx, courseID, lessonIDs)
+	})
+}
+
+func (d *Database) courseWrite(ctx context.Context, action, id string, write func(ctx context.Context, tx db.Database) error) error {
+	return d.write(ctx, func(ctx context.Context, tx *Database) error {
+		before := tx.course(ctx, id)
+		if err := write(ctx, tx.Database); err != nil {
+			return err
+		}
+		return tx.record(ctx, action, EntityCourse, id, before, tx.course(ctx, id))
+	})
+}
+
+// LESSONS DB HANDLERS
+
+func (d *Database) CreateLesson(ctx context.Context, title, lection, task string, estimated int) (lesson models.Lesson, err error) {
+	err = d.write(ctx, func(ctx context.Context, tx *Database) error {
+		lesson, err = tx.Database.CreateLesson(ctx, title, lection, task, estimated)
+		if err != nil {
+			return err
+		}
+		return tx.record(ctx, "CreateLesson", EntityLesson, lesson.ID, nil, lesson)
+	})
+	return lesson, err
+}
+
+func (d *Database) SaveLesson(ctx context.Context, lesson models.Lesson) error {
+	return d.lessonWrite(ctx, "SaveLesson", lesson.ID, func(ctx context.Context, tx db.Database) error {
+		return tx.SaveLesson(ctx, lesson)
+	})
+}
+
+func (d *Database) UpdateLesson(ctx context.Context, id string, version int, title, lection, task string, estimated int) error {
+	return d.lessonWrite(ctx, "UpdateLesson", id, func(ctx context.Context, tx db.Database) error {
+		return tx.UpdateLesson(ctx, id, version, title, lection, task, estimated)
+	})
+}
+
+func (d *Database) DeleteLesson(ctx context.Context, id string) error {
+	return d.lessonWrite(ctx, "DeleteLesson", id, func(ctx context.Context, tx db.Database) error {
+		return tx.DeleteLesson(ctx, id)
+	})
+}
+
+func (d *Database) ArchiveLesson(ctx context.Context, id string) error {
+	return d.lessonWrite(ctx, "ArchiveLesson", id, func(ctx context.Context, tx db.Database) error {
+		return tx.ArchiveLesson(ctx, id)
+	})
+}
+
+func (d *Database) RestoreLesson(ctx context.Context, id string) error {
+	return d.lessonWrite(ctx, "RestoreLesson", id, func(ctx context.Context, tx db.Database) error {
+		return tx.RestoreLesson(ctx, id)
+	})
+}
+
+func (d *Database) lessonWrite(ctx context.Context, action, id string, write func(ctx context.Context, tx db.Database) error) error {
+	return d.write(ctx, func(ctx context.Context, tx *Database) error {
+		before := tx.lesson(ctx, id)
+		if err := write(ctx, tx.Database); err != nil {
+			return err
+		}
+		return tx.record(ctx, action, EntityLesson, id, before, tx.lesson(ctx, id))
+	})
+}
+
+// ENROLLMENTS DB HANDLERS
+
+func (d *Database) UpdateEnrollmentStatus(ctx context.Context, userID, courseID string, status models.EnrollmentStatus) error {
+	return d.write(ctx, func(ctx context.Context, tx *Database) error {
+		before := tx.enrollment(ctx, userID, courseID)
+		if err := tx.Database.UpdateEnrollmentStatus(ctx, userID, courseID, status); err != nil {
+			return err
+		}
+		return tx.record(ctx, "UpdateEnrollmentStatus", EntityEnrollment, userID+":"+courseID, before, tx.enrollment(ctx, userID, courseID))
+	})
+}
+
+// BACKUP DB HANDLERS
+
+// Import records the imported record. Imported audit entries are not
+// recorded again.
+func (d *Database) Import(ctx context.Context, record interface{}) error {
+	var entity, id string
+	var snapshot func(ctx context.Context, tx *Database) interface{}
+	switch r := record.(type) {
+	case models.User:
+		entity, id = EntityUser, r.ID
+		snapshot = func(ctx context.Context, tx *Database) interface{} { return tx.user(ctx, r.Email) }
+	case models.Course:
+		entity, id = EntityCourse, r.ID
+		snapshot = func(ctx context.Context, tx *Database) interface{} { return tx.course(ctx, r.ID) }
+	case models.Lesson:
+		entity, id = EntityLesson, r.ID
+		snapshot = func(ctx context.Context, tx *Database) interface{} { return tx.lesson(ctx, r.ID) }
+	case models.Enrollment:
+		entity, id = EntityEnrollment, r.UserID+":"+r.CourseID
+		snapshot = func(ctx context.Context, tx *Database) interface{} { return tx.enrollment(ctx, r.UserID, r.CourseID) }
+	default:
+		return d.Database.Import(ctx, record)
+	}
+	return d.write(ctx, func(ctx context.Context, tx *Database) error {
+		before := snapshot(ctx, tx)
+		if err := tx.Database.Import(ctx, record); err != nil {
+			return err
+		}
+		return tx.record(ctx, "Import", entity, id, before, snapshot(ctx, tx))
+	})
+}
+
+// Clear records the number of removed records.
+func (d *Database) Clear(ctx context.Context, collection string) error {
+	return d.write(ctx, func(ctx context.Context, tx *Database) error {
+		count := 0
+		err := tx.Database.Export(ctx, collection, func(interface{}) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := tx.Database.Clear(ctx, collection); err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+		return tx.append(ctx, "Clear", EntityCollection, collection, map[string]models.AuditChange{
+			"records": {Before: count, After: 0},
+		})
+	})
+}
+
+// WithTransaction audits the writes made in the transaction,
+// their entries are committed or rolled back with them.
+func (d *Database) WithTransaction(ctx context.Context, fn func(ctx context.Context, tx db.Database) error) error {
+	return d.Database.WithTransaction(ctx, func(ctx context.Context, tx db.Database) error {
+		return fn(ctx, New(tx))
+	})
+}
+
+// Snapshots return nil when the entity can not be read,
+// so the diff shows it as created or removed.
+
+func (d *Database) user(ctx context.Context, email string) interface{} {
+	user, err := d.Database.GetUser(ctx, email)
+	if err != nil {
+		return nil
+	}
+	return user
+}
+
+func (d *Database) course(ctx context.Context, id string) interface{} {
+	course, err := d.Database.GetCourse(ctx, id)
+	if err != nil {
+		return nil
+	}
+	return course
+}
+
+func (d *Database) lesson(ctx context.Context, id string) interface{} {
+	lesson, err := d.Database.GetLesson(ctx, id)
+	if err != nil {
+		return nil
+	}
+	return lesson
+}
+
+func (d *Database) enrollment(ctx context.Context, userID, courseID string) interface{} {
+	enrollment, err := d.Database.GetEnrollment(ctx, userID, courseID)
+	if err != nil {
+		return nil
+	}
+	return enrollment
+}
+
+// record appends an audit entry. Writes that changed nothing, such as a
+// repeated import, are not recorded.
+func (d *Database) record(ctx context.Context, action, entity, entityID string, before, after interface{}) error {
+	changes := Diff(before, after)
+	if len(changes) == 0 {
+		return nil
+	}
+	return d.append(ctx, action, entity, entityID, changes)
+}
+
+// append appends an entry with the changes. Outside a transaction the
+// write has already happened, so a failure is logged instead of returned.
+func (d *Database) append(ctx context.Context, action, entity, entityID string, changes map[string]models.AuditChange) error {
+	entry := models.AuditEntry{
+		Actor:    ActorFrom(ctx),
+		Action:   action,
+		Entity:   entity,
+		EntityID: entityID,
+		Changes:  changes,
+		At:       time.Now().UTC(),
+	}
+	err := d.Database.AppendAudit(ctx, entry)
+	if err != nil && d.direct {
+		log.Printf("audit %s %s %s: %s", action, entity, entityID, err)
+		return nil
+	}
+	return err
+}
+
+// Diff returns the fields that differ between two snapshots, compared by
+// their JSON representation. Password values are never recorded. Versions
+// change on every write and are left out, so writes that change nothing
+// else still produce an empty diff.
+func Diff(before, after interface{}) map[string]models.AuditChange {
+	b, a := fields(before), fields(after)
+	delete(b, "version")
+	delete(a, "version")
+	changes := make(map[string]models.AuditChange)
+	for key, value := range b {
+		if !reflect.DeepEqual(value, a[key]) {
+			changes[key] = models.AuditChange{Before: value, After: a[key]}
+		}
+	}
+	for key, value := range a {
+		if _, ok := b[key]; !ok {
+			changes[key] = models.AuditChange{After: value}
+		}
+	}
+	if change, ok := changes["password"]; ok {
+		if change.Before != nil {
+			change.Before = redacted
+		}
+		if change.After != nil {
+			change.After = redacted
+		}
+		changes["password"] = change
+	}
+	return changes
+}
+
+func fields(v interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	if v == nil {
+		return result
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return result
+	}
+	json.Unmarshal(data, &result)
+	return result
+}
@@ -0,0 +1,128 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/db/sql"
+	"github.com/DanilLagunov/diploma/pkg/models"
+)
+
+func newDatabase(t *testing.T) *Database {
+	d, err := sql.New(sql.DriverSQLite, "file:"+filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	migrator, err := d.Migrator(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Up(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	return New(d)
+}
+
+func auditLog(t *testing.T, d *Database, query db.AuditQuery) []models.AuditEntry {
+	entries, err := d.GetAuditLog(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestImportAndClear(t *testing.T) {
+	ctx := WithActor(context.Background(), "restore")
+	d := newDatabase(t)
+
+	lesson := models.Lesson{ID: "l1", Title: "Вступ", EstimatedTime: 1}
+	if err := d.Import(ctx, lesson); err != nil {
+		t.Fatal(err)
+	}
+	// A repeated import changes nothing and is not recorded.
+	if err := d.Import(ctx, lesson); err != nil {
+		t.Fatal(err)
+	}
+	entries := auditLog(t, d, db.AuditQuery{Entity: EntityLesson, EntityID: "l1"})
+	if len(entries) != 1 || entries[0].Action != "Import" || entries[0].Actor != "restore" {
+		t.Fatalf("import entries: %+v", entries)
+	}
+
+	if err := d.Clear(ctx, db.CollectionLessons); err != nil {
+		t.Fatal(err)
+	}
+	entries = auditLog(t, d, db.AuditQuery{Entity: EntityCollection, EntityID: db.CollectionLessons})
+	if len(entries) != 1 || entries[0].Action != "Clear" {
+		t.Fatalf("clear entries: %+v", entries)
+	}
+	if change := entries[0].Changes["records"]; fmt.Sprint(change.Before) != "1" {
+		t.Errorf("cleared records: %+v", change)
+	}
+}
+
+func TestUpdateUserPreviousOwner(t *testing.T) {
+	ctx := context.Background()
+	d := newDatabase(t)
+	for _, user := range []models.User{{ID: "u1", Email: "first@example.com"}, {ID: "u2", Email: "second@example.com"}} {
+		if err := d.Import(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.UpdateUser(ctx, "first@example.com", 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UpdateUser(ctx, "second@example.com", 42); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := auditLog(t, d, db.AuditQuery{Entity: EntityUser, EntityID: "u1"})
+	if len(entries) == 0 || entries[0].Action != "UpdateUser" {
+		t.Fatalf("entries of the previous owner: %+v", entries)
+	}
+	if change, ok := entries[0].Changes["chat_id"]; !ok || fmt.Sprint(change.After) != "0" {
+		t.Errorf("chat of the previous owner: %+v", entries[0].Changes)
+	}
+}
+
+var errAppend = errors.New("append failed")
+
+// failingAudit fails to append audit entries, also in its transactions.
+type failingAudit struct {
+	db.Database
+	noTx bool
+}
+
+func (f failingAudit) AppendAudit(ctx context.Context, entry models.AuditEntry) error {
+	return errAppend
+}
+
+func (f failingAudit) WithTransaction(ctx context.Context, fn func(ctx context.Context, tx db.Database) error) error {
+	if f.noTx {
+		return db.ErrNoTransactions
+	}
+	return f.Database.WithTransaction(ctx, func(ctx context.Context, tx db.Database) error {
+		return fn(ctx, failingAudit{Database: tx})
+	})
+}
+
+func TestWriteRolledBackWithoutEntry(t *testing.T) {
+	ctx := context.Background()
+	for _, noTx := range []bool{false, true} {
+		d := newDatabase(t)
+		failing := New(failingAudit{Database: d.Database, noTx: noTx})
+		lesson, err := failing.CreateLesson(ctx, "Вступ", "Лекція", "Завдання", 10)
+		_, getErr := d.GetLesson(ctx, lesson.ID)
+		switch {
+		case !noTx && (!errors.Is(err, errAppend) || !errors.Is(getErr, db.ErrNotFound)):
+			t.Errorf("with transactions: create %v, lesson %v, want the lesson rolled back", err, getErr)
+		case noTx && (err != nil || getErr != nil):
+			t.Errorf("without transactions: create %v, lesson %v, want the lesson kept", err, getErr)
+		}
+	}
+}
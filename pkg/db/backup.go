@@ -0,0 +1,109 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/models"
+)
+
+var (
+	ErrUnknownCollection = errors.New("unknown collection")
+	// ErrAuditConflict is returned by Import for an audit entry whose ID
+	// is taken by an entry with other content. The audit log is append
+	// only, entries are never overwritten.
+	ErrAuditConflict = errors.New("audit entry exists with other content")
+)
+
+// Collections exported by Database.Export.
+const (
+	CollectionLessons     = "lessons"
+	CollectionCourses     = "courses"
+	CollectionUsers       = "users"
+	CollectionEnrollments = "enrollments"
+	CollectionChatStates  = "chat_states"
+	CollectionAudit       = "audit"
+)
+
+// CollectionTenant holds the tenant binding of the database.
+const CollectionTenant = "tenant"
+
+// Collections lists every collection in restore order: records only
+// reference records of earlier collections. New collections are added here
+// and to the backends, backups pick them up.
+var Collections = []string{
+	CollectionLessons,
+	CollectionCourses,
+	CollectionUsers,
+	CollectionEnrollments,
+	CollectionChatStates,
+	CollectionAudit,
+}
+
+// Unexported lists the stored collections backups leave out, Export and
+// Clear reject them. Every stored collection is in Collections or here.
+// The tenant binding belongs to the database, not to its data: restoring
+// an archive of another tenant must not rebind the database.
+var Unexported = []string{
+	CollectionTenant,
+}
+
+// DecodeRecord decodes a JSON record of the collection into its model value,
+// as accepted by Database.Import.
+func DecodeRecord(collection string, data []byte) (interface{}, error) {
+	var err error
+	switch collection {
+	case CollectionLessons:
+		var record models.Lesson
+		err = json.Unmarshal(data, &record)
+		return record, err
+	case CollectionCourses:
+		var record models.Course
+		err = json.Unmarshal(data, &record)
+		return record, err
+	case CollectionUsers:
+		var record models.User
+		err = json.Unmarshal(data, &record)
+		return record, err
+	case CollectionEnrollments:
+		var record models.Enrollment
+		err = json.Unmarshal(data, &record)
+		return record, err
+	case CollectionChatStates:
+		var record models.ChatState
+		err = json.Unmarshal(data, &record)
+		return record, err
+	case CollectionAudit:
+		var record models.AuditEntry
+		err = json.Unmarshal(data, &record)
+		return record, err
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCollection, collection)
+	}
+}
+
+// SameAuditEntry reports whether two audit entries record the same write.
+// Changes are compared by their JSON values and times to the millisecond,
+// the precision every backend keeps.
+func SameAuditEntry(a, b models.AuditEntry) bool {
+	if a.ID != b.ID || a.Actor != b.Actor || a.Action != b.Action || a.Entity != b.Entity || a.EntityID != b.EntityID {
+		return false
+	}
+	if !a.At.Truncate(time.Millisecond).Equal(b.At.Truncate(time.Millisecond)) {
+		return false
+	}
+	return reflect.DeepEqual(jsonValue(a.Changes), jsonValue(b.Changes))
+}
+
+func jsonValue(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var value interface{}
+	json.Unmarshal(data, &value)
+	return value
+}
@@ -7,18 +7,108 @@ import (
 	"github.com/DanilLagunov/diploma/pkg/models"
 )
 
-var ErrNotFound = errors.New("not found")
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrInvalidOrder = errors.New("lesson order does not match course lessons")
+	ErrArchived     = errors.New("archived")
+	// ErrConflict is returned by conditional updates when the record was
+	// changed since the expected version was read.
+	ErrConflict = errors.New("version conflict")
+	// ErrUnavailable is returned while the database is considered down.
+	ErrUnavailable = errors.New("database unavailable")
+	// ErrNoTransactions is returned by WithTransaction when the database
+	// does not support transactions, e.g. a standalone MongoDB server.
+	ErrNoTransactions = errors.New("transactions are not supported")
+	// ErrTenantMismatch is returned by BindTenant when the database belongs
+	// to another tenant.
+	ErrTenantMismatch = errors.New("database belongs to another tenant")
+)
+
+// EnrollResult tells whether EnrollUser created an enrollment. It is
+// EnrollUnknown whenever EnrollUser returns an error.
+type EnrollResult int
+
+const (
+	EnrollUnknown EnrollResult = iota
+	Enrolled
+	AlreadyEnrolled
+)
 
+// Database is the storage used by the bot. Deleted and archived courses and
+// lessons are hidden from listings and search, enrolled users keep access
+// to archived courses. Deletion is soft, deleted items can be restored.
+// Every write to a course or lesson increments its version, UpdateCourse
+// and UpdateLesson apply only at the expected version.
 type Database interface {
 	CreateUser(ctx context.Context, email, password string) error
 	GetUser(ctx context.Context, email string) (models.User, error)
+	GetUserByChatID(ctx context.Context, chatID int64) (models.User, error)
 	UpdateUser(ctx context.Context, email string, chatID int64) error
 	GetUserCourses(ctx context.Context, chatId int64) ([]models.Course, error)
-	UpdateUserCourses(ctx context.Context, chatId int64, course models.Course) error
+	EnrollUser(ctx context.Context, chatId int64, courseID string) (EnrollResult, error)
+	// GetCourse returns the course, archived and deleted ones included.
 	GetCourse(ctx context.Context, id string) (models.Course, error)
+	// GetAvailableCourse returns the course as the chat may see it: deleted
+	// courses are not found, archived ones only by users enrolled in them.
+	GetAvailableCourse(ctx context.Context, chatId int64, id string) (models.Course, error)
 	GetCourses(ctx context.Context) ([]models.Course, error)
-	CreateCourse(ctx context.Context, title, description string, lessons []models.Lesson) error
+	ListCourses(ctx context.Context, query CourseQuery) (CoursePage, error)
+	SearchCourses(ctx context.Context, query string, limit int) ([]models.Course, error)
+	CreateCourse(ctx context.Context, title, description string, lessons []models.Lesson) (models.Course, error)
+	// SaveCourse creates the course with the given ID or replaces its title,
+	// description and lessons. Archive and delete marks are left as they are.
+	SaveCourse(ctx context.Context, course models.Course) error
+	UpdateCourse(ctx context.Context, id string, version int, title, description string) error
+	DeleteCourse(ctx context.Context, id string) error
+	ArchiveCourse(ctx context.Context, id string) error
+	RestoreCourse(ctx context.Context, id string) error
 	GetCourseLessons(ctx context.Context, id string) ([]models.Lesson, error)
+	AddCourseLesson(ctx context.Context, courseID, lessonID string) error
+	RemoveCourseLesson(ctx context.Context, courseID, lessonID string) error
+	ReorderCourseLessons(ctx context.Context, courseID string, lessonIDs []string) error
 	CreateLesson(ctx context.Context, title, lection, task string, estimated int) (models.Lesson, error)
+	// GetLesson returns the lesson, archived and deleted ones included.
 	GetLesson(ctx context.Context, id string) (models.Lesson, error)
+	// SaveLesson creates the lesson with the given ID or replaces its content.
+	SaveLesson(ctx context.Context, lesson models.Lesson) error
+	SearchLessons(ctx context.Context, query string, limit int) ([]models.Lesson, error)
+	UpdateLesson(ctx context.Context, id string, version int, title, lection, task string, estimated int) error
+	DeleteLesson(ctx context.Context, id string) error
+	ArchiveLesson(ctx context.Context, id string) error
+	RestoreLesson(ctx context.Context, id string) error
+	GetEnrollment(ctx context.Context, userID, courseID string) (models.Enrollment, error)
+	GetUserEnrollments(ctx context.Context, userID string) ([]models.Enrollment, error)
+	GetCourseEnrollments(ctx context.Context, courseID string) ([]models.Enrollment, error)
+	UpdateEnrollmentStatus(ctx context.Context, userID, courseID string, status models.EnrollmentStatus) error
+	AppendAudit(ctx context.Context, entry models.AuditEntry) error
+	GetAuditLog(ctx context.Context, query AuditQuery) ([]models.AuditEntry, error)
+
+	// GetChatState returns the dialog state of the chat, expired or not.
+	GetChatState(ctx context.Context, chatID int64) (models.ChatState, error)
+	// SaveChatState creates or replaces the dialog state of the chat.
+	SaveChatState(ctx context.Context, state models.ChatState) error
+	// DeleteChatState removes the dialog state of the chat. Deleting a
+	// missing state is not an error.
+	DeleteChatState(ctx context.Context, chatID int64) error
+
+	// BindTenant marks the database as the database of the tenant on its
+	// first call. It returns ErrTenantMismatch when the database is bound
+	// to another tenant, so tenants never share a database.
+	BindTenant(ctx context.Context, tenantID string) error
+
+	// Export calls fn with every record of the collection, including archived
+	// and deleted ones. Records are model values, e.g. models.User.
+	Export(ctx context.Context, collection string, fn func(record interface{}) error) error
+	// Import writes a record returned by Export or DecodeRecord as it is,
+	// replacing the record with the same key. Audit entries are only
+	// inserted: an entry whose ID is taken by other content is
+	// ErrAuditConflict.
+	Import(ctx context.Context, record interface{}) error
+	// Clear removes every record of the collection.
+	Clear(ctx context.Context, collection string) error
+
+	// WithTransaction runs fn as one unit of work: every write made through
+	// tx and ctx is committed when fn returns nil and rolled back otherwise.
+	// fn may be retried on transient errors, so it should only touch tx.
+	WithTransaction(ctx context.Context, fn func(ctx context.Context, tx Database) error) error
 }
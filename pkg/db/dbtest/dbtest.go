@@ -0,0 +1,1008 @@
+// Package dbtest is a conformance suite for db.Database implementations.
+// The Mongo backend defines the expected behavior, every backend must pass
+// the same suite:
+//
+//	func TestConformance(t *testing.T) {
+//		dbtest.Run(t, func(t *testing.T) db.Database {
+//			return newEmptyDatabase(t)
+//		})
+//	}
+package dbtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/models"
+	"github.com/DanilLagunov/diploma/pkg/utils"
+)
+
+// Factory returns an empty, ready to use Database for one test.
+// Cleanup should be registered with t.Cleanup. WithTransaction is part of
+// the contract, so a Mongo factory has to connect to a replica set.
+type Factory func(t *testing.T) db.Database
+
+// concurrency is the number of goroutines racing in concurrent scenarios.
+const concurrency = 16
+
+// Run runs every contract as a subtest against a fresh Database.
+func Run(t *testing.T, newDB Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, d db.Database)
+	}{
+		{"NotFound", testNotFound},
+		{"Users", testUsers},
+		{"Courses", testCourses},
+		{"LessonOrder", testLessonOrder},
+		{"Save", testSave},
+		{"Versions", testVersions},
+		{"SoftDelete", testSoftDelete},
+		{"Enrollment", testEnrollment},
+		{"ListCourses", testListCourses},
+		{"Search", testSearch},
+		{"Audit", testAudit},
+		{"ChatState", testChatState},
+		{"Tenant", testTenant},
+		{"Transaction", testTransaction},
+		{"ExportImport", testExportImport},
+		{"ConcurrentEnroll", testConcurrentEnroll},
+		{"ConcurrentAddCourseLesson", testConcurrentAddCourseLesson},
+		{"ConcurrentReorder", testConcurrentReorder},
+		{"ConcurrentUpdate", testConcurrentUpdate},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newDB(t))
+		})
+	}
+}
+
+func testNotFound(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	lesson := createLesson(t, d, "lesson")
+	course := createCourse(t, d, "course", lesson)
+	const missing = "000000000000000000000000"
+
+	checks := map[string]error{}
+	_, checks["GetUser"] = d.GetUser(ctx, "missing@example.com")
+	_, checks["GetUserByChatID"] = d.GetUserByChatID(ctx, 404)
+	_, checks["GetUserCourses"] = d.GetUserCourses(ctx, 404)
+	_, checks["EnrollUser unknown chat"] = d.EnrollUser(ctx, 404, course.ID)
+	_, checks["GetCourse"] = d.GetCourse(ctx, missing)
+	checks["UpdateCourse"] = d.UpdateCourse(ctx, missing, 0, "t", "d")
+	checks["DeleteCourse"] = d.DeleteCourse(ctx, missing)
+	checks["ArchiveCourse"] = d.ArchiveCourse(ctx, missing)
+	checks["RestoreCourse"] = d.RestoreCourse(ctx, missing)
+	_, checks["GetCourseLessons"] = d.GetCourseLessons(ctx, missing)
+	checks["AddCourseLesson unknown course"] = d.AddCourseLesson(ctx, missing, lesson.ID)
+	checks["AddCourseLesson unknown lesson"] = d.AddCourseLesson(ctx, course.ID, missing)
+	checks["RemoveCourseLesson unknown course"] = d.RemoveCourseLesson(ctx, missing, lesson.ID)
+	checks["RemoveCourseLesson unknown lesson"] = d.RemoveCourseLesson(ctx, course.ID, missing)
+	checks["ReorderCourseLessons"] = d.ReorderCourseLessons(ctx, missing, nil)
+	_, checks["GetLesson"] = d.GetLesson(ctx, missing)
+	checks["UpdateLesson"] = d.UpdateLesson(ctx, missing, 0, "t", "l", "t", 1)
+	checks["DeleteLesson"] = d.DeleteLesson(ctx, missing)
+	checks["ArchiveLesson"] = d.ArchiveLesson(ctx, missing)
+	checks["RestoreLesson"] = d.RestoreLesson(ctx, missing)
+	_, checks["GetEnrollment"] = d.GetEnrollment(ctx, missing, course.ID)
+	checks["UpdateEnrollmentStatus"] = d.UpdateEnrollmentStatus(ctx, missing, course.ID, models.EnrollmentDropped)
+
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !errors.Is(checks[name], db.ErrNotFound) {
+			t.Errorf("%s: got %v, want ErrNotFound", name, checks[name])
+		}
+	}
+}
+
+func testUsers(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	must(t, d.CreateUser(ctx, "user@example.com", "secret"))
+
+	user, err := d.GetUser(ctx, "user@example.com")
+	must(t, err)
+	if user.ID == "" || user.Email != "user@example.com" {
+		t.Fatalf("GetUser = %+v", user)
+	}
+	if user.Password == "secret" || !utils.CheckPasswordHash("secret", user.Password) {
+		t.Errorf("password is not stored as a hash of the given password")
+	}
+	if err := d.CreateUser(ctx, "user@example.com", "other"); err == nil {
+		t.Errorf("CreateUser with a taken email succeeded")
+	}
+
+	must(t, d.UpdateUser(ctx, "user@example.com", 1))
+	bound, err := d.GetUserByChatID(ctx, 1)
+	must(t, err)
+	if bound.ID != user.ID || bound.ChatID != 1 {
+		t.Errorf("GetUserByChatID = %+v, want user %s", bound, user.ID)
+	}
+
+	// A chat belongs to one user, binding it again moves it.
+	must(t, d.CreateUser(ctx, "other@example.com", "secret"))
+	must(t, d.UpdateUser(ctx, "other@example.com", 1))
+	bound, err = d.GetUserByChatID(ctx, 1)
+	must(t, err)
+	if bound.Email != "other@example.com" {
+		t.Errorf("chat is bound to %s, want other@example.com", bound.Email)
+	}
+	user, err = d.GetUser(ctx, "user@example.com")
+	must(t, err)
+	if user.ChatID != 0 {
+		t.Errorf("previous user keeps chat %d", user.ChatID)
+	}
+
+	// Binding to an unknown user leaves the chat where it is.
+	if err := d.UpdateUser(ctx, "missing@example.com", 1); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("UpdateUser of unknown user: got %v, want ErrNotFound", err)
+	}
+	bound, err = d.GetUserByChatID(ctx, 1)
+	must(t, err)
+	if bound.Email != "other@example.com" {
+		t.Errorf("chat is bound to %s after a failed rebind, want other@example.com", bound.Email)
+	}
+}
+
+func testCourses(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	lesson := createLesson(t, d, "lesson")
+	course := createCourse(t, d, "course", lesson)
+	if course.ID == "" || course.Title != "course" || !equal(course.LessonIDs, []string{lesson.ID}) {
+		t.Fatalf("CreateCourse = %+v", course)
+	}
+
+	got, err := d.GetCourse(ctx, course.ID)
+	must(t, err)
+	if got.Title != course.Title || got.Description != course.Description || !equal(got.LessonIDs, course.LessonIDs) {
+		t.Errorf("GetCourse = %+v, want %+v", got, course)
+	}
+
+	must(t, d.UpdateCourse(ctx, course.ID, got.Version, "renamed", "new description"))
+	got, err = d.GetCourse(ctx, course.ID)
+	must(t, err)
+	if got.Title != "renamed" || got.Description != "new description" {
+		t.Errorf("UpdateCourse not applied: %+v", got)
+	}
+
+	courses, err := d.GetCourses(ctx)
+	must(t, err)
+	if len(courses) != 1 || courses[0].ID != course.ID {
+		t.Errorf("GetCourses = %+v", courses)
+	}
+
+	must(t, d.UpdateLesson(ctx, lesson.ID, lesson.Version, "renamed", "lection", "task", 42))
+	updated, err := d.GetLesson(ctx, lesson.ID)
+	must(t, err)
+	if updated.Title != "renamed" || updated.Lection != "lection" || updated.Task != "task" || updated.EstimatedTime != 42 {
+		t.Errorf("UpdateLesson not applied: %+v", updated)
+	}
+}
+
+func testVersions(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	lesson := createLesson(t, d, "lesson")
+	other := createLesson(t, d, "other")
+	course := createCourse(t, d, "course", lesson)
+
+	must(t, d.UpdateCourse(ctx, course.ID, course.Version, "renamed", ""))
+	if err := d.UpdateCourse(ctx, course.ID, course.Version, "stale", ""); !errors.Is(err, db.ErrConflict) {
+		t.Errorf("UpdateCourse at a stale version: got %v, want ErrConflict", err)
+	}
+	got, err := d.GetCourse(ctx, course.ID)
+	must(t, err)
+	if got.Title != "renamed" || got.Version <= course.Version {
+		t.Errorf("after UpdateCourse got %+v, want title renamed and a newer version than %d", got, course.Version)
+	}
+
+	// Every write moves the version, edits based on an older read conflict.
+	writes := map[string]func() error{
+		"AddCourseLesson":      func() error { return d.AddCourseLesson(ctx, course.ID, other.ID) },
+		"ReorderCourseLessons": func() error { return d.ReorderCourseLessons(ctx, course.ID, []string{other.ID, lesson.ID}) },
+		"RemoveCourseLesson":   func() error { return d.RemoveCourseLesson(ctx, course.ID, other.ID) },
+		"ArchiveCourse":        func() error { return d.ArchiveCourse(ctx, course.ID) },
+		"RestoreCourse":        func() error { return d.RestoreCourse(ctx, course.ID) },
+		"SaveCourse": func() error {
+			return d.SaveCourse(ctx, models.Course{ID: course.ID, Title: "saved", LessonIDs: []string{lesson.ID}})
+		},
+	}
+	for _, name := range []string{"AddCourseLesson", "ReorderCourseLessons", "RemoveCourseLesson", "ArchiveCourse", "RestoreCourse", "SaveCourse"} {
+		before, err := d.GetCourse(ctx, course.ID)
+		must(t, err)
+		must(t, writes[name]())
+		after, err := d.GetCourse(ctx, course.ID)
+		must(t, err)
+		if after.Version <= before.Version {
+			t.Errorf("%s kept version %d", name, before.Version)
+		}
+		if err := d.UpdateCourse(ctx, course.ID, before.Version, "stale", ""); !errors.Is(err, db.ErrConflict) {
+			t.Errorf("UpdateCourse after %s: got %v, want ErrConflict", name, err)
+		}
+	}
+
+	must(t, d.UpdateLesson(ctx, lesson.ID, lesson.Version, "renamed", "", "", 1))
+	if err := d.UpdateLesson(ctx, lesson.ID, lesson.Version, "stale", "", "", 1); !errors.Is(err, db.ErrConflict) {
+		t.Errorf("UpdateLesson at a stale version: got %v, want ErrConflict", err)
+	}
+	updated, err := d.GetLesson(ctx, lesson.ID)
+	must(t, err)
+	must(t, d.SaveLesson(ctx, models.Lesson{ID: lesson.ID, Title: "saved", EstimatedTime: 1}))
+	if err := d.UpdateLesson(ctx, lesson.ID, updated.Version, "stale", "", "", 1); !errors.Is(err, db.ErrConflict) {
+		t.Errorf("UpdateLesson after SaveLesson: got %v, want ErrConflict", err)
+	}
+
+	// Versions survive export and import.
+	saved, err := d.GetLesson(ctx, lesson.ID)
+	must(t, err)
+	must(t, d.Import(ctx, saved))
+	must(t, d.UpdateLesson(ctx, lesson.ID, saved.Version, "imported", "", "", 1))
+}
+
+func testLessonOrder(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	a, b, c := createLesson(t, d, "a"), createLesson(t, d, "b"), createLesson(t, d, "c")
+	course := createCourse(t, d, "course", a, b)
+	expectLessons(t, d, course.ID, a.ID, b.ID)
+
+	must(t, d.AddCourseLesson(ctx, course.ID, c.ID))
+	expectLessons(t, d, course.ID, a.ID, b.ID, c.ID)
+	must(t, d.AddCourseLesson(ctx, course.ID, c.ID))
+	expectLessons(t, d, course.ID, a.ID, b.ID, c.ID)
+
+	must(t, d.ReorderCourseLessons(ctx, course.ID, []string{c.ID, a.ID, b.ID}))
+	expectLessons(t, d, course.ID, c.ID, a.ID, b.ID)
+
+	for name, order := range map[string][]string{
+		"missing lesson":   {c.ID, a.ID},
+		"duplicate lesson": {c.ID, a.ID, a.ID},
+		"extra lesson":     {c.ID, a.ID, b.ID, "000000000000000000000000"},
+		"unknown lesson":   {c.ID, a.ID, "000000000000000000000000"},
+	} {
+		if err := d.ReorderCourseLessons(ctx, course.ID, order); !errors.Is(err, db.ErrInvalidOrder) {
+			t.Errorf("Reorder with %s: got %v, want ErrInvalidOrder", name, err)
+		}
+	}
+	expectLessons(t, d, course.ID, c.ID, a.ID, b.ID)
+
+	must(t, d.RemoveCourseLesson(ctx, course.ID, a.ID))
+	expectLessons(t, d, course.ID, c.ID, b.ID)
+	if err := d.RemoveCourseLesson(ctx, course.ID, a.ID); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("removing a removed lesson: got %v, want ErrNotFound", err)
+	}
+	must(t, d.AddCourseLesson(ctx, course.ID, a.ID))
+	expectLessons(t, d, course.ID, c.ID, b.ID, a.ID)
+
+	got, err := d.GetCourse(ctx, course.ID)
+	must(t, err)
+	if !equal(got.LessonIDs, []string{c.ID, b.ID, a.ID}) {
+		t.Errorf("course lesson IDs = %v", got.LessonIDs)
+	}
+}
+
+func testSave(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	a := models.Lesson{ID: "lesson-a", Title: "a", Lection: "lection", Task: "task", EstimatedTime: 10}
+	b := models.Lesson{ID: "lesson-b", Title: "b", Lection: "lection", Task: "task", EstimatedTime: 20}
+	must(t, d.SaveLesson(ctx, a))
+	must(t, d.SaveLesson(ctx, b))
+	a.Title, a.EstimatedTime = "renamed", 15
+	must(t, d.SaveLesson(ctx, a))
+	lesson, err := d.GetLesson(ctx, a.ID)
+	must(t, err)
+	if lesson.Title != "renamed" || lesson.EstimatedTime != 15 {
+		t.Errorf("SaveLesson did not replace the lesson: %+v", lesson)
+	}
+
+	course := models.Course{ID: "course", Title: "course", Description: "description", LessonIDs: []string{a.ID, b.ID}}
+	must(t, d.SaveCourse(ctx, course))
+	expectLessons(t, d, course.ID, a.ID, b.ID)
+	must(t, d.ArchiveCourse(ctx, course.ID))
+	course.Title, course.LessonIDs = "renamed", []string{b.ID}
+	must(t, d.SaveCourse(ctx, course))
+	got, err := d.GetCourse(ctx, course.ID)
+	must(t, err)
+	if got.Title != "renamed" || !equal(got.LessonIDs, []string{b.ID}) || got.ArchivedAt == nil {
+		t.Errorf("SaveCourse = %+v, want new content and the archive mark kept", got)
+	}
+
+	if err := d.SaveCourse(ctx, models.Course{ID: "other", Title: "t", LessonIDs: []string{"missing"}}); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("SaveCourse with unknown lesson: got %v, want ErrNotFound", err)
+	}
+	if err := d.SaveCourse(ctx, models.Course{ID: "other", Title: "t", LessonIDs: []string{a.ID, a.ID}}); !errors.Is(err, db.ErrInvalidOrder) {
+		t.Errorf("SaveCourse with duplicate lesson: got %v, want ErrInvalidOrder", err)
+	}
+}
+
+func testSoftDelete(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	a, b := createLesson(t, d, "a"), createLesson(t, d, "b")
+	course := createCourse(t, d, "course", a, b)
+	chatID := createBoundUser(t, d, "user@example.com", 1)
+	other := createBoundUser(t, d, "other@example.com", 2)
+
+	must(t, d.ArchiveCourse(ctx, course.ID))
+	expectCourses(t, d)
+	expectAvailable(t, d, other, course.ID, false)
+	archived, err := d.GetCourse(ctx, course.ID)
+	must(t, err)
+	if archived.ArchivedAt == nil {
+		t.Errorf("archived course has no ArchivedAt")
+	}
+	if result, err := d.EnrollUser(ctx, chatID, course.ID); !errors.Is(err, db.ErrArchived) || result != db.EnrollUnknown {
+		t.Errorf("EnrollUser into archived course: got %v, %v, want EnrollUnknown, ErrArchived", result, err)
+	}
+	must(t, d.RestoreCourse(ctx, course.ID))
+	expectCourses(t, d, course.ID)
+
+	// Enrolled users keep archived courses, deleted ones disappear.
+	enroll(t, d, chatID, course.ID, db.Enrolled)
+	must(t, d.ArchiveCourse(ctx, course.ID))
+	expectUserCourses(t, d, chatID, course.ID)
+	expectAvailable(t, d, chatID, course.ID, true)
+	expectAvailable(t, d, other, course.ID, false)
+	must(t, d.DeleteCourse(ctx, course.ID))
+	expectUserCourses(t, d, chatID)
+	expectAvailable(t, d, chatID, course.ID, false)
+	expectCourses(t, d)
+	deleted, err := d.GetCourse(ctx, course.ID)
+	must(t, err)
+	if deleted.DeletedAt == nil {
+		t.Errorf("deleted course has no DeletedAt")
+	}
+	must(t, d.RestoreCourse(ctx, course.ID))
+	expectUserCourses(t, d, chatID, course.ID)
+	expectCourses(t, d, course.ID)
+
+	must(t, d.DeleteLesson(ctx, a.ID))
+	expectLessons(t, d, course.ID, b.ID)
+	lesson, err := d.GetLesson(ctx, a.ID)
+	must(t, err)
+	if lesson.DeletedAt == nil {
+		t.Errorf("deleted lesson has no DeletedAt")
+	}
+	must(t, d.RestoreLesson(ctx, a.ID))
+	expectLessons(t, d, course.ID, a.ID, b.ID)
+
+	c := createLesson(t, d, "c")
+	must(t, d.ArchiveLesson(ctx, c.ID))
+	if err := d.AddCourseLesson(ctx, course.ID, c.ID); !errors.Is(err, db.ErrArchived) {
+		t.Errorf("AddCourseLesson with archived lesson: got %v, want ErrArchived", err)
+	}
+}
+
+func testEnrollment(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	first, second := createCourse(t, d, "first"), createCourse(t, d, "second")
+	chatID := createBoundUser(t, d, "user@example.com", 1)
+	user, err := d.GetUserByChatID(ctx, chatID)
+	must(t, err)
+
+	expectUserCourses(t, d, chatID)
+	enroll(t, d, chatID, first.ID, db.Enrolled)
+	enroll(t, d, chatID, first.ID, db.AlreadyEnrolled)
+	enroll(t, d, chatID, second.ID, db.Enrolled)
+	expectUserCourses(t, d, chatID, first.ID, second.ID)
+
+	enrollment, err := d.GetEnrollment(ctx, user.ID, first.ID)
+	must(t, err)
+	if enrollment.Status != models.EnrollmentActive || enrollment.EnrolledAt.IsZero() {
+		t.Errorf("GetEnrollment = %+v", enrollment)
+	}
+
+	must(t, d.UpdateEnrollmentStatus(ctx, user.ID, first.ID, models.EnrollmentDropped))
+	expectUserCourses(t, d, chatID, second.ID)
+	enroll(t, d, chatID, first.ID, db.Enrolled)
+	enrollment, err = d.GetEnrollment(ctx, user.ID, first.ID)
+	must(t, err)
+	if enrollment.Status != models.EnrollmentActive {
+		t.Errorf("re-enrolled status = %s, want active", enrollment.Status)
+	}
+
+	must(t, d.UpdateEnrollmentStatus(ctx, user.ID, second.ID, models.EnrollmentCompleted))
+	expectUserCourses(t, d, chatID, second.ID, first.ID)
+	enroll(t, d, chatID, second.ID, db.AlreadyEnrolled)
+
+	enrollments, err := d.GetUserEnrollments(ctx, user.ID)
+	must(t, err)
+	if len(enrollments) != 2 {
+		t.Errorf("GetUserEnrollments returned %d enrollments, want 2", len(enrollments))
+	}
+	enrollments, err = d.GetCourseEnrollments(ctx, first.ID)
+	must(t, err)
+	if len(enrollments) != 1 || enrollments[0].UserID != user.ID {
+		t.Errorf("GetCourseEnrollments = %+v", enrollments)
+	}
+}
+
+func testListCourses(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	var ids []string
+	for _, title := range []string{"e", "b", "a", "d", "c", "g", "f"} {
+		ids = append(ids, createCourse(t, d, title).ID)
+	}
+	hidden := createCourse(t, d, "hidden")
+	must(t, d.ArchiveCourse(ctx, hidden.ID))
+
+	// Walk forward, then back from the last page.
+	var pages []db.CoursePage
+	query := db.CourseQuery{Limit: 3}
+	for {
+		page, err := d.ListCourses(ctx, query)
+		must(t, err)
+		pages = append(pages, page)
+		if page.Next == "" {
+			break
+		}
+		if len(pages) > len(ids) {
+			t.Fatalf("ListCourses does not terminate")
+		}
+		query.Cursor = page.Next
+	}
+	var got []string
+	for _, page := range pages {
+		got = append(got, courseIDs(page.Courses)...)
+	}
+	if !equal(got, ids) {
+		t.Errorf("forward walk = %v, want %v", got, ids)
+	}
+	if len(pages) != 3 || pages[0].Prev != "" {
+		t.Errorf("got %d pages, first Prev %q", len(pages), pages[0].Prev)
+	}
+	for i := len(pages) - 1; i > 0; i-- {
+		page, err := d.ListCourses(ctx, db.CourseQuery{Limit: 3, Cursor: pages[i].Prev})
+		must(t, err)
+		if !equal(courseIDs(page.Courses), courseIDs(pages[i-1].Courses)) {
+			t.Errorf("page %d backwards = %v, want %v", i-1, courseIDs(page.Courses), courseIDs(pages[i-1].Courses))
+		}
+	}
+
+	page, err := d.ListCourses(ctx, db.CourseQuery{Sort: db.SortByTitle, Desc: true, Limit: 4})
+	must(t, err)
+	if titles := courseTitles(page.Courses); !equal(titles, []string{"g", "f", "e", "d"}) {
+		t.Errorf("by title desc = %v", titles)
+	}
+	page, err = d.ListCourses(ctx, db.CourseQuery{Sort: db.SortByTitle, Desc: true, Limit: 4, Cursor: page.Next})
+	must(t, err)
+	if titles := courseTitles(page.Courses); !equal(titles, []string{"c", "b", "a"}) || page.Next != "" {
+		t.Errorf("second page by title desc = %v, next %q", titles, page.Next)
+	}
+
+	if _, err := d.ListCourses(ctx, db.CourseQuery{Cursor: "x"}); !errors.Is(err, db.ErrInvalidCursor) {
+		t.Errorf("invalid cursor: got %v, want ErrInvalidCursor", err)
+	}
+}
+
+func testSearch(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	algebra := createCourse(t, d, "Algebra basics")
+	geometry := createCourseWith(t, d, "Geometry", "Shapes, with a little algebra")
+	createCourse(t, d, "History")
+	archived := createCourse(t, d, "Algebra archive")
+	must(t, d.ArchiveCourse(ctx, archived.ID))
+
+	courses, err := d.SearchCourses(ctx, "algebra", 10)
+	must(t, err)
+	if ids := courseIDs(courses); !equal(ids, []string{algebra.ID, geometry.ID}) {
+		t.Errorf("SearchCourses = %v, want title match before description match", courseTitles(courses))
+	}
+	courses, err = d.SearchCourses(ctx, "algebra", 1)
+	must(t, err)
+	if len(courses) != 1 {
+		t.Errorf("SearchCourses ignores the limit: %d results", len(courses))
+	}
+
+	lesson := createLesson(t, d, "Fractions")
+	createLesson(t, d, "Decimals")
+	lessons, err := d.SearchLessons(ctx, "fractions", 10)
+	must(t, err)
+	if len(lessons) != 1 || lessons[0].ID != lesson.ID {
+		t.Errorf("SearchLessons = %+v", lessons)
+	}
+}
+
+func testAudit(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	start := time.Now().UTC().Truncate(time.Millisecond)
+	for i, actor := range []string{"alice", "bob", "alice"} {
+		must(t, d.AppendAudit(ctx, models.AuditEntry{
+			Actor:    actor,
+			Action:   "UpdateCourse",
+			Entity:   "course",
+			EntityID: fmt.Sprint(i),
+			Changes:  map[string]models.AuditChange{"title": {Before: "old", After: "new"}},
+			At:       start.Add(time.Duration(i) * time.Second),
+		}))
+	}
+
+	entries, err := d.GetAuditLog(ctx, db.AuditQuery{})
+	must(t, err)
+	if len(entries) != 3 || entries[0].EntityID != "2" || entries[2].EntityID != "0" {
+		t.Fatalf("GetAuditLog is not newest first: %+v", entries)
+	}
+	if change := entries[0].Changes["title"]; change.Before != "old" || change.After != "new" {
+		t.Errorf("changes = %+v", entries[0].Changes)
+	}
+
+	entries, err = d.GetAuditLog(ctx, db.AuditQuery{Actor: "alice", Limit: 1})
+	must(t, err)
+	if len(entries) != 1 || entries[0].EntityID != "2" {
+		t.Errorf("by actor with limit = %+v", entries)
+	}
+	entries, err = d.GetAuditLog(ctx, db.AuditQuery{Entity: "course", EntityID: "1"})
+	must(t, err)
+	if len(entries) != 1 || entries[0].Actor != "bob" {
+		t.Errorf("by entity = %+v", entries)
+	}
+	entries, err = d.GetAuditLog(ctx, db.AuditQuery{From: start.Add(time.Second), To: start.Add(time.Second)})
+	must(t, err)
+	if len(entries) != 1 || entries[0].EntityID != "1" {
+		t.Errorf("by time range = %+v", entries)
+	}
+}
+
+func testTenant(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	must(t, d.BindTenant(ctx, "acme"))
+	must(t, d.BindTenant(ctx, "acme"))
+	if err := d.BindTenant(ctx, "other"); !errors.Is(err, db.ErrTenantMismatch) {
+		t.Fatalf("BindTenant of another tenant: err = %v, want ErrTenantMismatch", err)
+	}
+}
+
+func testChatState(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	if _, err := d.GetChatState(ctx, 1); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("GetChatState of a new chat: err = %v, want ErrNotFound", err)
+	}
+	must(t, d.DeleteChatState(ctx, 1))
+
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Millisecond)
+	must(t, d.SaveChatState(ctx, models.ChatState{ChatID: 1, State: "email", ExpiresAt: expires}))
+	must(t, d.SaveChatState(ctx, models.ChatState{
+		ChatID:    1,
+		State:     "password",
+		Data:      map[string]string{"email": "a@example.com"},
+		ExpiresAt: expires,
+	}))
+	must(t, d.SaveChatState(ctx, models.ChatState{ChatID: 2, State: "email", ExpiresAt: expires}))
+
+	state, err := d.GetChatState(ctx, 1)
+	must(t, err)
+	if state.ChatID != 1 || state.State != "password" || state.Data["email"] != "a@example.com" {
+		t.Errorf("GetChatState = %+v", state)
+	}
+	if !state.ExpiresAt.Equal(expires) {
+		t.Errorf("ExpiresAt = %s, want %s", state.ExpiresAt, expires)
+	}
+
+	must(t, d.DeleteChatState(ctx, 1))
+	if _, err := d.GetChatState(ctx, 1); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("GetChatState after delete: err = %v, want ErrNotFound", err)
+	}
+	if _, err := d.GetChatState(ctx, 2); err != nil {
+		t.Errorf("delete removed the state of another chat: %v", err)
+	}
+}
+
+func testTransaction(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	boom := errors.New("boom")
+
+	err := d.WithTransaction(ctx, func(ctx context.Context, tx db.Database) error {
+		lesson, err := tx.CreateLesson(ctx, "rolled back", "", "", 1)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CreateCourse(ctx, "rolled back", "", []models.Lesson{lesson}); err != nil {
+			return err
+		}
+		return tx.WithTransaction(ctx, func(ctx context.Context, tx db.Database) error {
+			return boom
+		})
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("WithTransaction = %v, want the callback error", err)
+	}
+	expectCourses(t, d)
+	lessons, err := d.SearchLessons(ctx, "rolled", 10)
+	must(t, err)
+	if len(lessons) != 0 {
+		t.Errorf("rolled back lessons are visible: %+v", lessons)
+	}
+
+	var course models.Course
+	err = d.WithTransaction(ctx, func(ctx context.Context, tx db.Database) error {
+		lesson, err := tx.CreateLesson(ctx, "committed", "", "", 1)
+		if err != nil {
+			return err
+		}
+		course, err = tx.CreateCourse(ctx, "committed", "", []models.Lesson{lesson})
+		if err != nil {
+			return err
+		}
+		// Writes are visible inside the transaction.
+		lessons, err := tx.GetCourseLessons(ctx, course.ID)
+		if err != nil {
+			return err
+		}
+		if len(lessons) != 1 {
+			return fmt.Errorf("course has %d lessons inside the transaction", len(lessons))
+		}
+		return nil
+	})
+	must(t, err)
+	expectCourses(t, d, course.ID)
+	expectLessons(t, d, course.ID, course.LessonIDs...)
+}
+
+func testExportImport(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	a, b := createLesson(t, d, "a"), createLesson(t, d, "b")
+	course := createCourse(t, d, "course", b, a)
+	archived := createCourse(t, d, "archived", a)
+	must(t, d.ArchiveCourse(ctx, archived.ID))
+	must(t, d.DeleteLesson(ctx, b.ID))
+	chatID := createBoundUser(t, d, "user@example.com", 1)
+	must(t, d.CreateUser(ctx, "unbound@example.com", "secret"))
+	enroll(t, d, chatID, course.ID, db.Enrolled)
+	must(t, d.AppendAudit(ctx, models.AuditEntry{Actor: "a", Action: "b", Entity: "course", EntityID: course.ID,
+		Changes: map[string]models.AuditChange{"title": {After: "course"}}, At: time.Now().UTC()}))
+	must(t, d.SaveChatState(ctx, models.ChatState{ChatID: chatID, State: "login.password",
+		Data: map[string]string{"email": "user@example.com"}, ExpiresAt: time.Now().Add(time.Hour)}))
+
+	dump := func() map[string][]string {
+		result := map[string][]string{}
+		for _, collection := range db.Collections {
+			result[collection] = []string{}
+			must(t, d.Export(ctx, collection, func(record interface{}) error {
+				data, err := json.Marshal(record)
+				result[collection] = append(result[collection], string(data))
+				return err
+			}))
+		}
+		return result
+	}
+	before := dump()
+	for collection, records := range map[string]int{
+		db.CollectionLessons: 2, db.CollectionCourses: 2, db.CollectionUsers: 2,
+		db.CollectionEnrollments: 1, db.CollectionChatStates: 1, db.CollectionAudit: 1,
+	} {
+		// Decorators such as the audit log may add records.
+		if len(before[collection]) < records {
+			t.Errorf("exported %d %s, want at least %d", len(before[collection]), collection, records)
+		}
+	}
+
+	for i := len(db.Collections) - 1; i >= 0; i-- {
+		must(t, d.Clear(ctx, db.Collections[i]))
+	}
+	for _, records := range dump() {
+		if len(records) != 0 {
+			t.Fatalf("Clear left records: %v", records)
+		}
+	}
+	for _, collection := range db.Collections {
+		for _, data := range before[collection] {
+			record, err := db.DecodeRecord(collection, []byte(data))
+			must(t, err)
+			must(t, d.Import(ctx, record))
+			// Importing twice replaces the record, or keeps the audit entry.
+			must(t, d.Import(ctx, record))
+		}
+	}
+	after := dump()
+	for _, collection := range db.Collections {
+		if !equal(before[collection], after[collection]) {
+			t.Errorf("%s after import:\n%v\nwant\n%v", collection, after[collection], before[collection])
+		}
+	}
+	expectLessons(t, d, course.ID, a.ID)
+	expectUserCourses(t, d, chatID, course.ID)
+
+	// Audit entries are never overwritten.
+	entry, err := db.DecodeRecord(db.CollectionAudit, []byte(before[db.CollectionAudit][0]))
+	must(t, err)
+	rewritten := entry.(models.AuditEntry)
+	rewritten.Actor = "someone else"
+	if err := d.Import(ctx, rewritten); !errors.Is(err, db.ErrAuditConflict) {
+		t.Errorf("Import of a rewritten audit entry: got %v, want ErrAuditConflict", err)
+	}
+	if after := dump(); !equal(before[db.CollectionAudit], after[db.CollectionAudit]) {
+		t.Errorf("audit log rewritten by import: %v", after[db.CollectionAudit])
+	}
+
+	if err := d.Clear(ctx, "unknown"); !errors.Is(err, db.ErrUnknownCollection) {
+		t.Errorf("Clear unknown collection: got %v, want ErrUnknownCollection", err)
+	}
+	for _, collection := range db.Unexported {
+		err := d.Export(ctx, collection, func(interface{}) error { return nil })
+		if !errors.Is(err, db.ErrUnknownCollection) {
+			t.Errorf("Export of unexported %s: got %v, want ErrUnknownCollection", collection, err)
+		}
+		if err := d.Clear(ctx, collection); !errors.Is(err, db.ErrUnknownCollection) {
+			t.Errorf("Clear of unexported %s: got %v, want ErrUnknownCollection", collection, err)
+		}
+	}
+	if err := d.Import(ctx, struct{}{}); !errors.Is(err, db.ErrUnknownCollection) {
+		t.Errorf("Import unknown record: got %v, want ErrUnknownCollection", err)
+	}
+}
+
+func testConcurrentEnroll(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	course := createCourse(t, d, "course")
+	chatID := createBoundUser(t, d, "user@example.com", 1)
+
+	results := make(chan db.EnrollResult, concurrency)
+	race(t, func() error {
+		result, err := d.EnrollUser(ctx, chatID, course.ID)
+		results <- result
+		return err
+	})
+	close(results)
+	enrolled := 0
+	for result := range results {
+		if result == db.Enrolled {
+			enrolled++
+		}
+	}
+	if enrolled != 1 {
+		t.Errorf("%d concurrent calls reported Enrolled, want 1", enrolled)
+	}
+	enrollments, err := d.GetCourseEnrollments(ctx, course.ID)
+	must(t, err)
+	if len(enrollments) != 1 {
+		t.Errorf("got %d enrollments, want 1", len(enrollments))
+	}
+}
+
+func testConcurrentAddCourseLesson(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	course := createCourse(t, d, "course")
+	shared := createLesson(t, d, "shared")
+	lessons := make(chan models.Lesson, concurrency)
+	for i := 0; i < concurrency; i++ {
+		lessons <- createLesson(t, d, fmt.Sprint(i))
+	}
+	close(lessons)
+
+	race(t, func() error {
+		if err := d.AddCourseLesson(ctx, course.ID, shared.ID); err != nil {
+			return err
+		}
+		return d.AddCourseLesson(ctx, course.ID, (<-lessons).ID)
+	})
+
+	got, err := d.GetCourseLessons(ctx, course.ID)
+	must(t, err)
+	seen := map[string]bool{}
+	for _, lesson := range got {
+		if seen[lesson.ID] {
+			t.Errorf("lesson %s added twice", lesson.ID)
+		}
+		seen[lesson.ID] = true
+	}
+	if len(seen) != concurrency+1 {
+		t.Errorf("course has %d distinct lessons, want %d", len(seen), concurrency+1)
+	}
+}
+
+func testConcurrentReorder(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	a, b, c := createLesson(t, d, "a"), createLesson(t, d, "b"), createLesson(t, d, "c")
+	course := createCourse(t, d, "course", a, b, c)
+	orders := [][]string{
+		{a.ID, b.ID, c.ID}, {a.ID, c.ID, b.ID}, {b.ID, a.ID, c.ID},
+		{b.ID, c.ID, a.ID}, {c.ID, a.ID, b.ID}, {c.ID, b.ID, a.ID},
+	}
+	var mu sync.Mutex
+	next := 0
+
+	// Racing reorders may lose with ErrInvalidOrder, but the
+	// lesson list must stay a permutation of the original one.
+	race(t, func() error {
+		mu.Lock()
+		order := orders[next%len(orders)]
+		next++
+		mu.Unlock()
+		if err := d.ReorderCourseLessons(ctx, course.ID, order); err != nil && !errors.Is(err, db.ErrInvalidOrder) {
+			return err
+		}
+		return nil
+	})
+
+	got, err := d.GetCourseLessons(ctx, course.ID)
+	must(t, err)
+	ids := courseLessonIDs(got)
+	sort.Strings(ids)
+	want := []string{a.ID, b.ID, c.ID}
+	sort.Strings(want)
+	if !equal(ids, want) {
+		t.Errorf("lessons after concurrent reorders = %v, want a permutation of %v", ids, want)
+	}
+}
+
+// race runs fn from concurrent goroutines released at the same time.
+func testConcurrentUpdate(t *testing.T, d db.Database) {
+	ctx := context.Background()
+	course := createCourse(t, d, "course")
+
+	var mu sync.Mutex
+	applied := 0
+	race(t, func() error {
+		err := d.UpdateCourse(ctx, course.ID, course.Version, "renamed", "")
+		if errors.Is(err, db.ErrConflict) {
+			return nil
+		}
+		mu.Lock()
+		applied++
+		mu.Unlock()
+		return err
+	})
+	if applied != 1 {
+		t.Errorf("%d concurrent updates at one version applied, want 1", applied)
+	}
+	got, err := d.GetCourse(ctx, course.ID)
+	must(t, err)
+	if got.Version != course.Version+1 {
+		t.Errorf("version %d after one update of version %d", got.Version, course.Version)
+	}
+}
+
+func race(t *testing.T, fn func() error) {
+	t.Helper()
+	start := make(chan struct{})
+	errs := make(chan error, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			errs <- fn()
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent call: %v", err)
+		}
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func createLesson(t *testing.T, d db.Database, title string) models.Lesson {
+	t.Helper()
+	lesson, err := d.CreateLesson(context.Background(), title, "lection", "task", 10)
+	must(t, err)
+	return lesson
+}
+
+func createCourse(t *testing.T, d db.Database, title string, lessons ...models.Lesson) models.Course {
+	t.Helper()
+	course, err := d.CreateCourse(context.Background(), title, "description", lessons)
+	must(t, err)
+	return course
+}
+
+func createCourseWith(t *testing.T, d db.Database, title, description string) models.Course {
+	t.Helper()
+	course, err := d.CreateCourse(context.Background(), title, description, nil)
+	must(t, err)
+	return course
+}
+
+func createBoundUser(t *testing.T, d db.Database, email string, chatID int64) int64 {
+	t.Helper()
+	must(t, d.CreateUser(context.Background(), email, "secret"))
+	must(t, d.UpdateUser(context.Background(), email, chatID))
+	return chatID
+}
+
+func enroll(t *testing.T, d db.Database, chatID int64, courseID string, want db.EnrollResult) {
+	t.Helper()
+	result, err := d.EnrollUser(context.Background(), chatID, courseID)
+	must(t, err)
+	if result != want {
+		t.Errorf("EnrollUser(%d, %s) = %v, want %v", chatID, courseID, result, want)
+	}
+}
+
+func expectAvailable(t *testing.T, d db.Database, chatID int64, courseID string, want bool) {
+	t.Helper()
+	course, err := d.GetAvailableCourse(context.Background(), chatID, courseID)
+	switch {
+	case want && err != nil:
+		t.Errorf("GetAvailableCourse(%d, %s): %v", chatID, courseID, err)
+	case want && course.ID != courseID:
+		t.Errorf("GetAvailableCourse(%d, %s) = %+v", chatID, courseID, course)
+	case !want && !errors.Is(err, db.ErrNotFound):
+		t.Errorf("GetAvailableCourse(%d, %s): got %v, want ErrNotFound", chatID, courseID, err)
+	}
+}
+
+func expectLessons(t *testing.T, d db.Database, courseID string, want ...string) {
+	t.Helper()
+	lessons, err := d.GetCourseLessons(context.Background(), courseID)
+	must(t, err)
+	if got := courseLessonIDs(lessons); !equal(got, want) {
+		t.Errorf("course lessons = %v, want %v", got, want)
+	}
+}
+
+func expectCourses(t *testing.T, d db.Database, want ...string) {
+	t.Helper()
+	courses, err := d.GetCourses(context.Background())
+	must(t, err)
+	got := courseIDs(courses)
+	sort.Strings(got)
+	sort.Strings(want)
+	if !equal(got, want) {
+		t.Errorf("GetCourses = %v, want %v", got, want)
+	}
+}
+
+func expectUserCourses(t *testing.T, d db.Database, chatID int64, want ...string) {
+	t.Helper()
+	courses, err := d.GetUserCourses(context.Background(), chatID)
+	must(t, err)
+	if got := courseIDs(courses); !equal(got, want) {
+		t.Errorf("GetUserCourses = %v, want %v", got, want)
+	}
+}
+
+func courseIDs(courses []models.Course) []string {
+	ids := make([]string, 0, len(courses))
+	for _, course := range courses {
+		ids = append(ids, course.ID)
+	}
+	return ids
+}
+
+func courseTitles(courses []models.Course) []string {
+	titles := make([]string, 0, len(courses))
+	for _, course := range courses {
+		titles = append(titles, course.Title)
+	}
+	return titles
+}
+
+func courseLessonIDs(lessons []models.Lesson) []string {
+	ids := make([]string, 0, len(lessons))
+	for _, lesson := range lessons {
+		ids = append(ids, lesson.ID)
+	}
+	return ids
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,176 @@
+package mongo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// stored maps the name of every stored collection, exported or in
+// db.Unexported, to the collection.
+func (d *Database) stored() map[string]*mongo.Collection {
+	return map[string]*mongo.Collection{
+		db.CollectionLessons:     d.lessonsCollection,
+		db.CollectionCourses:     d.coursesCollection,
+		db.CollectionUsers:       d.usersCollection,
+		db.CollectionEnrollments: d.enrollmentsCollection,
+		db.CollectionChatStates:  d.statesCollection,
+		db.CollectionAudit:       d.auditCollection,
+		db.CollectionTenant:      d.tenantCollection,
+	}
+}
+
+func (d *Database) collection(name string) (*mongo.Collection, error) {
+	for _, unexported := range db.Unexported {
+		if name == unexported {
+			return nil, fmt.Errorf("%w: %q", db.ErrUnknownCollection, name)
+		}
+	}
+	coll, ok := d.stored()[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", db.ErrUnknownCollection, name)
+	}
+	return coll, nil
+}
+
+// Export streams the collection ordered by key.
+func (d *Database) Export(ctx context.Context, collection string, fn func(record interface{}) error) error {
+	coll, err := d.collection(collection)
+	if err != nil {
+		return err
+	}
+	sort := bson.D{{Key: "_id", Value: 1}}
+	if collection == db.CollectionEnrollments {
+		sort = bson.D{{Key: "user_id", Value: 1}, {Key: "course_id", Value: 1}}
+	}
+	cur, err := coll.Find(ctx, bson.M{}, options.Find().SetSort(sort))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		record, err := decodeRecord(collection, cur)
+		if err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+func decodeRecord(collection string, cur *mongo.Cursor) (interface{}, error) {
+	var err error
+	switch collection {
+	case db.CollectionLessons:
+		var record models.Lesson
+		err = cur.Decode(&record)
+		return record, err
+	case db.CollectionCourses:
+		var record models.Course
+		err = cur.Decode(&record)
+		return record, err
+	case db.CollectionUsers:
+		var record models.User
+		err = cur.Decode(&record)
+		return record, err
+	case db.CollectionEnrollments:
+		var record models.Enrollment
+		err = cur.Decode(&record)
+		return record, err
+	case db.CollectionChatStates:
+		var record models.ChatState
+		err = cur.Decode(&record)
+		return record, err
+	default:
+		var record models.AuditEntry
+		err = cur.Decode(&record)
+		return record, err
+	}
+}
+
+func (d *Database) Import(ctx context.Context, record interface{}) error {
+	var coll *mongo.Collection
+	var filter bson.M
+	switch r := record.(type) {
+	case models.Lesson:
+		coll, filter = d.lessonsCollection, bson.M{"_id": r.ID}
+	case models.Course:
+		if r.LessonIDs == nil {
+			r.LessonIDs = []string{}
+			record = r
+		}
+		coll, filter = d.coursesCollection, bson.M{"_id": r.ID}
+	case models.User:
+		coll, filter = d.usersCollection, bson.M{"_id": r.ID}
+	case models.Enrollment:
+		coll, filter = d.enrollmentsCollection, bson.M{"user_id": r.UserID, "course_id": r.CourseID}
+	case models.ChatState:
+		coll, filter = d.statesCollection, bson.M{"_id": r.ChatID}
+	case models.AuditEntry:
+		return d.importAuditEntry(ctx, r)
+	default:
+		return fmt.Errorf("%w: record %T", db.ErrUnknownCollection, record)
+	}
+	_, err := coll.ReplaceOne(ctx, filter, record, options.Replace().SetUpsert(true))
+	return err
+}
+
+// importAuditEntry inserts the entry unless its ID is taken, audit entries
+// are never overwritten.
+func (d *Database) importAuditEntry(ctx context.Context, entry models.AuditEntry) error {
+	insert := bson.M{
+		"actor":     entry.Actor,
+		"action":    entry.Action,
+		"entity":    entry.Entity,
+		"entity_id": entry.EntityID,
+		"changes":   entry.Changes,
+		"at":        entry.At,
+	}
+	res, err := d.auditCollection.UpdateOne(ctx, bson.M{"_id": entry.ID},
+		bson.M{"$setOnInsert": insert}, options.Update().SetUpsert(true))
+	if err != nil || res.UpsertedCount > 0 {
+		return err
+	}
+
+	raw, err := d.auditCollection.FindOne(ctx, bson.M{"_id": entry.ID}).DecodeBytes()
+	if err != nil {
+		return err
+	}
+	var existing models.AuditEntry
+	if err := bson.Unmarshal(raw, &existing); err != nil {
+		return err
+	}
+	// Decoded changes hold BSON documents, compare them as JSON instead.
+	existing.Changes = nil
+	if changes, ok := raw.Lookup("changes").DocumentOK(); ok {
+		data, err := bson.MarshalExtJSON(changes, false, false)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &existing.Changes); err != nil {
+			return err
+		}
+	}
+	if !db.SameAuditEntry(existing, entry) {
+		return fmt.Errorf("%w: %s", db.ErrAuditConflict, entry.ID)
+	}
+	return nil
+}
+
+func (d *Database) Clear(ctx context.Context, collection string) error {
+	coll, err := d.collection(collection)
+	if err != nil {
+		return err
+	}
+	_, err = coll.DeleteMany(ctx, bson.M{})
+	return err
+}
@@ -0,0 +1,58 @@
+package mongo
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// TestBackupCoversCollections checks that every collection of the database
+// is exported or listed in db.Unexported, so a new collection is not left
+// out of backups by mistake. It needs no server.
+func TestBackupCoversCollections(t *testing.T) {
+	client, err := mongo.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	database := client.Database("test")
+	collectionType := reflect.TypeOf(database.Collection(""))
+
+	// Every collection field gets a collection named after it.
+	var d Database
+	value := reflect.ValueOf(&d).Elem()
+	fields := map[string]bool{}
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if field.Type() != collectionType {
+			continue
+		}
+		name := value.Type().Field(i).Name
+		fields[name] = true
+		reflect.NewAt(collectionType, field.Addr().UnsafePointer()).Elem().Set(reflect.ValueOf(database.Collection(name)))
+	}
+
+	stored := d.stored()
+	for _, coll := range stored {
+		delete(fields, coll.Name())
+	}
+	for name := range fields {
+		t.Errorf("%s is not in stored", name)
+	}
+
+	names := append(append([]string{}, db.Collections...), db.Unexported...)
+	if len(stored) != len(names) {
+		t.Errorf("stored has %d collections, want %d", len(stored), len(names))
+	}
+	for _, name := range names {
+		if _, ok := stored[name]; !ok {
+			t.Errorf("collection %s is not in stored", name)
+		}
+	}
+	for _, name := range db.Collections {
+		if _, err := d.collection(name); err != nil {
+			t.Errorf("collection(%s): %v", name, err)
+		}
+	}
+}
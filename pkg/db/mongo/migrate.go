@@ -0,0 +1,330 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/migrations"
+	"github.com/DanilLagunov/diploma/pkg/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migrator returns a migrator over the registered Mongo migrations.
+// Applied migrations are recorded in the migrations collection.
+func (d *Database) Migrator(out io.Writer) (*migrations.Migrator, error) {
+	database := d.usersCollection.Database()
+	store := &migrationStore{
+		records: database.Collection("migrations"),
+		lock:    database.Collection("migrations_lock"),
+	}
+	return migrations.New(store, out,
+		migrations.Migration{
+			Version: 1,
+			Name:    "lesson_references",
+			Up:      d.migrateLessonReferences,
+			Down:    d.embedLessons,
+		},
+		migrations.Migration{
+			Version: 2,
+			Name:    "user_enrollments",
+			Up:      d.migrateUserEnrollments,
+			Down:    d.embedUserCourses,
+		},
+		migrations.Migration{
+			Version: 3,
+			Name:    "content_versions",
+			Up:      d.addContentVersions,
+			Down:    d.removeContentVersions,
+		},
+		migrations.Migration{
+			Version: 4,
+			Name:    "text_language",
+			Up:      d.rebuildTextIndexes(textLanguage),
+			Down:    d.rebuildTextIndexes("english"),
+		},
+	)
+}
+
+// migrationStore implements migrations.Store. The lock is a single document
+// that can be taken over once it expires.
+type migrationStore struct {
+	records *mongo.Collection
+	lock    *mongo.Collection
+}
+
+func (s *migrationStore) Applied(ctx context.Context) ([]migrations.Record, error) {
+	cur, err := s.records.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var records []migrations.Record
+	if err := cur.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (s *migrationStore) Save(ctx context.Context, record migrations.Record) error {
+	_, err := s.records.ReplaceOne(ctx, bson.M{"_id": record.Version}, record, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *migrationStore) Delete(ctx context.Context, version int) error {
+	_, err := s.records.DeleteOne(ctx, bson.M{"_id": version})
+	return err
+}
+
+func (s *migrationStore) Lock(ctx context.Context, owner string, ttl time.Duration) error {
+	now := time.Now().UTC()
+	filter := bson.M{"_id": "lock", "$or": bson.A{
+		bson.M{"owner": owner},
+		bson.M{"expires_at": bson.M{"$lt": now}},
+	}}
+	update := bson.M{"$set": bson.M{"owner": owner, "expires_at": now.Add(ttl)}}
+	// When another owner holds the lock the filter does not match and
+	// the upsert collides with the existing lock document.
+	_, err := s.lock.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return migrations.ErrLocked
+	}
+	return err
+}
+
+func (s *migrationStore) Unlock(ctx context.Context, owner string) error {
+	_, err := s.lock.DeleteOne(ctx, bson.M{"_id": "lock", "owner": owner})
+	return err
+}
+
+// legacyCourse is the course document layout with embedded lesson copies.
+type legacyCourse struct {
+	ID          string          `bson:"_id"`
+	Title       string          `bson:"title"`
+	Description string          `bson:"description"`
+	LessonIDs   []string        `bson:"lesson_ids"`
+	Lessons     []models.Lesson `bson:"lessons"`
+}
+
+func (c legacyCourse) toCourse() models.Course {
+	course := models.Course{
+		ID:          c.ID,
+		Title:       c.Title,
+		Description: c.Description,
+		LessonIDs:   c.LessonIDs,
+	}
+	if len(c.Lessons) > 0 {
+		course.LessonIDs = make([]string, 0, len(c.Lessons))
+		for _, lesson := range c.Lessons {
+			course.LessonIDs = append(course.LessonIDs, lesson.ID)
+		}
+	}
+	return course
+}
+
+// migrateLessonReferences converts courses with embedded lessons to
+// ordered lesson ID references. Embedded lessons missing from the lessons
+// collection are inserted there first. Documents already in the new layout
+// are left untouched, so the migration is safe to run repeatedly.
+func (d *Database) migrateLessonReferences(ctx context.Context) error {
+	cur, err := d.coursesCollection.Find(ctx, bson.M{"lessons": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	var courses []legacyCourse
+	if err := cur.All(ctx, &courses); err != nil {
+		return err
+	}
+
+	for _, c := range courses {
+		for _, lesson := range c.Lessons {
+			_, err := d.lessonsCollection.UpdateOne(ctx,
+				bson.M{"_id": lesson.ID},
+				bson.M{"$setOnInsert": lesson},
+				options.Update().SetUpsert(true))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := d.coursesCollection.UpdateOne(ctx,
+			bson.M{"_id": c.ID},
+			bson.M{
+				"$set":   bson.M{"lesson_ids": c.toCourse().LessonIDs},
+				"$unset": bson.M{"lessons": ""},
+			})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateUserEnrollments moves course copies embedded in user documents
+// to the enrollments collection and removes them from the users.
+// The original enrollment time is unknown, so the migration time is used.
+func (d *Database) migrateUserEnrollments(ctx context.Context) error {
+	cur, err := d.usersCollection.Find(ctx, bson.M{"courses": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	var users []struct {
+		ID      string         `bson:"_id"`
+		Courses []legacyCourse `bson:"courses"`
+	}
+	if err := cur.All(ctx, &users); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, u := range users {
+		for i, c := range u.Courses {
+			enrollment := models.Enrollment{
+				UserID:     u.ID,
+				CourseID:   c.ID,
+				EnrolledAt: now.Add(time.Duration(i) * time.Millisecond),
+				Status:     models.EnrollmentActive,
+			}
+			_, err := d.enrollmentsCollection.UpdateOne(ctx,
+				bson.M{"user_id": u.ID, "course_id": c.ID},
+				bson.M{"$setOnInsert": enrollment},
+				options.Update().SetUpsert(true))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := d.usersCollection.UpdateOne(ctx,
+			bson.M{"_id": u.ID},
+			bson.M{"$unset": bson.M{"courses": ""}})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addContentVersions sets version 0 on courses and lessons written
+// before versioning, so conditional updates can match them.
+func (d *Database) addContentVersions(ctx context.Context) error {
+	for _, coll := range []*mongo.Collection{d.coursesCollection, d.lessonsCollection} {
+		_, err := coll.UpdateMany(ctx,
+			bson.M{"version": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"version": 0}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Database) removeContentVersions(ctx context.Context) error {
+	for _, coll := range []*mongo.Collection{d.coursesCollection, d.lessonsCollection} {
+		_, err := coll.UpdateMany(ctx, bson.M{}, bson.M{"$unset": bson.M{"version": ""}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildTextIndexes recreates the text indexes with the default language,
+// indexes created before it was set use the server default, english.
+func (d *Database) rebuildTextIndexes(language string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		for _, spec := range d.indexSpecs() {
+			if !spec.text() {
+				continue
+			}
+			_, err := spec.collection.Indexes().DropOne(ctx, spec.name)
+			if err != nil && !indexNotFound(err) {
+				return err
+			}
+			model := spec.model()
+			model.Options.SetDefaultLanguage(language)
+			if _, err := spec.collection.Indexes().CreateOne(ctx, model); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// indexNotFound reports whether dropping an index failed because the index
+// or its collection does not exist.
+func indexNotFound(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && (cmdErr.Code == 26 || cmdErr.Code == 27)
+}
+
+// embedLessons reverts migrateLessonReferences by copying the referenced
+// lessons back into the course documents.
+func (d *Database) embedLessons(ctx context.Context) error {
+	cur, err := d.coursesCollection.Find(ctx, bson.M{"lesson_ids": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	var courses []legacyCourse
+	if err := cur.All(ctx, &courses); err != nil {
+		return err
+	}
+
+	for _, c := range courses {
+		lessons, err := d.GetCourseLessons(ctx, c.ID)
+		if err != nil {
+			return err
+		}
+		_, err = d.coursesCollection.UpdateOne(ctx,
+			bson.M{"_id": c.ID},
+			bson.M{
+				"$set":   bson.M{"lessons": lessons},
+				"$unset": bson.M{"lesson_ids": ""},
+			})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// embedUserCourses reverts migrateUserEnrollments by copying enrolled
+// courses back into the user documents. Dropped enrollments are discarded.
+func (d *Database) embedUserCourses(ctx context.Context) error {
+	cur, err := d.enrollmentsCollection.Find(ctx,
+		bson.M{"status": bson.M{"$ne": models.EnrollmentDropped}},
+		options.Find().SetSort(bson.M{"enrolled_at": 1}))
+	if err != nil {
+		return err
+	}
+	var enrollments []models.Enrollment
+	if err := cur.All(ctx, &enrollments); err != nil {
+		return err
+	}
+
+	courses := make(map[string][]models.Course)
+	for _, enrollment := range enrollments {
+		course, err := d.GetCourse(ctx, enrollment.CourseID)
+		if err == db.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		courses[enrollment.UserID] = append(courses[enrollment.UserID], course)
+	}
+	for userID, userCourses := range courses {
+		_, err := d.usersCollection.UpdateOne(ctx,
+			bson.M{"_id": userID},
+			bson.M{"$set": bson.M{"courses": userCourses}})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = d.enrollmentsCollection.DeleteMany(ctx, bson.M{})
+	return err
+}
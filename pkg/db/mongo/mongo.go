@@ -2,8 +2,13 @@ package mongo
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
 	"time"
 
+	"github.com/DanilLagunov/diploma/pkg/config"
 	"github.com/DanilLagunov/diploma/pkg/db"
 	"github.com/DanilLagunov/diploma/pkg/models"
 	"github.com/DanilLagunov/diploma/pkg/utils"
@@ -15,26 +20,88 @@ import (
 
 // Database struct.
 type Database struct {
-	client            *mongo.Client
-	usersCollection   *mongo.Collection
-	coursesCollection *mongo.Collection
-	lessonsCollection *mongo.Collection
+	client                *mongo.Client
+	usersCollection       *mongo.Collection
+	coursesCollection     *mongo.Collection
+	lessonsCollection     *mongo.Collection
+	enrollmentsCollection *mongo.Collection
+	auditCollection       *mongo.Collection
+	statesCollection      *mongo.Collection
+	tenantCollection      *mongo.Collection
 }
 
 // NewDatabase creating a new Database object.
-func New(uri, dbName, usersCollectionName, coursesCollectionName, lessonsCollectionName string) (*Database, error) {
+func New(cfg config.Mongo) (*Database, error) {
 	var db Database
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
 	defer cancel()
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.URI.Value))
+	if err != nil {
+		return nil, err
+	}
+	database := client.Database(cfg.Name)
 	db.client = client
-	db.usersCollection = client.Database(dbName).Collection(usersCollectionName)
-	db.coursesCollection = client.Database(dbName).Collection(coursesCollectionName)
-	db.lessonsCollection = client.Database(dbName).Collection(lessonsCollectionName)
+	db.usersCollection = database.Collection(cfg.Collections.Users)
+	db.coursesCollection = database.Collection(cfg.Collections.Courses)
+	db.lessonsCollection = database.Collection(cfg.Collections.Lessons)
+	db.enrollmentsCollection = database.Collection(cfg.Collections.Enrollments)
+	db.auditCollection = database.Collection(cfg.Collections.Audit)
+	db.statesCollection = database.Collection(cfg.Collections.States)
+	db.tenantCollection = database.Collection("tenant")
+
+	bootstrapCtx, cancelBootstrap := context.WithTimeout(context.Background(), cfg.BootstrapTimeout)
+	defer cancelBootstrap()
+	drift, err := db.Bootstrap(bootstrapCtx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, item := range drift {
+		log.Printf("index drift: %s", item)
+	}
+
+	return &db, nil
+}
+
+// disconnectTimeout bounds the wait for connections in use on Close.
+const disconnectTimeout = 10 * time.Second
+
+// Close disconnecting the client once the operations in progress finish.
+func (d *Database) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+	defer cancel()
+	return d.client.Disconnect(ctx)
+}
+
+// available matches courses and lessons that are neither archived nor deleted.
+func available() bson.M {
+	return bson.M{
+		"archived_at": bson.M{"$exists": false},
+		"deleted_at":  bson.M{"$exists": false},
+	}
+}
+
+// WithTransaction runs fn in a session transaction, nested calls join the
+// outer one. Transactions need a replica set or a sharded cluster.
+func (d *Database) WithTransaction(ctx context.Context, fn func(ctx context.Context, tx db.Database) error) error {
+	if mongo.SessionFromContext(ctx) != nil {
+		return fn(ctx, d)
+	}
+	session, err := d.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
 
-	return &db, err
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc, d)
+	})
+	if noTransactions(err) {
+		return fmt.Errorf("%w: %s", db.ErrNoTransactions, err)
+	}
+	return err
 }
 
 // USER DB HANDLERS
@@ -61,45 +128,123 @@ func (d *Database) GetUser(ctx context.Context, email string) (models.User, erro
 	return user, err
 }
 
+// UpdateUser binds the chat to the user in a transaction, the previous
+// owner of the chat is unbound. Without transactions, on a standalone
+// server, the updates run one after another.
 func (d *Database) UpdateUser(ctx context.Context, email string, chatID int64) error {
-	filter := bson.M{"email": email}
-	update := bson.M{"$set": bson.M{"chat_id": chatID}}
-	_, err := d.usersCollection.UpdateOne(ctx, filter, update)
+	err := d.WithTransaction(ctx, func(ctx context.Context, tx db.Database) error {
+		return d.bindChat(ctx, email, chatID)
+	})
+	if errors.Is(err, db.ErrNoTransactions) {
+		return d.bindChat(ctx, email, chatID)
+	}
+	return err
+}
+
+func (d *Database) bindChat(ctx context.Context, email string, chatID int64) error {
+	if err := d.usersCollection.FindOne(ctx, bson.M{"email": email}).Err(); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return db.ErrNotFound
+		}
+		return err
+	}
+	// A chat is bound to one user at a time, chat_id is unique.
+	_, err := d.usersCollection.UpdateMany(ctx,
+		bson.M{"chat_id": chatID, "email": bson.M{"$ne": email}},
+		bson.M{"$unset": bson.M{"chat_id": ""}})
 	if err != nil {
 		return err
 	}
+	res, err := d.usersCollection.UpdateOne(ctx, bson.M{"email": email}, bson.M{"$set": bson.M{"chat_id": chatID}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return db.ErrNotFound
+	}
 	return nil
 }
 
 func (d *Database) GetUserCourses(ctx context.Context, chatId int64) ([]models.Course, error) {
-	filter := bson.M{"chat_id": chatId}
-	var user models.User
-	err := d.usersCollection.FindOne(ctx, filter).Decode(&user)
-	if err == mongo.ErrNoDocuments {
-		return []models.Course{}, db.ErrNotFound
+	user, err := d.GetUserByChatID(ctx, chatId)
+	if err != nil {
+		return []models.Course{}, err
 	}
-	return user.Courses, nil
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user_id": user.ID, "status": bson.M{"$ne": models.EnrollmentDropped}}}},
+		{{Key: "$sort", Value: bson.M{"enrolled_at": 1}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         d.coursesCollection.Name(),
+			"localField":   "course_id",
+			"foreignField": "_id",
+			"as":           "course",
+		}}},
+		{{Key: "$unwind", Value: "$course"}},
+		{{Key: "$match", Value: bson.M{"course.deleted_at": bson.M{"$exists": false}}}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$course"}}},
+	}
+	cur, err := d.enrollmentsCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return []models.Course{}, err
+	}
+	defer cur.Close(ctx)
+	result := []models.Course{}
+	if err := cur.All(ctx, &result); err != nil {
+		return result, err
+	}
+	return result, nil
 }
 
-func (d *Database) UpdateUserCourses(ctx context.Context, chatId int64, course models.Course) error {
-	filter := bson.M{"chat_id": chatId}
-	var user models.User
-	err := d.usersCollection.FindOne(ctx, filter).Decode(&user)
-	if err == mongo.ErrNoDocuments {
-		return db.ErrNotFound
+// EnrollUser enrolls the user into the course with server-side upserts,
+// so concurrent calls for the same pair create a single enrollment.
+// A dropped enrollment is reactivated.
+func (d *Database) EnrollUser(ctx context.Context, chatId int64, courseID string) (db.EnrollResult, error) {
+	user, err := d.GetUserByChatID(ctx, chatId)
+	if err != nil {
+		return db.EnrollUnknown, err
 	}
-	for _, c := range user.Courses {
-		if c.ID == course.ID {
-			return nil
-		}
+	course, err := d.GetCourse(ctx, courseID)
+	if err != nil {
+		return db.EnrollUnknown, err
+	}
+	if course.ArchivedAt != nil || course.DeletedAt != nil {
+		return db.EnrollUnknown, db.ErrArchived
 	}
-	user.Courses = append(user.Courses, course)
-	update := bson.M{"$set": bson.M{"courses": user.Courses}}
-	_, err = d.usersCollection.UpdateOne(ctx, filter, update)
+	now := time.Now().UTC()
+
+	filter := bson.M{"user_id": user.ID, "course_id": courseID, "status": models.EnrollmentDropped}
+	update := bson.M{"$set": bson.M{"status": models.EnrollmentActive, "enrolled_at": now}}
+	res, err := d.enrollmentsCollection.UpdateOne(ctx, filter, update)
 	if err != nil {
-		return err
+		return db.EnrollUnknown, err
 	}
-	return nil
+	if res.MatchedCount > 0 {
+		return db.Enrolled, nil
+	}
+
+	filter = bson.M{"user_id": user.ID, "course_id": courseID}
+	update = bson.M{"$setOnInsert": bson.M{"status": models.EnrollmentActive, "enrolled_at": now}}
+	res, err = d.enrollmentsCollection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return db.AlreadyEnrolled, nil
+	}
+	if err != nil {
+		return db.EnrollUnknown, err
+	}
+	if res.UpsertedCount > 0 {
+		return db.Enrolled, nil
+	}
+	return db.AlreadyEnrolled, nil
+}
+
+func (d *Database) GetUserByChatID(ctx context.Context, chatID int64) (models.User, error) {
+	filter := bson.M{"chat_id": chatID}
+	var user models.User
+	err := d.usersCollection.FindOne(ctx, filter).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return user, db.ErrNotFound
+	}
+	return user, err
 }
 
 // COURSES DB HANDLERS
@@ -114,8 +259,34 @@ func (d *Database) GetCourse(ctx context.Context, id string) (models.Course, err
 	return course, err
 }
 
+func (d *Database) GetAvailableCourse(ctx context.Context, chatId int64, id string) (models.Course, error) {
+	filter := bson.M{"_id": id, "deleted_at": bson.M{"$exists": false}}
+	var course models.Course
+	err := d.coursesCollection.FindOne(ctx, filter).Decode(&course)
+	if err == mongo.ErrNoDocuments {
+		return course, db.ErrNotFound
+	}
+	if err != nil || course.ArchivedAt == nil {
+		return course, err
+	}
+
+	user, err := d.GetUserByChatID(ctx, chatId)
+	if err != nil {
+		return models.Course{}, err
+	}
+	filter = bson.M{"user_id": user.ID, "course_id": id, "status": bson.M{"$ne": models.EnrollmentDropped}}
+	err = d.enrollmentsCollection.FindOne(ctx, filter).Err()
+	if err == mongo.ErrNoDocuments {
+		return models.Course{}, db.ErrNotFound
+	}
+	if err != nil {
+		return models.Course{}, err
+	}
+	return course, nil
+}
+
 func (d *Database) GetCourses(ctx context.Context) ([]models.Course, error) {
-	cur, err := d.coursesCollection.Find(ctx, bson.M{})
+	cur, err := d.coursesCollection.Find(ctx, available())
 	if err != nil {
 		return []models.Course{}, err
 	}
@@ -127,26 +298,299 @@ func (d *Database) GetCourses(ctx context.Context) ([]models.Course, error) {
 	return result, nil
 }
 
-func (d *Database) CreateCourse(ctx context.Context, title, description string, lessons []models.Lesson) error {
+func (d *Database) ListCourses(ctx context.Context, query db.CourseQuery) (db.CoursePage, error) {
+	if query.Limit <= 0 {
+		query.Limit = db.DefaultLimit
+	}
+	field := "_id"
+	if query.Sort == db.SortByTitle {
+		field = "title"
+	}
+
+	filter := available()
+	if query.Title != "" {
+		filter["title"] = primitive.Regex{Pattern: regexp.QuoteMeta(query.Title), Options: "i"}
+	}
+
+	var before bool
+	if query.Cursor != "" {
+		id, b, err := db.ParseCursor(query.Cursor)
+		if err != nil {
+			return db.CoursePage{}, err
+		}
+		before = b
+		boundary, err := d.GetCourse(ctx, id)
+		if err != nil {
+			return db.CoursePage{}, err
+		}
+		op := "$gt"
+		if query.Desc != before {
+			op = "$lt"
+		}
+		keyset := bson.M{"_id": bson.M{op: id}}
+		if field == "title" {
+			keyset = bson.M{"$or": bson.A{
+				bson.M{"title": bson.M{op: boundary.Title}},
+				bson.M{"title": boundary.Title, "_id": bson.M{op: id}},
+			}}
+		}
+		filter = bson.M{"$and": bson.A{filter, keyset}}
+	}
+
+	// Pages before the cursor are fetched in reverse and flipped back.
+	dir := 1
+	if query.Desc != before {
+		dir = -1
+	}
+	sort := bson.D{{Key: field, Value: dir}}
+	if field != "_id" {
+		sort = append(sort, bson.E{Key: "_id", Value: dir})
+	}
+	opts := options.Find().SetSort(sort).SetLimit(int64(query.Limit + 1))
+
+	cur, err := d.coursesCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return db.CoursePage{}, err
+	}
+	defer cur.Close(ctx)
+	courses := []models.Course{}
+	if err := cur.All(ctx, &courses); err != nil {
+		return db.CoursePage{}, err
+	}
+	if before {
+		for i, j := 0, len(courses)-1; i < j; i, j = i+1, j-1 {
+			courses[i], courses[j] = courses[j], courses[i]
+		}
+	}
+
+	return db.NewCoursePage(courses, query.Limit, query.Cursor, before), nil
+}
+
+// SearchCourses returns courses matching the text index on title and
+// description, best matches first.
+func (d *Database) SearchCourses(ctx context.Context, query string, limit int) ([]models.Course, error) {
+	result := []models.Course{}
+	if err := d.search(ctx, d.coursesCollection, query, limit, &result); err != nil {
+		return []models.Course{}, err
+	}
+	return result, nil
+}
+
+func (d *Database) search(ctx context.Context, collection *mongo.Collection, query string, limit int, result interface{}) error {
+	if limit <= 0 {
+		limit = db.DefaultLimit
+	}
+	score := bson.M{"score": bson.M{"$meta": "textScore"}}
+	opts := options.Find().SetProjection(score).SetSort(score).SetLimit(int64(limit))
+	filter := available()
+	filter["$text"] = bson.M{"$search": query}
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	return cur.All(ctx, result)
+}
+
+func (d *Database) CreateCourse(ctx context.Context, title, description string, lessons []models.Lesson) (models.Course, error) {
 	id := primitive.NewObjectID().Hex()
+	lessonIDs := make([]string, 0, len(lessons))
+	for _, lesson := range lessons {
+		lessonIDs = append(lessonIDs, lesson.ID)
+	}
 	course := models.Course{
 		ID:          id,
 		Title:       title,
 		Description: description,
-		Lessons:     lessons,
+		LessonIDs:   lessonIDs,
 	}
 	_, err := d.coursesCollection.InsertOne(ctx, course)
+	return course, err
+}
+
+func (d *Database) SaveCourse(ctx context.Context, course models.Course) error {
+	lessonIDs := course.LessonIDs
+	if lessonIDs == nil {
+		lessonIDs = []string{}
+	}
+	seen := make(map[string]bool, len(lessonIDs))
+	for _, id := range lessonIDs {
+		if seen[id] {
+			return db.ErrInvalidOrder
+		}
+		seen[id] = true
+	}
+	count, err := d.lessonsCollection.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": lessonIDs}})
+	if err != nil {
+		return err
+	}
+	if int(count) != len(lessonIDs) {
+		return db.ErrNotFound
+	}
+
+	filter := bson.M{"_id": course.ID}
+	update := bson.M{
+		"$set": bson.M{"title": course.Title, "description": course.Description, "lesson_ids": lessonIDs},
+		"$inc": bson.M{"version": 1},
+	}
+	_, err = d.coursesCollection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
 	return err
 }
 
+func (d *Database) UpdateCourse(ctx context.Context, id string, version int, title, description string) error {
+	filter := bson.M{"_id": id, "version": version}
+	update := bson.M{"$set": bson.M{"title": title, "description": description}, "$inc": bson.M{"version": 1}}
+	res, err := d.coursesCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return conflict(d.courseExists(ctx, id))
+	}
+	return nil
+}
+
+// DeleteCourse marks the course as deleted. Enrollments are kept,
+// so RestoreCourse brings the course back for enrolled users.
+func (d *Database) DeleteCourse(ctx context.Context, id string) error {
+	return d.markCourse(ctx, id, bson.M{"$min": bson.M{"deleted_at": time.Now().UTC()}})
+}
+
+func (d *Database) ArchiveCourse(ctx context.Context, id string) error {
+	return d.markCourse(ctx, id, bson.M{"$min": bson.M{"archived_at": time.Now().UTC()}})
+}
+
+func (d *Database) RestoreCourse(ctx context.Context, id string) error {
+	return d.markCourse(ctx, id, bson.M{"$unset": bson.M{"archived_at": "", "deleted_at": ""}})
+}
+
+func (d *Database) markCourse(ctx context.Context, id string, update bson.M) error {
+	update["$inc"] = bson.M{"version": 1}
+	res, err := d.coursesCollection.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
 func (d *Database) GetCourseLessons(ctx context.Context, id string) ([]models.Lesson, error) {
-	filter := bson.M{"_id": id}
-	var course models.Course
-	err := d.coursesCollection.FindOne(ctx, filter).Decode(&course)
-	if err == mongo.ErrNoDocuments {
-		return []models.Lesson{}, db.ErrNotFound
+	course, err := d.GetCourse(ctx, id)
+	if err != nil {
+		return []models.Lesson{}, err
+	}
+	if len(course.LessonIDs) == 0 {
+		return []models.Lesson{}, nil
+	}
+
+	filter := bson.M{"_id": bson.M{"$in": course.LessonIDs}, "deleted_at": bson.M{"$exists": false}}
+	cur, err := d.lessonsCollection.Find(ctx, filter)
+	if err != nil {
+		return []models.Lesson{}, err
+	}
+	defer cur.Close(ctx)
+	found := []models.Lesson{}
+	if err := cur.All(ctx, &found); err != nil {
+		return []models.Lesson{}, err
+	}
+
+	byID := make(map[string]models.Lesson, len(found))
+	for _, lesson := range found {
+		byID[lesson.ID] = lesson
+	}
+	result := make([]models.Lesson, 0, len(course.LessonIDs))
+	for _, lessonID := range course.LessonIDs {
+		if lesson, ok := byID[lessonID]; ok {
+			result = append(result, lesson)
+		}
+	}
+	return result, nil
+}
+
+func (d *Database) AddCourseLesson(ctx context.Context, courseID, lessonID string) error {
+	lesson, err := d.GetLesson(ctx, lessonID)
+	if err != nil {
+		return err
+	}
+	if lesson.ArchivedAt != nil || lesson.DeletedAt != nil {
+		return db.ErrArchived
+	}
+	filter := bson.M{"_id": courseID, "lesson_ids": bson.M{"$ne": lessonID}}
+	update := bson.M{"$push": bson.M{"lesson_ids": lessonID}, "$inc": bson.M{"version": 1}}
+	res, err := d.coursesCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return d.courseExists(ctx, courseID)
+	}
+	return nil
+}
+
+func (d *Database) RemoveCourseLesson(ctx context.Context, courseID, lessonID string) error {
+	filter := bson.M{"_id": courseID, "lesson_ids": lessonID}
+	update := bson.M{"$pull": bson.M{"lesson_ids": lessonID}, "$inc": bson.M{"version": 1}}
+	res, err := d.coursesCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func (d *Database) ReorderCourseLessons(ctx context.Context, courseID string, lessonIDs []string) error {
+	course, err := d.GetCourse(ctx, courseID)
+	if err != nil {
+		return err
+	}
+	if len(course.LessonIDs) != len(lessonIDs) {
+		return db.ErrInvalidOrder
+	}
+	current := make(map[string]bool, len(course.LessonIDs))
+	for _, id := range course.LessonIDs {
+		current[id] = true
+	}
+	for _, id := range lessonIDs {
+		if !current[id] {
+			return db.ErrInvalidOrder
+		}
+		delete(current, id)
+	}
+	// Only apply the new order if nobody changed the lesson list meanwhile.
+	filter := bson.M{"_id": courseID, "lesson_ids": course.LessonIDs}
+	update := bson.M{"$set": bson.M{"lesson_ids": lessonIDs}, "$inc": bson.M{"version": 1}}
+	res, err := d.coursesCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return db.ErrInvalidOrder
+	}
+	return nil
+}
+
+func (d *Database) courseExists(ctx context.Context, id string) error {
+	count, err := d.coursesCollection.CountDocuments(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// conflict maps a failed conditional update of an existing record to
+// db.ErrConflict. exists is the result of the existence check.
+func conflict(exists error) error {
+	if exists == nil {
+		return db.ErrConflict
 	}
-	return course.Lessons, nil
+	return exists
 }
 
 // LESSONS DB HANDLERS
@@ -173,3 +617,198 @@ func (d *Database) GetLesson(ctx context.Context, id string) (models.Lesson, err
 	}
 	return lesson, err
 }
+
+func (d *Database) SaveLesson(ctx context.Context, lesson models.Lesson) error {
+	filter := bson.M{"_id": lesson.ID}
+	update := bson.M{
+		"$set": bson.M{"title": lesson.Title, "lection": lesson.Lection, "task": lesson.Task, "time": lesson.EstimatedTime},
+		"$inc": bson.M{"version": 1},
+	}
+	_, err := d.lessonsCollection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// SearchLessons returns lessons matching the text index on title,
+// best matches first.
+func (d *Database) SearchLessons(ctx context.Context, query string, limit int) ([]models.Lesson, error) {
+	result := []models.Lesson{}
+	if err := d.search(ctx, d.lessonsCollection, query, limit, &result); err != nil {
+		return []models.Lesson{}, err
+	}
+	return result, nil
+}
+
+func (d *Database) UpdateLesson(ctx context.Context, id string, version int, title, lection, task string, estimated int) error {
+	filter := bson.M{"_id": id, "version": version}
+	update := bson.M{"$set": bson.M{"title": title, "lection": lection, "task": task, "time": estimated}, "$inc": bson.M{"version": 1}}
+	res, err := d.lessonsCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return conflict(d.lessonExists(ctx, id))
+	}
+	return nil
+}
+
+// DeleteLesson marks the lesson as deleted. Course references are kept,
+// deleted lessons are skipped by GetCourseLessons until restored.
+func (d *Database) DeleteLesson(ctx context.Context, id string) error {
+	return d.markLesson(ctx, id, bson.M{"$min": bson.M{"deleted_at": time.Now().UTC()}})
+}
+
+func (d *Database) ArchiveLesson(ctx context.Context, id string) error {
+	return d.markLesson(ctx, id, bson.M{"$min": bson.M{"archived_at": time.Now().UTC()}})
+}
+
+func (d *Database) RestoreLesson(ctx context.Context, id string) error {
+	return d.markLesson(ctx, id, bson.M{"$unset": bson.M{"archived_at": "", "deleted_at": ""}})
+}
+
+func (d *Database) markLesson(ctx context.Context, id string, update bson.M) error {
+	update["$inc"] = bson.M{"version": 1}
+	res, err := d.lessonsCollection.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func (d *Database) lessonExists(ctx context.Context, id string) error {
+	count, err := d.lessonsCollection.CountDocuments(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+// ENROLLMENTS DB HANDLERS
+
+func (d *Database) GetEnrollment(ctx context.Context, userID, courseID string) (models.Enrollment, error) {
+	filter := bson.M{"user_id": userID, "course_id": courseID}
+	var enrollment models.Enrollment
+	err := d.enrollmentsCollection.FindOne(ctx, filter).Decode(&enrollment)
+	if err == mongo.ErrNoDocuments {
+		return enrollment, db.ErrNotFound
+	}
+	return enrollment, err
+}
+
+func (d *Database) GetUserEnrollments(ctx context.Context, userID string) ([]models.Enrollment, error) {
+	return d.findEnrollments(ctx, bson.M{"user_id": userID})
+}
+
+func (d *Database) GetCourseEnrollments(ctx context.Context, courseID string) ([]models.Enrollment, error) {
+	return d.findEnrollments(ctx, bson.M{"course_id": courseID})
+}
+
+func (d *Database) UpdateEnrollmentStatus(ctx context.Context, userID, courseID string, status models.EnrollmentStatus) error {
+	filter := bson.M{"user_id": userID, "course_id": courseID}
+	update := bson.M{"$set": bson.M{"status": status}}
+	res, err := d.enrollmentsCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func (d *Database) findEnrollments(ctx context.Context, filter bson.M) ([]models.Enrollment, error) {
+	opts := options.Find().SetSort(bson.M{"enrolled_at": 1})
+	cur, err := d.enrollmentsCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return []models.Enrollment{}, err
+	}
+	defer cur.Close(ctx)
+	result := []models.Enrollment{}
+	if err := cur.All(ctx, &result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// AUDIT DB HANDLERS
+
+// AppendAudit inserts an audit entry. Entries are never updated or removed.
+func (d *Database) AppendAudit(ctx context.Context, entry models.AuditEntry) error {
+	if entry.ID == "" {
+		entry.ID = primitive.NewObjectID().Hex()
+	}
+	_, err := d.auditCollection.InsertOne(ctx, entry)
+	return err
+}
+
+// GetAuditLog returns matching audit entries, newest first.
+func (d *Database) GetAuditLog(ctx context.Context, query db.AuditQuery) ([]models.AuditEntry, error) {
+	filter := bson.M{}
+	if query.Actor != "" {
+		filter["actor"] = query.Actor
+	}
+	if query.Entity != "" {
+		filter["entity"] = query.Entity
+	}
+	if query.EntityID != "" {
+		filter["entity_id"] = query.EntityID
+	}
+	at := bson.M{}
+	if !query.From.IsZero() {
+		at["$gte"] = query.From
+	}
+	if !query.To.IsZero() {
+		at["$lte"] = query.To
+	}
+	if len(at) > 0 {
+		filter["at"] = at
+	}
+	if query.Limit <= 0 {
+		query.Limit = db.DefaultAuditLimit
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "at", Value: -1}}).SetLimit(int64(query.Limit))
+	cur, err := d.auditCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return []models.AuditEntry{}, err
+	}
+	defer cur.Close(ctx)
+	result := []models.AuditEntry{}
+	if err := cur.All(ctx, &result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// CHAT STATE DB HANDLERS
+
+// GetChatState returns the dialog state of the chat, expired or not. The
+// TTL index removes expired states within a minute or so.
+func (d *Database) GetChatState(ctx context.Context, chatID int64) (models.ChatState, error) {
+	var state models.ChatState
+	err := d.statesCollection.FindOne(ctx, bson.M{"_id": chatID}).Decode(&state)
+	if err == mongo.ErrNoDocuments {
+		return state, db.ErrNotFound
+	}
+	return state, err
+}
+
+// SaveChatState creates or replaces the dialog state of the chat.
+func (d *Database) SaveChatState(ctx context.Context, state models.ChatState) error {
+	if state.UpdatedAt.IsZero() {
+		state.UpdatedAt = time.Now()
+	}
+	_, err := d.statesCollection.ReplaceOne(ctx, bson.M{"_id": state.ChatID}, state, options.Replace().SetUpsert(true))
+	return err
+}
+
+// DeleteChatState removes the dialog state of the chat.
+func (d *Database) DeleteChatState(ctx context.Context, chatID int64) error {
+	_, err := d.statesCollection.DeleteOne(ctx, bson.M{"_id": chatID})
+	return err
+}
@@ -0,0 +1,44 @@
+package mongo
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/DanilLagunov/diploma/pkg/config"
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/db/dbtest"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestMongo runs against the replica set in MONGO_TEST_URI, e.g.
+// mongodb://localhost:27017/?replicaSet=rs0. Every test gets its own
+// database, which is dropped afterwards.
+func TestMongo(t *testing.T) {
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+	dbtest.Run(t, func(t *testing.T) db.Database {
+		cfg := config.Default().Database.Mongo
+		cfg.URI = config.Secret{Value: uri}
+		cfg.Name = "diploma_test_" + primitive.NewObjectID().Hex()
+		d, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			d.usersCollection.Database().Drop(context.Background())
+			d.Close()
+		})
+		migrator, err := d.Migrator(io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := migrator.Up(context.Background(), 0); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
@@ -0,0 +1,27 @@
+package mongo
+
+import (
+	"errors"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Retryable reports whether err is a transient failure: a network error,
+// a server side timeout or an error the server labels as retryable.
+func (d *Database) Retryable(err error) bool {
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	var labeled interface{ HasErrorLabel(string) bool }
+	return errors.As(err, &labeled) &&
+		(labeled.HasErrorLabel("RetryableWriteError") || labeled.HasErrorLabel("TransientTransactionError"))
+}
+
+// illegalOperation is the error code of a transaction on a standalone
+// server, which has no transactions.
+const illegalOperation = 20
+
+func noTransactions(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && cmdErr.Code == illegalOperation
+}
@@ -0,0 +1,319 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/DanilLagunov/diploma/pkg/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// textLanguage is the default language of the text indexes. MongoDB has no
+// Ukrainian stemmer, so words are matched as they are, without stemming or
+// stop words; the server default, english, would stem Ukrainian words as
+// English ones.
+const textLanguage = "none"
+
+// indexSpec declares an index the store relies on.
+type indexSpec struct {
+	collection *mongo.Collection
+	name       string
+	keys       bson.D
+	unique     bool
+	sparse     bool
+	// ttl expires documents at the date stored in the indexed field.
+	ttl bool
+}
+
+func (s indexSpec) text() bool {
+	for _, k := range s.keys {
+		if k.Value == "text" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s indexSpec) model() mongo.IndexModel {
+	opts := options.Index().SetName(s.name)
+	if s.unique {
+		opts.SetUnique(true)
+	}
+	if s.sparse {
+		opts.SetSparse(true)
+	}
+	if s.ttl {
+		opts.SetExpireAfterSeconds(0)
+	}
+	if s.text() {
+		opts.SetDefaultLanguage(textLanguage)
+	}
+	return mongo.IndexModel{Keys: s.keys, Options: opts}
+}
+
+// IndexDrift describes a difference between declared and actual indexes.
+type IndexDrift struct {
+	Collection string
+	Index      string
+	Problem    string
+}
+
+func (d IndexDrift) String() string {
+	return fmt.Sprintf("%s.%s: %s", d.Collection, d.Index, d.Problem)
+}
+
+func (d *Database) indexSpecs() []indexSpec {
+	return []indexSpec{
+		{collection: d.usersCollection, name: "email_1", keys: bson.D{{Key: "email", Value: 1}}, unique: true},
+		{collection: d.usersCollection, name: "chat_id_1", keys: bson.D{{Key: "chat_id", Value: 1}}, unique: true, sparse: true},
+		{collection: d.coursesCollection, name: "lesson_ids_1", keys: bson.D{{Key: "lesson_ids", Value: 1}}},
+		{collection: d.coursesCollection, name: "title_text_description_text", keys: bson.D{{Key: "title", Value: "text"}, {Key: "description", Value: "text"}}},
+		{collection: d.lessonsCollection, name: "title_text", keys: bson.D{{Key: "title", Value: "text"}}},
+		{collection: d.enrollmentsCollection, name: "user_id_1_course_id_1", keys: bson.D{{Key: "user_id", Value: 1}, {Key: "course_id", Value: 1}}, unique: true},
+		{collection: d.enrollmentsCollection, name: "course_id_1", keys: bson.D{{Key: "course_id", Value: 1}}},
+		{collection: d.auditCollection, name: "at_-1", keys: bson.D{{Key: "at", Value: -1}}},
+		{collection: d.auditCollection, name: "actor_1_at_-1", keys: bson.D{{Key: "actor", Value: 1}, {Key: "at", Value: -1}}},
+		{collection: d.auditCollection, name: "entity_1_entity_id_1_at_-1", keys: bson.D{{Key: "entity", Value: 1}, {Key: "entity_id", Value: 1}, {Key: "at", Value: -1}}},
+		{collection: d.statesCollection, name: "expires_at_1", keys: bson.D{{Key: "expires_at", Value: 1}}, ttl: true},
+	}
+}
+
+func (d *Database) validators() map[*mongo.Collection]bson.M {
+	return map[*mongo.Collection]bson.M{
+		d.usersCollection: {
+			"bsonType": "object",
+			"required": bson.A{"_id", "email", "password"},
+			"properties": bson.M{
+				"_id":      bson.M{"bsonType": "string"},
+				"email":    bson.M{"bsonType": "string"},
+				"password": bson.M{"bsonType": "string"},
+				"chat_id":  bson.M{"bsonType": bson.A{"long", "int"}},
+			},
+		},
+		d.coursesCollection: {
+			"bsonType": "object",
+			"required": bson.A{"_id", "title", "description"},
+			"properties": bson.M{
+				"_id":         bson.M{"bsonType": "string"},
+				"title":       bson.M{"bsonType": "string"},
+				"description": bson.M{"bsonType": "string"},
+				"lesson_ids":  bson.M{"bsonType": bson.A{"array", "null"}, "items": bson.M{"bsonType": "string"}},
+				"version":     bson.M{"bsonType": bson.A{"long", "int"}},
+				"archived_at": bson.M{"bsonType": "date"},
+				"deleted_at":  bson.M{"bsonType": "date"},
+			},
+		},
+		d.lessonsCollection: {
+			"bsonType": "object",
+			"required": bson.A{"_id", "title", "lection", "task", "time"},
+			"properties": bson.M{
+				"_id":         bson.M{"bsonType": "string"},
+				"title":       bson.M{"bsonType": "string"},
+				"lection":     bson.M{"bsonType": "string"},
+				"task":        bson.M{"bsonType": "string"},
+				"time":        bson.M{"bsonType": bson.A{"long", "int"}},
+				"version":     bson.M{"bsonType": bson.A{"long", "int"}},
+				"archived_at": bson.M{"bsonType": "date"},
+				"deleted_at":  bson.M{"bsonType": "date"},
+			},
+		},
+		d.enrollmentsCollection: {
+			"bsonType": "object",
+			"required": bson.A{"user_id", "course_id", "enrolled_at", "status"},
+			"properties": bson.M{
+				"user_id":     bson.M{"bsonType": "string"},
+				"course_id":   bson.M{"bsonType": "string"},
+				"enrolled_at": bson.M{"bsonType": "date"},
+				"status": bson.M{"enum": bson.A{
+					models.EnrollmentActive,
+					models.EnrollmentCompleted,
+					models.EnrollmentDropped,
+				}},
+			},
+		},
+		d.auditCollection: {
+			"bsonType": "object",
+			"required": bson.A{"_id", "actor", "action", "entity", "entity_id", "at"},
+			"properties": bson.M{
+				"_id":       bson.M{"bsonType": "string"},
+				"actor":     bson.M{"bsonType": "string"},
+				"action":    bson.M{"bsonType": "string"},
+				"entity":    bson.M{"bsonType": "string"},
+				"entity_id": bson.M{"bsonType": "string"},
+				"changes":   bson.M{"bsonType": bson.A{"object", "null"}},
+				"at":        bson.M{"bsonType": "date"},
+			},
+		},
+		d.statesCollection: {
+			"bsonType": "object",
+			"required": bson.A{"_id", "state", "expires_at"},
+			"properties": bson.M{
+				"_id":        bson.M{"bsonType": bson.A{"long", "int"}},
+				"state":      bson.M{"bsonType": "string"},
+				"data":       bson.M{"bsonType": bson.A{"object", "null"}},
+				"expires_at": bson.M{"bsonType": "date"},
+				"updated_at": bson.M{"bsonType": "date"},
+			},
+		},
+	}
+}
+
+// Bootstrap applies collection validators and creates missing indexes.
+// Indexes that exist with other options, and undeclared indexes, are not
+// changed; they are returned as drift for the operator to resolve.
+func (d *Database) Bootstrap(ctx context.Context) ([]IndexDrift, error) {
+	for collection, schema := range d.validators() {
+		if err := applyValidator(ctx, collection, schema); err != nil {
+			return nil, fmt.Errorf("validator for %s: %w", collection.Name(), err)
+		}
+	}
+
+	// chat_id is indexed as sparse, so unbound users must not carry a zero value.
+	_, err := d.usersCollection.UpdateMany(ctx,
+		bson.M{"chat_id": 0},
+		bson.M{"$unset": bson.M{"chat_id": ""}})
+	if err != nil {
+		return nil, err
+	}
+
+	drift, err := d.IndexDrift(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := []IndexDrift{}
+	for _, item := range drift {
+		if item.Problem != "missing" {
+			remaining = append(remaining, item)
+			continue
+		}
+		for _, spec := range d.indexSpecs() {
+			if spec.collection.Name() == item.Collection && spec.name == item.Index {
+				if _, err := spec.collection.Indexes().CreateOne(ctx, spec.model()); err != nil {
+					return nil, fmt.Errorf("index %s: %w", item, err)
+				}
+			}
+		}
+	}
+
+	return remaining, nil
+}
+
+func applyValidator(ctx context.Context, collection *mongo.Collection, schema bson.M) error {
+	validator := bson.M{"$jsonSchema": schema}
+	err := collection.Database().RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: collection.Name()},
+		{Key: "validator", Value: validator},
+		{Key: "validationLevel", Value: "moderate"},
+	}).Err()
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == 26 { // NamespaceNotFound
+		return collection.Database().CreateCollection(ctx, collection.Name(),
+			options.CreateCollection().SetValidator(validator).SetValidationLevel("moderate"))
+	}
+	return err
+}
+
+// IndexDrift compares the declared indexes with the ones on the server.
+func (d *Database) IndexDrift(ctx context.Context) ([]IndexDrift, error) {
+	type actualIndex struct {
+		Name    string `bson:"name"`
+		Key     bson.D `bson:"key"`
+		Unique  bool   `bson:"unique"`
+		Sparse  bool   `bson:"sparse"`
+		Weights bson.M `bson:"weights"`
+		// DefaultLanguage is set on text indexes only.
+		DefaultLanguage string `bson:"default_language"`
+		// ExpireAfterSeconds is set on TTL indexes only.
+		ExpireAfterSeconds *float64 `bson:"expireAfterSeconds"`
+	}
+
+	specs := map[string][]indexSpec{}
+	collections := map[string]*mongo.Collection{}
+	for _, spec := range d.indexSpecs() {
+		specs[spec.collection.Name()] = append(specs[spec.collection.Name()], spec)
+		collections[spec.collection.Name()] = spec.collection
+	}
+
+	names := make([]string, 0, len(collections))
+	for name := range collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	drift := []IndexDrift{}
+	for _, name := range names {
+		cur, err := collections[name].Indexes().List(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var indexes []actualIndex
+		if err := cur.All(ctx, &indexes); err != nil {
+			return nil, err
+		}
+		actual := make(map[string]actualIndex, len(indexes))
+		for _, index := range indexes {
+			actual[index.Name] = index
+		}
+
+		for _, spec := range specs[name] {
+			index, ok := actual[spec.name]
+			delete(actual, spec.name)
+			switch {
+			case !ok:
+				drift = append(drift, IndexDrift{Collection: name, Index: spec.name, Problem: "missing"})
+			case spec.text() && !sameFields(spec.keys, index.Weights):
+				drift = append(drift, IndexDrift{Collection: name, Index: spec.name, Problem: "text fields differ"})
+			case spec.text() && index.DefaultLanguage != textLanguage:
+				drift = append(drift, IndexDrift{Collection: name, Index: spec.name, Problem: "language differs"})
+			case !spec.text() && !sameKeys(spec.keys, index.Key):
+				drift = append(drift, IndexDrift{Collection: name, Index: spec.name, Problem: "keys differ"})
+			case spec.unique != index.Unique || spec.sparse != index.Sparse || spec.ttl != (index.ExpireAfterSeconds != nil):
+				drift = append(drift, IndexDrift{Collection: name, Index: spec.name, Problem: "options differ"})
+			}
+		}
+
+		delete(actual, "_id_")
+		extra := make([]string, 0, len(actual))
+		for index := range actual {
+			extra = append(extra, index)
+		}
+		sort.Strings(extra)
+		for _, index := range extra {
+			drift = append(drift, IndexDrift{Collection: name, Index: index, Problem: "not declared"})
+		}
+	}
+
+	return drift, nil
+}
+
+func sameKeys(declared, actual bson.D) bool {
+	if len(declared) != len(actual) {
+		return false
+	}
+	for i := range declared {
+		if declared[i].Key != actual[i].Key || fmt.Sprint(declared[i].Value) != fmt.Sprint(actual[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameFields(declared bson.D, weights bson.M) bool {
+	fields := make([]string, 0, len(declared))
+	for _, k := range declared {
+		fields = append(fields, k.Key)
+	}
+	actual := make([]string, 0, len(weights))
+	for field := range weights {
+		actual = append(actual, field)
+	}
+	sort.Strings(fields)
+	sort.Strings(actual)
+	return strings.Join(fields, ",") == strings.Join(actual, ",")
+}
@@ -0,0 +1,33 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// tenantKey is the ID of the single document of the tenant collection.
+const tenantKey = "tenant"
+
+// BindTenant marks the database as the database of the tenant on its
+// first call. The upsert keeps the tenant of a bound database.
+func (d *Database) BindTenant(ctx context.Context, tenantID string) error {
+	var bound struct {
+		TenantID string `bson:"tenant_id"`
+	}
+	err := d.tenantCollection.FindOneAndUpdate(ctx,
+		bson.M{"_id": tenantKey},
+		bson.M{"$setOnInsert": bson.M{"tenant_id": tenantID}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&bound)
+	if err != nil {
+		return err
+	}
+	if bound.TenantID != tenantID {
+		return fmt.Errorf("%w: %s", db.ErrTenantMismatch, bound.TenantID)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/DanilLagunov/diploma/pkg/models"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// DefaultLimit is the page size used when CourseQuery.Limit is not set.
+const DefaultLimit = 10
+
+// CourseSort is the field course listings are ordered by.
+// Ties are broken by course ID.
+type CourseSort string
+
+const (
+	// SortByID orders courses by ID, which follows creation order.
+	SortByID    CourseSort = "id"
+	SortByTitle CourseSort = "title"
+)
+
+// CourseQuery describes one page of a course listing.
+// Cursor is taken from a previous CoursePage; the rest of the query
+// must stay the same while paging.
+type CourseQuery struct {
+	// Title filters courses by case-insensitive substring.
+	Title  string
+	Sort   CourseSort
+	Desc   bool
+	Limit  int
+	Cursor string
+}
+
+// CoursePage is one page of a course listing. Next and Prev are empty
+// when there is no page in that direction.
+type CoursePage struct {
+	Courses []models.Course
+	Next    string
+	Prev    string
+}
+
+// Cursors reference the boundary course of a page, so they stay short
+// enough for Telegram callback data.
+const (
+	afterPrefix  = "a"
+	beforePrefix = "b"
+)
+
+// AfterCursor returns a cursor for the page following the course.
+func AfterCursor(id string) string {
+	return afterPrefix + id
+}
+
+// BeforeCursor returns a cursor for the page preceding the course.
+func BeforeCursor(id string) string {
+	return beforePrefix + id
+}
+
+// ParseCursor returns the boundary course ID of a cursor and whether
+// the page lies before it.
+func ParseCursor(cursor string) (id string, before bool, err error) {
+	if len(cursor) < 2 {
+		return "", false, ErrInvalidCursor
+	}
+	switch cursor[:1] {
+	case afterPrefix:
+		return cursor[1:], false, nil
+	case beforePrefix:
+		return cursor[1:], true, nil
+	default:
+		return "", false, ErrInvalidCursor
+	}
+}
+
+// NewCoursePage builds a page from courses fetched in query order
+// with one extra item to detect whether more courses follow.
+// Courses fetched before a cursor must already be restored to query order,
+// with the extra item first.
+func NewCoursePage(courses []models.Course, limit int, cursor string, before bool) CoursePage {
+	more := len(courses) > limit
+	if more {
+		if before {
+			courses = courses[1:]
+		} else {
+			courses = courses[:limit]
+		}
+	}
+	page := CoursePage{Courses: courses}
+	if len(courses) == 0 {
+		return page
+	}
+	first, last := courses[0].ID, courses[len(courses)-1].ID
+	if before {
+		page.Next = AfterCursor(last)
+		if more {
+			page.Prev = BeforeCursor(first)
+		}
+	} else {
+		if more {
+			page.Next = AfterCursor(last)
+		}
+		if cursor != "" {
+			page.Prev = BeforeCursor(first)
+		}
+	}
+	return page
+}
@@ -0,0 +1,355 @@
+package retry
+
+import (
+	"context"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/config"
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/models"
+)
+
+// Database wraps a db.Database. Reads and idempotent writes are retried.
+// Creates and writes whose result depends on the state they change are
+// not, since a failed attempt may still have been applied and the retry
+// would report it wrongly, e.g. as already enrolled or as a conflict.
+// Every call goes through the breaker and returns an error matching
+// db.ErrUnavailable while it is open.
+type Database struct {
+	db.Database
+	policy *policy
+}
+
+// New creating a Database with the retry and breaker settings.
+func New(database db.Database, cfg config.Retry) *Database {
+	retryable := Retryable
+	if c, ok := database.(Classifier); ok {
+		retryable = func(err error) bool { return c.Retryable(err) || Retryable(err) }
+	}
+	return &Database{
+		Database: database,
+		policy: &policy{
+			cfg:       cfg,
+			retryable: retryable,
+			breaker:   &breaker{threshold: cfg.BreakerThreshold, cooldown: cfg.BreakerCooldown, now: time.Now},
+			budget:    newBudget(cfg.Budget),
+			sleep:     sleep,
+		},
+	}
+}
+
+// USER DB HANDLERS
+
+func (d *Database) CreateUser(ctx context.Context, email, password string) error {
+	return d.policy.call(ctx, func(ctx context.Context) error {
+		return d.Database.CreateUser(ctx, email, password)
+	})
+}
+
+func (d *Database) GetUser(ctx context.Context, email string) (user models.User, err error) {
+	err = d.policy.retry(ctx, func(ctx context.Context) error {
+		user, err = d.Database.GetUser(ctx, email)
+		return err
+	})
+	return user, err
+}
+
+func (d *Database) GetUserByChatID(ctx context.Context, chatID int64) (user models.User, err error) {
+	err = d.policy.retry(ctx, func(ctx context.Context) error {
+		user, err = d.Database.GetUserByChatID(ctx, chatID)
+		return err
+	})
+	return user, err
+}
+
+func (d *Database) UpdateUser(ctx context.Context, email string, chatID int64) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.UpdateUser(ctx, email, chatID)
+	})
+}
+
+func (d *Database) GetUserCourses(ctx context.Context, chatID int64) (courses []models.Course, err error) {
+	err = d.policy.retry(ctx, func(ctx context.Context) error {
+		courses, err = d.Database.GetUserCourses(ctx, chatID)
+		return err
+	})
+	return courses, err
+}
+
+func (d *Database) EnrollUser(ctx context.Context, chatID int64, courseID string) (result db.EnrollResult, err error) {
+	err = d.policy.call(ctx, func(ctx context.Context) error {
+		result, err = d.Database.EnrollUser(ctx, chatID, courseID)
+		return err
+	})
+	return result, err
+}
+
+// COURSES DB HANDLERS
+
+func (d *Database) GetCourse(ctx context.Context, id string) (course models.Course, err error) {
+	err = d.policy.retry(ctx, func(ctx context.Context) error {
+		course, err = d.Database.GetCourse(ctx, id)
+		return err
+	})
+	return course, err
+}
+
+func (d *Database) GetAvailableCourse(ctx context.Context, chatId int64, id string) (course models.Course, err error) {
+	err = d.policy.retry(ctx, func(ctx context.Context) error {
+		course, err = d.Database.GetAvailableCourse(ctx, chatId, id)
+		return err
+	})
+	return course, err
+}
+
+func (d *Database) GetCourses(ctx context.Context) (courses []models.Course, err error) {
+	err = d.policy.retry(ctx, func(ctx context.Context) error {
+		courses, err = d.Database.GetCourses(ctx)
+		return err
+	})
+	return courses, err
+}
+
+func (d *Database) ListCourses(ctx context.Context, query db.CourseQuery) (page db.CoursePage, err error) {
+	err = d.policy.retry(ctx, func(ctx context.Context) error {
+		page, err = d.Database.ListCourses(ctx, query)
+		return err
+	})
+	return page, err
+}
+
+func (d *Database) SearchCourses(ctx context.Context, query string, limit int) (courses []models.Course, err error) {
+	err = d.policy.retry(ctx, func(ctx context.Context) error {
+		courses, err = d.Database.SearchCourses(ctx, query, limit)
+		return err
+	})
+	return courses, err
+}
+
+func (d *Database) CreateCourse(ctx context.Context, title, description string, lessons []models.Lesson) (course models.Course, err error) {
+	err = d.policy.call(ctx, func(ctx context.Context) error {
+		course, err = d.Database.CreateCourse(ctx, title, description, lessons)
+		return err
+	})
+	return course, err
+}
+
+func (d *Database) SaveCourse(ctx context.Context, course models.Course) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.SaveCourse(ctx, course)
+	})
+}
+
+func (d *Database) UpdateCourse(ctx context.Context, id string, version int, title, description string) error {
+	return d.policy.call(ctx, func(ctx context.Context) error {
+		return d.Database.UpdateCourse(ctx, id, version, title, description)
+	})
+}
+
+func (d *Database) DeleteCourse(ctx context.Context, id string) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.DeleteCourse(ctx, id)
+	})
+}
+
+func (d *Database) ArchiveCourse(ctx context.Context, id string) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.ArchiveCourse(ctx, id)
+	})
+}
+
+func (d *Database) RestoreCourse(ctx context.Context, id string) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.RestoreCourse(ctx, id)
+	})
+}
+
+func (d *Database) GetCourseLessons(ctx context.Context, id string) (lessons []models.Lesson, err error) {
+	err = d.policy.retry(ctx, func(ctx context.Context) error {
+		lessons, err = d.Database.GetCourseLessons(ctx, id)
+		return err
+	})
+	return lessons, err
+}
+
+func (d *Database) AddCourseLesson(ctx context.Context, courseID, lessonID string) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.AddCourseLesson(ctx, courseID, lessonID)
+	})
+}
+
+func (d *Database) RemoveCourseLesson(ctx context.Context, courseID, lessonID string) error {
+	return d.policy.call(ctx, func(ctx context.Context) error {
+		return d.Database.RemoveCourseLesson(ctx, courseID, lessonID)
+	})
+}
+
+func (d *Database) ReorderCourseLessons(ctx context.Context, courseID string, lessonIDs []string) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.ReorderCourseLessons(ctx, courseID, lessonIDs)
+	})
+}
+
+// LESSONS DB HANDLERS
+
+func (d *Database) CreateLesson(ctx context.Context, title, lection, task string, estimated int) (lesson models.Lesson, err error) {
+	err = d.policy.call(ctx, func(ctx context.Context) error {
+		lesson, err = d.Database.CreateLesson(ctx, title, lection, task, estimated)
+		return err
+	})
+	return lesson, err
+}
+
+func (d *Database) GetLesson(ctx context.Context, id string) (lesson models.Lesson, err error) {
+	err = d.policy.retry(ctx, func(ctx context.Context) error {
+		lesson, err = d.Database.GetLesson(ctx, id)
+		return err
+	})
+	return lesson, err
+}
+
+func (d *Database) SaveLesson(ctx context.Context, lesson models.Lesson) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.SaveLesson(ctx, lesson)
+	})
+}
+
+func (d *Database) SearchLessons(ctx context.Context, query string, limit int) (lessons []models.Lesson, err error) {
+	err = d.policy.retry(ctx, func(ctx context.Context) error {
+		lessons, err = d.Database.SearchLessons(ctx, query, limit)
+		return err
+	})
+	return lessons, err
+}
+
+func (d *Database) UpdateLesson(ctx context.Context, id string, version int, title, lection, task string, estimated int) error {
+	return d.policy.call(ctx, func(ctx context.Context) error {
+		return d.Database.UpdateLesson(ctx, id, version, title, lection, task, estimated)
+	})
+}
+
+func (d *Database) DeleteLesson(ctx context.Context, id string) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.DeleteLesson(ctx, id)
+	})
+}
+
+func (d *Database) ArchiveLesson(ctx context.Context, id string) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.ArchiveLesson(ctx, id)
+	})
+}
+
+func (d *Database) RestoreLesson(ctx context.Context, id string) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.RestoreLesson(ctx, id)
+	})
+}
+
+// ENROLLMENTS DB HANDLERS
+
+func (d *Database) GetEnrollment(ctx context.Context, userID, courseID string) (enrollment models.Enrollment, err error) {
+	err = d.policy.retry(ctx, func(ctx context.Context) error {
+		enrollment, err = d.Database.GetEnrollment(ctx, userID, courseID)
+		return err
+	})
+	return enrollment, err
+}
+
+func (d *Database) GetUserEnrollments(ctx context.Context, userID string) (enrollments []models.Enrollment, err error) {
+	err = d.policy.retry(ctx, func(ctx context.Context) error {
+		enrollments, err = d.Database.GetUserEnrollments(ctx, userID)
+		return err
+	})
+	return enrollments, err
+}
+
+func (d *Database) GetCourseEnrollments(ctx context.Context, courseID string) (enrollments []models.Enrollment, err error) {
+	err = d.policy.retry(ctx, func(ctx context.Context) error {
+		enrollments, err = d.Database.GetCourseEnrollments(ctx, courseID)
+		return err
+	})
+	return enrollments, err
+}
+
+func (d *Database) UpdateEnrollmentStatus(ctx context.Context, userID, courseID string, status models.EnrollmentStatus) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.UpdateEnrollmentStatus(ctx, userID, courseID, status)
+	})
+}
+
+// AUDIT DB HANDLERS
+
+func (d *Database) AppendAudit(ctx context.Context, entry models.AuditEntry) error {
+	return d.policy.call(ctx, func(ctx context.Context) error {
+		return d.Database.AppendAudit(ctx, entry)
+	})
+}
+
+func (d *Database) GetAuditLog(ctx context.Context, query db.AuditQuery) (entries []models.AuditEntry, err error) {
+	err = d.policy.retry(ctx, func(ctx context.Context) error {
+		entries, err = d.Database.GetAuditLog(ctx, query)
+		return err
+	})
+	return entries, err
+}
+
+// CHAT STATE DB HANDLERS
+
+func (d *Database) GetChatState(ctx context.Context, chatID int64) (state models.ChatState, err error) {
+	err = d.policy.retry(ctx, func(ctx context.Context) error {
+		state, err = d.Database.GetChatState(ctx, chatID)
+		return err
+	})
+	return state, err
+}
+
+// SaveChatState replaces the whole state, so it is safe to retry.
+func (d *Database) SaveChatState(ctx context.Context, state models.ChatState) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.SaveChatState(ctx, state)
+	})
+}
+
+func (d *Database) DeleteChatState(ctx context.Context, chatID int64) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.DeleteChatState(ctx, chatID)
+	})
+}
+
+// TENANT DB HANDLERS
+
+func (d *Database) BindTenant(ctx context.Context, tenantID string) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.BindTenant(ctx, tenantID)
+	})
+}
+
+// BACKUP DB HANDLERS
+
+// Export is not retried, fn may have consumed part of the records.
+func (d *Database) Export(ctx context.Context, collection string, fn func(record interface{}) error) error {
+	return d.policy.call(ctx, func(ctx context.Context) error {
+		return d.Database.Export(ctx, collection, fn)
+	})
+}
+
+func (d *Database) Import(ctx context.Context, record interface{}) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.Import(ctx, record)
+	})
+}
+
+func (d *Database) Clear(ctx context.Context, collection string) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.Clear(ctx, collection)
+	})
+}
+
+// WithTransaction retries the whole unit of work, fn only touches tx by
+// contract. Calls made through tx are not retried one by one.
+func (d *Database) WithTransaction(ctx context.Context, fn func(ctx context.Context, tx db.Database) error) error {
+	return d.policy.retry(ctx, func(ctx context.Context) error {
+		return d.Database.WithTransaction(ctx, fn)
+	})
+}
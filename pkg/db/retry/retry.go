@@ -0,0 +1,197 @@
+// Package retry wraps a db.Database with retries of transient errors and a
+// circuit breaker that fails fast while the database is down.
+package retry
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/config"
+	"github.com/DanilLagunov/diploma/pkg/db"
+)
+
+// Classifier is implemented by backends that tell transient errors apart.
+// Backends without it get the network level checks of Retryable.
+type Classifier interface {
+	Retryable(err error) bool
+}
+
+// Retryable reports whether err is a transient network failure.
+func Retryable(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// unavailableError is returned while the breaker is open and when retries
+// are exhausted. It matches db.ErrUnavailable and unwraps to the cause.
+type unavailableError struct {
+	err error
+}
+
+func (e unavailableError) Error() string {
+	if e.err == nil {
+		return db.ErrUnavailable.Error()
+	}
+	return db.ErrUnavailable.Error() + ": " + e.err.Error()
+}
+
+func (e unavailableError) Is(target error) bool { return target == db.ErrUnavailable }
+
+func (e unavailableError) Unwrap() error { return e.err }
+
+// policy runs calls with retries and the breaker.
+type policy struct {
+	cfg       config.Retry
+	retryable func(error) bool
+	breaker   *breaker
+	budget    *budget
+	sleep     func(ctx context.Context, d time.Duration) error
+}
+
+// call runs fn once through the breaker.
+func (p *policy) call(ctx context.Context, fn func(ctx context.Context) error) error {
+	return p.run(ctx, 1, fn)
+}
+
+// retry runs fn through the breaker and retries transient errors with
+// jittered exponential backoff, as long as attempts and budget last.
+func (p *policy) retry(ctx context.Context, fn func(ctx context.Context) error) error {
+	return p.run(ctx, p.cfg.Attempts, fn)
+}
+
+func (p *policy) run(ctx context.Context, attempts int, fn func(ctx context.Context) error) error {
+	backoff := p.cfg.Backoff
+	for attempt := 1; ; attempt++ {
+		if !p.breaker.allow() {
+			return unavailableError{}
+		}
+		err := fn(ctx)
+		if err != nil && ctx.Err() != nil {
+			// The caller gave up, the error says nothing about the database.
+			p.breaker.release()
+			return err
+		}
+		transient := err != nil && p.retryable(err)
+		p.breaker.record(transient)
+		p.budget.record(transient)
+		if !transient {
+			return err
+		}
+		if attempt >= attempts || !p.budget.allow() {
+			return unavailableError{err: err}
+		}
+		if err := p.sleep(ctx, time.Duration(rand.Int63n(int64(backoff)+1))); err != nil {
+			return err
+		}
+		if backoff *= 2; backoff > p.cfg.MaxBackoff {
+			backoff = p.cfg.MaxBackoff
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// breaker opens after threshold consecutive transient failures. While open
+// every call fails fast; after the cooldown one call probes the database
+// and closes the breaker on success or opens it again on failure.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (b *breaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || b.now().Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *breaker) record(failed bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = b.now()
+	}
+}
+
+// release ends a probe without a verdict.
+func (b *breaker) release() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// budget throttles retries when most calls fail, so retries do not
+// multiply the load of a struggling database. Failures take a token,
+// successes return a tenth of one, and retries need half of the tokens.
+type budget struct {
+	mu     sync.Mutex
+	max    float64
+	tokens float64
+}
+
+func newBudget(max int) *budget {
+	return &budget{max: float64(max), tokens: float64(max)}
+}
+
+func (b *budget) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if failed {
+		if b.tokens--; b.tokens < 0 {
+			b.tokens = 0
+		}
+	} else if b.tokens += 0.1; b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+func (b *budget) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens > b.max/2
+}
@@ -0,0 +1,82 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/config"
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/models"
+)
+
+// flaky fails the first calls with a transient error, after applying them.
+type flaky struct {
+	db.Database
+	fail  int
+	calls int
+}
+
+func (f *flaky) attempt() error {
+	f.calls++
+	if f.calls <= f.fail {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (f *flaky) GetCourse(ctx context.Context, id string) (models.Course, error) {
+	return models.Course{ID: id}, f.attempt()
+}
+
+func (f *flaky) EnrollUser(ctx context.Context, chatID int64, courseID string) (db.EnrollResult, error) {
+	if err := f.attempt(); err != nil {
+		return db.EnrollUnknown, err
+	}
+	if f.calls > 1 {
+		return db.AlreadyEnrolled, nil
+	}
+	return db.Enrolled, nil
+}
+
+func (f *flaky) UpdateCourse(ctx context.Context, id string, version int, title, description string) error {
+	if err := f.attempt(); err != nil {
+		return err
+	}
+	if f.calls > 1 {
+		return db.ErrConflict
+	}
+	return nil
+}
+
+func newDatabase(f *flaky) *Database {
+	cfg := config.Default().Database.Retry
+	cfg.Backoff, cfg.MaxBackoff = time.Millisecond, time.Millisecond
+	return New(f, cfg)
+}
+
+func TestReadsAreRetried(t *testing.T) {
+	f := &flaky{fail: 1}
+	if _, err := newDatabase(f).GetCourse(context.Background(), "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if f.calls != 2 {
+		t.Errorf("%d calls, want 2", f.calls)
+	}
+}
+
+func TestStateDependentWritesAreNotRetried(t *testing.T) {
+	f := &flaky{fail: 1}
+	result, err := newDatabase(f).EnrollUser(context.Background(), 1, "c1")
+	if err == nil || result != db.EnrollUnknown || f.calls != 1 {
+		t.Errorf("enroll: %v, %v after %d calls", result, err, f.calls)
+	}
+
+	f = &flaky{fail: 1}
+	err = newDatabase(f).UpdateCourse(context.Background(), "c1", 1, "Назва", "Опис")
+	if err == nil || errors.Is(err, db.ErrConflict) || f.calls != 1 {
+		t.Errorf("update: %v after %d calls", err, f.calls)
+	}
+}
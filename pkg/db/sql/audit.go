@@ -0,0 +1,86 @@
+package sql
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AppendAudit inserts an audit entry. Entries are never updated or removed.
+func (d *Database) AppendAudit(ctx context.Context, entry models.AuditEntry) error {
+	if entry.ID == "" {
+		entry.ID = primitive.NewObjectID().Hex()
+	}
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.ExecContext(ctx,
+		d.rebind("INSERT INTO audit_log (id, actor, action, entity, entity_id, changes, at) VALUES (?, ?, ?, ?, ?, ?, ?)"),
+		entry.ID, entry.Actor, entry.Action, entry.Entity, entry.EntityID, string(changes), entry.At.UTC())
+	return err
+}
+
+// GetAuditLog returns matching audit entries, newest first.
+func (d *Database) GetAuditLog(ctx context.Context, query db.AuditQuery) ([]models.AuditEntry, error) {
+	where := []string{"1 = 1"}
+	args := []interface{}{}
+	if query.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, query.Actor)
+	}
+	if query.Entity != "" {
+		where = append(where, "entity = ?")
+		args = append(args, query.Entity)
+	}
+	if query.EntityID != "" {
+		where = append(where, "entity_id = ?")
+		args = append(args, query.EntityID)
+	}
+	if !query.From.IsZero() {
+		where = append(where, "at >= ?")
+		args = append(args, query.From.UTC())
+	}
+	if !query.To.IsZero() {
+		where = append(where, "at <= ?")
+		args = append(args, query.To.UTC())
+	}
+	if query.Limit <= 0 {
+		query.Limit = db.DefaultAuditLimit
+	}
+	args = append(args, query.Limit)
+
+	rows, err := d.conn.QueryContext(ctx, d.rebind(
+		"SELECT "+auditColumns+" FROM audit_log WHERE "+
+			strings.Join(where, " AND ")+" ORDER BY at DESC LIMIT ?"), args...)
+	if err != nil {
+		return []models.AuditEntry{}, err
+	}
+	defer rows.Close()
+
+	result := []models.AuditEntry{}
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
+
+const auditColumns = "id, actor, action, entity, entity_id, changes, at"
+
+func scanAuditEntry(row scanner) (models.AuditEntry, error) {
+	var entry models.AuditEntry
+	var changes string
+	if err := row.Scan(&entry.ID, &entry.Actor, &entry.Action, &entry.Entity, &entry.EntityID, &changes, &entry.At); err != nil {
+		return entry, err
+	}
+	err := json.Unmarshal([]byte(changes), &entry.Changes)
+	return entry, err
+}
@@ -0,0 +1,196 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/models"
+)
+
+// tables maps backup collections to tables.
+var tables = map[string]string{
+	db.CollectionLessons:     "lessons",
+	db.CollectionCourses:     "courses",
+	db.CollectionUsers:       "users",
+	db.CollectionEnrollments: "enrollments",
+	db.CollectionChatStates:  "chat_states",
+	db.CollectionAudit:       "audit_log",
+}
+
+// Export reads the whole collection before calling fn, so fn may use the
+// database even on SQLite's single connection.
+func (d *Database) Export(ctx context.Context, collection string, fn func(record interface{}) error) error {
+	records, err := d.export(ctx, collection)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Database) export(ctx context.Context, collection string) ([]interface{}, error) {
+	table, ok := tables[collection]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", db.ErrUnknownCollection, collection)
+	}
+	var query string
+	switch collection {
+	case db.CollectionLessons:
+		query = "SELECT " + lessonColumns + " FROM lessons ORDER BY id"
+	case db.CollectionCourses:
+		rows, err := d.conn.QueryContext(ctx, "SELECT "+courseColumns+" FROM courses ORDER BY id")
+		if err != nil {
+			return nil, err
+		}
+		courses, err := d.scanCourses(ctx, rows)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]interface{}, 0, len(courses))
+		for _, course := range courses {
+			records = append(records, course)
+		}
+		return records, nil
+	case db.CollectionUsers:
+		query = "SELECT id, chat_id, email, password FROM users ORDER BY id"
+	case db.CollectionEnrollments:
+		query = "SELECT user_id, course_id, enrolled_at, status FROM enrollments ORDER BY user_id, course_id"
+	case db.CollectionChatStates:
+		query = "SELECT chat_id, state, data, expires_at, updated_at FROM chat_states ORDER BY chat_id"
+	default:
+		query = "SELECT " + auditColumns + " FROM " + table + " ORDER BY at, id"
+	}
+
+	rows, err := d.conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []interface{}{}
+	for rows.Next() {
+		var record interface{}
+		switch collection {
+		case db.CollectionLessons:
+			record, err = scanLesson(rows)
+		case db.CollectionUsers:
+			var user models.User
+			var chatID sql.NullInt64
+			err = rows.Scan(&user.ID, &chatID, &user.Email, &user.Password)
+			user.ChatID = chatID.Int64
+			record = user
+		case db.CollectionEnrollments:
+			var enrollment models.Enrollment
+			err = rows.Scan(&enrollment.UserID, &enrollment.CourseID, &enrollment.EnrolledAt, &enrollment.Status)
+			record = enrollment
+		case db.CollectionChatStates:
+			var state models.ChatState
+			var data string
+			err = rows.Scan(&state.ChatID, &state.State, &data, &state.ExpiresAt, &state.UpdatedAt)
+			if err == nil {
+				err = json.Unmarshal([]byte(data), &state.Data)
+			}
+			record = state
+		default:
+			record, err = scanAuditEntry(rows)
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (d *Database) Import(ctx context.Context, record interface{}) error {
+	switch r := record.(type) {
+	case models.Lesson:
+		_, err := d.conn.ExecContext(ctx, d.rebind(`INSERT INTO lessons (`+lessonColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET title = excluded.title, lection = excluded.lection, task = excluded.task,
+estimated_time = excluded.estimated_time, version = excluded.version, archived_at = excluded.archived_at, deleted_at = excluded.deleted_at`),
+			r.ID, r.Title, r.Lection, r.Task, r.EstimatedTime, r.Version, r.ArchivedAt, r.DeletedAt)
+		return err
+	case models.Course:
+		return d.withTx(ctx, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, d.rebind(`INSERT INTO courses (`+courseColumns+`) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET title = excluded.title, description = excluded.description, version = excluded.version,
+archived_at = excluded.archived_at, deleted_at = excluded.deleted_at`),
+				r.ID, r.Title, r.Description, r.Version, r.ArchivedAt, r.DeletedAt)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, d.rebind("DELETE FROM course_lessons WHERE course_id = ?"), r.ID)
+			if err != nil {
+				return err
+			}
+			for i, lessonID := range r.LessonIDs {
+				_, err := tx.ExecContext(ctx,
+					d.rebind("INSERT INTO course_lessons (course_id, lesson_id, position) VALUES (?, ?, ?)"),
+					r.ID, lessonID, i)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	case models.User:
+		chatID := sql.NullInt64{Int64: r.ChatID, Valid: r.ChatID != 0}
+		_, err := d.conn.ExecContext(ctx, d.rebind(`INSERT INTO users (id, chat_id, email, password) VALUES (?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET chat_id = excluded.chat_id, email = excluded.email, password = excluded.password`),
+			r.ID, chatID, r.Email, r.Password)
+		return err
+	case models.Enrollment:
+		_, err := d.conn.ExecContext(ctx, d.rebind(`INSERT INTO enrollments (user_id, course_id, enrolled_at, status) VALUES (?, ?, ?, ?)
+ON CONFLICT (user_id, course_id) DO UPDATE SET enrolled_at = excluded.enrolled_at, status = excluded.status`),
+			r.UserID, r.CourseID, r.EnrolledAt.UTC(), r.Status)
+		return err
+	case models.ChatState:
+		data, err := json.Marshal(r.Data)
+		if err != nil {
+			return err
+		}
+		_, err = d.conn.ExecContext(ctx, d.rebind(`INSERT INTO chat_states (chat_id, state, data, expires_at, updated_at) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (chat_id) DO UPDATE SET state = excluded.state, data = excluded.data,
+expires_at = excluded.expires_at, updated_at = excluded.updated_at`),
+			r.ChatID, r.State, string(data), r.ExpiresAt.UTC(), r.UpdatedAt.UTC())
+		return err
+	case models.AuditEntry:
+		changes, err := json.Marshal(r.Changes)
+		if err != nil {
+			return err
+		}
+		res, err := d.conn.ExecContext(ctx, d.rebind(`INSERT INTO audit_log (`+auditColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (id) DO NOTHING`),
+			r.ID, r.Actor, r.Action, r.Entity, r.EntityID, string(changes), r.At.UTC())
+		if err := affected(res, err); !errors.Is(err, db.ErrNotFound) {
+			return err
+		}
+		existing, err := scanAuditEntry(d.conn.QueryRowContext(ctx,
+			d.rebind("SELECT "+auditColumns+" FROM audit_log WHERE id = ?"), r.ID))
+		if err != nil {
+			return err
+		}
+		if !db.SameAuditEntry(existing, r) {
+			return fmt.Errorf("%w: %s", db.ErrAuditConflict, r.ID)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: record %T", db.ErrUnknownCollection, record)
+	}
+}
+
+func (d *Database) Clear(ctx context.Context, collection string) error {
+	table, ok := tables[collection]
+	if !ok {
+		return fmt.Errorf("%w: %q", db.ErrUnknownCollection, collection)
+	}
+	_, err := d.conn.ExecContext(ctx, "DELETE FROM "+table)
+	return err
+}
@@ -0,0 +1,63 @@
+package sql
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+)
+
+// TestBackupCoversTables checks that every table is exported or listed in
+// db.Unexported, so a new table is not left out of backups by mistake.
+func TestBackupCoversTables(t *testing.T) {
+	ctx := context.Background()
+	d := newSQLite(t)
+	migrator, err := d.Migrator(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	covered := map[string]bool{
+		// Stored with the courses, and the bookkeeping of migrations.
+		"course_lessons":         true,
+		"schema_migrations":      true,
+		"schema_migrations_lock": true,
+	}
+	for _, collection := range db.Collections {
+		table, ok := tables[collection]
+		if !ok {
+			t.Errorf("collection %s has no table", collection)
+		}
+		covered[table] = true
+	}
+	for _, collection := range db.Unexported {
+		covered[collection] = true
+	}
+
+	rows, err := d.conn.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(name, "_search") {
+			// Full-text index tables, rebuilt from the indexed tables.
+			continue
+		}
+		if !covered[name] {
+			t.Errorf("table %s is neither exported nor in db.Unexported", name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
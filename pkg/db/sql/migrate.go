@@ -0,0 +1,275 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/migrations"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the Postgres advisory lock key of the migrations.
+const migrationLockKey = 4217301
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// loadMigrations reads embedded migrations ordered by version. File names
+// have the form <version>_<name>.sql, the optional rollback is in
+// <version>_<name>.down.sql.
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		down := strings.HasSuffix(name, ".down")
+		name = strings.TrimSuffix(name, ".down")
+		split := strings.SplitN(name, "_", 2)
+		version, err := strconv.Atoi(split[0])
+		if err != nil || len(split) < 2 {
+			return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+		}
+		query, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: split[1]}
+			byVersion[version] = m
+		}
+		if m.name != split[1] {
+			return nil, fmt.Errorf("duplicate migration version: %d", version)
+		}
+		if down {
+			m.down = string(query)
+		} else {
+			m.up = string(query)
+		}
+	}
+
+	result := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.version, m.name)
+		}
+		result = append(result, *m)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].version < result[j].version })
+	return result, nil
+}
+
+// sqliteMigrations run after the SQL of the migration with the same name
+// on SQLite, for schema its SQL file can not hold.
+var sqliteMigrations = map[string]struct {
+	up, down func(ctx context.Context, tx *sql.Tx) error
+}{
+	"search_index": {up: createSearchIndex, down: dropSearchIndex},
+}
+
+// Migrator returns a migrator over the embedded SQL migrations. Applied
+// migrations are recorded in the schema_migrations table, in the
+// transaction of the migration.
+func (d *Database) Migrator(out io.Writer) (*migrations.Migrator, error) {
+	files, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]migrations.Migration, 0, len(files))
+	found := 0
+	for _, file := range files {
+		file := file
+		code, ok := sqliteMigrations[file.name]
+		if ok {
+			found++
+		}
+		if d.driver != DriverSQLite {
+			code.up, code.down = nil, nil
+		}
+		m := migrations.Migration{
+			Version: file.version,
+			Name:    file.name,
+			Up: d.recorded(file.version, file.name, func(ctx context.Context, tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, file.up); err != nil || code.up == nil {
+					return err
+				}
+				return code.up(ctx, tx)
+			}),
+		}
+		if file.down != "" {
+			m.Down = d.recorded(file.version, "", func(ctx context.Context, tx *sql.Tx) error {
+				if code.down != nil {
+					if err := code.down(ctx, tx); err != nil {
+						return err
+					}
+				}
+				_, err := tx.ExecContext(ctx, file.down)
+				return err
+			})
+		}
+		list = append(list, m)
+	}
+	if found != len(sqliteMigrations) {
+		return nil, fmt.Errorf("sqlite migrations without a migration file: %d of %d found", found, len(sqliteMigrations))
+	}
+	return migrations.New(&migrationStore{d: d}, out, list...)
+}
+
+// recorded runs fn in a transaction that records the migration as applied,
+// or as rolled back when name is empty.
+func (d *Database) recorded(version int, name string, fn func(ctx context.Context, tx *sql.Tx) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return d.withTx(ctx, func(tx *sql.Tx) error {
+			if err := fn(ctx, tx); err != nil {
+				return err
+			}
+			if name == "" {
+				_, err := tx.ExecContext(ctx, d.rebind("DELETE FROM schema_migrations WHERE version = ?"), version)
+				return err
+			}
+			_, err := tx.ExecContext(ctx,
+				d.rebind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"),
+				version, name, time.Now().UTC())
+			return err
+		})
+	}
+}
+
+// migrationStore implements migrations.Store. On Postgres the lock is a
+// session advisory lock, released by the server when the holder dies. On
+// SQLite it is a row that can be taken over once it expires.
+type migrationStore struct {
+	d *Database
+	// lockConn holds the advisory lock on Postgres.
+	lockConn *sql.Conn
+}
+
+func (s *migrationStore) init(ctx context.Context) error {
+	_, err := s.d.conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied_at TIMESTAMP NOT NULL
+)`)
+	if err != nil || s.d.driver == DriverPostgres {
+		return err
+	}
+	_, err = s.d.conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations_lock (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    owner TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+)`)
+	return err
+}
+
+func (s *migrationStore) Applied(ctx context.Context) ([]migrations.Record, error) {
+	if err := s.init(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := s.d.conn.QueryContext(ctx, "SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []migrations.Record
+	for rows.Next() {
+		var record migrations.Record
+		if err := rows.Scan(&record.Version, &record.Name, &record.AppliedAt); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// Save records a migration, the migration itself has already recorded it.
+func (s *migrationStore) Save(ctx context.Context, record migrations.Record) error {
+	_, err := s.d.conn.ExecContext(ctx, s.d.rebind(`INSERT INTO schema_migrations (version, name, applied_at)
+VALUES (?, ?, ?) ON CONFLICT (version) DO NOTHING`),
+		record.Version, record.Name, record.AppliedAt)
+	return err
+}
+
+func (s *migrationStore) Delete(ctx context.Context, version int) error {
+	_, err := s.d.conn.ExecContext(ctx, s.d.rebind("DELETE FROM schema_migrations WHERE version = ?"), version)
+	return err
+}
+
+func (s *migrationStore) Lock(ctx context.Context, owner string, ttl time.Duration) error {
+	if s.d.driver == DriverPostgres {
+		return s.advisoryLock(ctx)
+	}
+	if err := s.init(ctx); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	res, err := s.d.conn.ExecContext(ctx, `INSERT INTO schema_migrations_lock (id, owner, expires_at) VALUES (1, ?, ?)
+ON CONFLICT (id) DO UPDATE SET owner = excluded.owner, expires_at = excluded.expires_at
+WHERE schema_migrations_lock.owner = excluded.owner OR schema_migrations_lock.expires_at < ?`,
+		owner, now.Add(ttl), now)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return migrations.ErrLocked
+	}
+	return nil
+}
+
+// advisoryLock takes the lock on a connection of its own, or checks that
+// the connection holding it is still alive.
+func (s *migrationStore) advisoryLock(ctx context.Context) error {
+	if s.lockConn != nil {
+		return s.lockConn.PingContext(ctx)
+	}
+	if err := s.init(ctx); err != nil {
+		return err
+	}
+	conn, err := s.d.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", migrationLockKey).Scan(&locked); err != nil {
+		conn.Close()
+		return err
+	}
+	if !locked {
+		conn.Close()
+		return migrations.ErrLocked
+	}
+	s.lockConn = conn
+	return nil
+}
+
+func (s *migrationStore) Unlock(ctx context.Context, owner string) error {
+	if s.d.driver != DriverPostgres {
+		_, err := s.d.conn.ExecContext(ctx, "DELETE FROM schema_migrations_lock WHERE id = 1 AND owner = ?", owner)
+		return err
+	}
+	if s.lockConn == nil {
+		return nil
+	}
+	conn := s.lockConn
+	s.lockConn = nil
+	defer conn.Close()
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockKey)
+	return err
+}
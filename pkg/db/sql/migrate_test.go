@@ -0,0 +1,87 @@
+package sql
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/migrations"
+)
+
+func TestMigrateUpAndDown(t *testing.T) {
+	ctx := context.Background()
+	d := newSQLite(t)
+	var out bytes.Buffer
+	migrator, err := d.Migrator(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrator.DryRun = true
+	if err := migrator.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "would apply 0001_init") {
+		t.Errorf("dry run printed %q", out.String())
+	}
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if status.Applied {
+			t.Fatalf("%s applied by a dry run", status.Migration)
+		}
+	}
+
+	migrator.DryRun = false
+	if err := migrator.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Down(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.conn.ExecContext(ctx, "SELECT 1 FROM users"); err == nil {
+		t.Error("users table is left after rolling back every migration")
+	}
+	if err := migrator.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err = migrator.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if !status.Applied {
+			t.Errorf("%s is pending", status.Migration)
+		}
+	}
+}
+
+func TestMigrateLock(t *testing.T) {
+	ctx := context.Background()
+	d := newSQLite(t)
+	store := &migrationStore{d: d}
+	if err := store.Lock(ctx, "other", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	migrator, err := d.Migrator(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Up(ctx, 0); !errors.Is(err, migrations.ErrLocked) {
+		t.Fatalf("Up while locked: err = %v, want ErrLocked", err)
+	}
+
+	// An expired lock is taken over.
+	if err := store.Lock(ctx, "other", -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+}
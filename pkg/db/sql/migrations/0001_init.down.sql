@@ -0,0 +1,5 @@
+DROP TABLE enrollments;
+DROP TABLE course_lessons;
+DROP TABLE lessons;
+DROP TABLE courses;
+DROP TABLE users;
@@ -0,0 +1,38 @@
+CREATE TABLE users (
+    id TEXT PRIMARY KEY,
+    chat_id BIGINT,
+    email TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL
+);
+
+CREATE UNIQUE INDEX users_chat_id_idx ON users (chat_id);
+
+CREATE TABLE courses (
+    id TEXT PRIMARY KEY,
+    title TEXT NOT NULL,
+    description TEXT NOT NULL
+);
+
+CREATE TABLE lessons (
+    id TEXT PRIMARY KEY,
+    title TEXT NOT NULL,
+    lection TEXT NOT NULL,
+    task TEXT NOT NULL,
+    estimated_time INTEGER NOT NULL
+);
+
+CREATE TABLE course_lessons (
+    course_id TEXT NOT NULL REFERENCES courses (id) ON DELETE CASCADE,
+    lesson_id TEXT NOT NULL REFERENCES lessons (id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    PRIMARY KEY (course_id, lesson_id)
+);
+
+CREATE INDEX course_lessons_position_idx ON course_lessons (course_id, position);
+
+CREATE TABLE enrollments (
+    user_id TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    course_id TEXT NOT NULL REFERENCES courses (id) ON DELETE CASCADE,
+    enrolled_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, course_id)
+);
@@ -0,0 +1,3 @@
+DROP INDEX enrollments_course_id_idx;
+
+ALTER TABLE enrollments DROP COLUMN status;
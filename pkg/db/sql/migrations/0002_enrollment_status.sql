@@ -0,0 +1,3 @@
+ALTER TABLE enrollments ADD COLUMN status TEXT NOT NULL DEFAULT 'active';
+
+CREATE INDEX enrollments_course_id_idx ON enrollments (course_id);
@@ -0,0 +1,4 @@
+ALTER TABLE courses DROP COLUMN archived_at;
+ALTER TABLE courses DROP COLUMN deleted_at;
+ALTER TABLE lessons DROP COLUMN archived_at;
+ALTER TABLE lessons DROP COLUMN deleted_at;
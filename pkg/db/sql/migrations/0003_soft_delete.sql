@@ -0,0 +1,4 @@
+ALTER TABLE courses ADD COLUMN archived_at TIMESTAMP;
+ALTER TABLE courses ADD COLUMN deleted_at TIMESTAMP;
+ALTER TABLE lessons ADD COLUMN archived_at TIMESTAMP;
+ALTER TABLE lessons ADD COLUMN deleted_at TIMESTAMP;
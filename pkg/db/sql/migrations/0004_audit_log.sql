@@ -0,0 +1,13 @@
+CREATE TABLE audit_log (
+    id TEXT PRIMARY KEY,
+    actor TEXT NOT NULL,
+    action TEXT NOT NULL,
+    entity TEXT NOT NULL,
+    entity_id TEXT NOT NULL,
+    changes TEXT NOT NULL,
+    at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX audit_log_at_idx ON audit_log (at);
+CREATE INDEX audit_log_actor_idx ON audit_log (actor, at);
+CREATE INDEX audit_log_entity_idx ON audit_log (entity, entity_id, at);
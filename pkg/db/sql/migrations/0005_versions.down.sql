@@ -0,0 +1,2 @@
+ALTER TABLE courses DROP COLUMN version;
+ALTER TABLE lessons DROP COLUMN version;
@@ -0,0 +1,2 @@
+ALTER TABLE courses ADD COLUMN version INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE lessons ADD COLUMN version INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,9 @@
+CREATE TABLE chat_states (
+    chat_id BIGINT PRIMARY KEY,
+    state TEXT NOT NULL,
+    data TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX chat_states_expires_at_idx ON chat_states (expires_at);
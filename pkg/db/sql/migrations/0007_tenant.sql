@@ -0,0 +1,5 @@
+-- The tenant the database belongs to, a single row.
+CREATE TABLE tenant (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    tenant_id TEXT NOT NULL
+);
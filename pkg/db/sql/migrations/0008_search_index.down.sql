@@ -0,0 +1 @@
+-- The SQLite full-text search index is dropped in Go, see sqliteMigrations.
@@ -0,0 +1,2 @@
+-- The SQLite full-text search index is created in Go, see sqliteMigrations.
+-- Postgres searches with LIKE and needs no index.
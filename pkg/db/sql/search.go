@@ -0,0 +1,211 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/models"
+)
+
+// Search ranks rows by how many query terms they contain, matches in the
+// title weigh more than matches in the description. Postgres finds rows
+// containing a term with LIKE. SQLite's LOWER only folds ASCII, so there
+// rows are found in a full-text index of words starting with a term.
+
+// searchIndexes are the full-text indexes kept by triggers, by table.
+var searchIndexes = []struct {
+	table   string
+	columns []string
+}{
+	{table: "courses", columns: []string{"title", "description"}},
+	{table: "lessons", columns: []string{"title"}},
+}
+
+// createSearchIndex creates and fills the full-text indexes. FTS5 is only
+// compiled into go-sqlite3 with the sqlite_fts5 build tag, other builds
+// use FTS4; both are queried the same way.
+func createSearchIndex(ctx context.Context, tx *sql.Tx) error {
+	var fts5 bool
+	if err := tx.QueryRowContext(ctx, "SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		return err
+	}
+	for _, index := range searchIndexes {
+		name := index.table + "_search"
+		columns := strings.Join(index.columns, ", ")
+		// Diacritics are kept, й and ї are letters of their own.
+		module := fmt.Sprintf(`fts4(id, %s, notindexed=id, tokenize=unicode61 "remove_diacritics=0")`, columns)
+		if fts5 {
+			module = fmt.Sprintf(`fts5(id UNINDEXED, %s, tokenize="unicode61 remove_diacritics 0")`, columns)
+		}
+		var set []string
+		for _, column := range index.columns {
+			set = append(set, column+" = new."+column)
+		}
+		statements := []string{
+			fmt.Sprintf("CREATE VIRTUAL TABLE %s USING %s", name, module),
+			fmt.Sprintf("INSERT INTO %s (id, %s) SELECT id, %s FROM %s", name, columns, columns, index.table),
+			fmt.Sprintf(`CREATE TRIGGER %[1]s_insert AFTER INSERT ON %[2]s BEGIN
+    INSERT INTO %[1]s (id, %[3]s) VALUES (new.id, new.%[4]s);
+END`, name, index.table, columns, strings.Join(index.columns, ", new.")),
+			fmt.Sprintf(`CREATE TRIGGER %[1]s_update AFTER UPDATE OF %[3]s ON %[2]s BEGIN
+    UPDATE %[1]s SET %[4]s WHERE id = old.id;
+END`, name, index.table, columns, strings.Join(set, ", ")),
+			fmt.Sprintf(`CREATE TRIGGER %[1]s_delete AFTER DELETE ON %[2]s BEGIN
+    DELETE FROM %[1]s WHERE id = old.id;
+END`, name, index.table),
+		}
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func dropSearchIndex(ctx context.Context, tx *sql.Tx) error {
+	for _, index := range searchIndexes {
+		name := index.table + "_search"
+		for _, statement := range []string{
+			"DROP TRIGGER IF EXISTS " + name + "_insert",
+			"DROP TRIGGER IF EXISTS " + name + "_update",
+			"DROP TRIGGER IF EXISTS " + name + "_delete",
+			"DROP TABLE IF EXISTS " + name,
+		} {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SearchCourses returns courses containing the query terms, best matches first.
+func (d *Database) SearchCourses(ctx context.Context, query string, limit int) ([]models.Course, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return []models.Course{}, nil
+	}
+	where, args := d.searchFilter(terms, "courses", "title", "description")
+	rows, err := d.conn.QueryContext(ctx,
+		d.rebind("SELECT "+courseColumns+" FROM courses WHERE "+availableFilter+" AND "+where), args...)
+	if err != nil {
+		return []models.Course{}, err
+	}
+	courses, err := d.scanCourses(ctx, rows)
+	if err != nil {
+		return []models.Course{}, err
+	}
+
+	scores := make(map[string]int, len(courses))
+	result := []models.Course{}
+	for _, course := range courses {
+		score := searchScore(terms, course.Title, course.Description)
+		if score > 0 {
+			scores[course.ID] = score
+			result = append(result, course)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if scores[result[i].ID] != scores[result[j].ID] {
+			return scores[result[i].ID] > scores[result[j].ID]
+		}
+		return result[i].Title < result[j].Title
+	})
+	if limit <= 0 {
+		limit = db.DefaultLimit
+	}
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// SearchLessons returns lessons containing the query terms, best matches first.
+func (d *Database) SearchLessons(ctx context.Context, query string, limit int) ([]models.Lesson, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return []models.Lesson{}, nil
+	}
+	where, args := d.searchFilter(terms, "lessons", "title")
+	rows, err := d.conn.QueryContext(ctx,
+		d.rebind("SELECT "+lessonColumns+" FROM lessons WHERE "+availableFilter+" AND "+where), args...)
+	if err != nil {
+		return []models.Lesson{}, err
+	}
+	defer rows.Close()
+
+	scores := make(map[string]int)
+	result := []models.Lesson{}
+	for rows.Next() {
+		lesson, err := scanLesson(rows)
+		if err != nil {
+			return []models.Lesson{}, err
+		}
+		score := searchScore(terms, lesson.Title, "")
+		if score > 0 {
+			scores[lesson.ID] = score
+			result = append(result, lesson)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return []models.Lesson{}, err
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if scores[result[i].ID] != scores[result[j].ID] {
+			return scores[result[i].ID] > scores[result[j].ID]
+		}
+		return result[i].Title < result[j].Title
+	})
+	if limit <= 0 {
+		limit = db.DefaultLimit
+	}
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// searchFilter returns the condition matching rows of the table that
+// contain a term.
+func (d *Database) searchFilter(terms []string, table string, columns ...string) (string, []interface{}) {
+	if d.driver != DriverPostgres {
+		// Terms are letters and digits only, so they need no quoting.
+		return "id IN (SELECT id FROM " + table + "_search WHERE " + table + "_search MATCH ?)",
+			[]interface{}{strings.Join(terms, "* OR ") + "*"}
+	}
+	var conditions []string
+	var args []interface{}
+	for _, term := range terms {
+		for _, column := range columns {
+			conditions = append(conditions, "LOWER("+column+`) LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+likeEscaper.Replace(term)+"%")
+		}
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
+
+func searchTerms(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func searchScore(terms []string, title, description string) int {
+	title, description = strings.ToLower(title), strings.ToLower(description)
+	score := 0
+	for _, term := range terms {
+		if strings.Contains(title, term) {
+			score += 2
+		}
+		if strings.Contains(description, term) {
+			score++
+		}
+	}
+	return score
+}
@@ -0,0 +1,77 @@
+package sql
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/DanilLagunov/diploma/pkg/models"
+)
+
+func TestSearchIndex(t *testing.T) {
+	ctx := context.Background()
+	d := newSQLite(t)
+	migrator, err := d.Migrator(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	searchIndexVersion := 0
+	for _, file := range files {
+		if _, ok := sqliteMigrations[file.name]; ok {
+			searchIndexVersion = file.version
+		}
+	}
+	if searchIndexVersion == 0 {
+		t.Fatal("no migration file for the search index")
+	}
+	// Rows written before the index is created are indexed by the migration.
+	if err := migrator.Up(ctx, searchIndexVersion-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveLesson(ctx, models.Lesson{ID: "l1", Title: "Звичайні дроби"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	course, err := d.CreateCourse(ctx, "Алгебра", "Дроби та рівняння", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lessons, err := d.SearchLessons(ctx, "ДРОБ", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lessons) != 1 || lessons[0].ID != "l1" {
+		t.Errorf("SearchLessons = %+v", lessons)
+	}
+	courses, err := d.SearchCourses(ctx, "рівняння", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(courses) != 1 || courses[0].ID != course.ID {
+		t.Errorf("SearchCourses = %+v", courses)
+	}
+
+	if err := d.UpdateCourse(ctx, course.ID, course.Version, "Геометрія", "Фігури"); err != nil {
+		t.Fatal(err)
+	}
+	if courses, _ := d.SearchCourses(ctx, "алгебра", 10); len(courses) != 0 {
+		t.Errorf("renamed course found by its old title: %+v", courses)
+	}
+	if courses, _ := d.SearchCourses(ctx, "геометрія", 10); len(courses) != 1 {
+		t.Errorf("renamed course not found by its new title: %+v", courses)
+	}
+
+	if err := migrator.Down(ctx, searchIndexVersion-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SaveLesson(ctx, models.Lesson{ID: "l2", Title: "Дроби"}); err != nil {
+		t.Fatal(err)
+	}
+}
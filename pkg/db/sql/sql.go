@@ -0,0 +1,822 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/models"
+	"github.com/DanilLagunov/diploma/pkg/utils"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Supported drivers.
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite3"
+)
+
+const (
+	courseColumns = "id, title, description, version, archived_at, deleted_at"
+	lessonColumns = "id, title, lection, task, estimated_time, version, archived_at, deleted_at"
+	// availableFilter matches courses and lessons that are neither archived nor deleted.
+	availableFilter = "archived_at IS NULL AND deleted_at IS NULL"
+	// lessonIDsBatch is the number of courses whose lesson IDs are loaded
+	// in one query, well below the bound parameter limits.
+	lessonIDsBatch = 500
+)
+
+// Database struct.
+type Database struct {
+	db     *sql.DB
+	driver string
+	// conn is db, or tx inside WithTransaction.
+	conn querier
+	tx   *sql.Tx
+}
+
+// querier is the part of *sql.DB and *sql.Tx used by the queries.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// New opening a new Database object. Migrations are applied with the
+// Migrator.
+func New(driver, dsn string) (*Database, error) {
+	switch driver {
+	case DriverPostgres:
+	case DriverSQLite:
+		if !strings.Contains(dsn, "_foreign_keys") {
+			if strings.Contains(dsn, "?") {
+				dsn += "&_foreign_keys=on"
+			} else {
+				dsn += "?_foreign_keys=on"
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported sql driver: %q", driver)
+	}
+
+	conn, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == DriverSQLite {
+		conn.SetMaxOpenConns(1)
+	}
+
+	d := &Database{
+		db:     conn,
+		driver: driver,
+		conn:   conn,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := conn.PingContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Close closing the underlying connection pool.
+func (d *Database) Close() error {
+	return d.db.Close()
+}
+
+// rebind converts ? placeholders to the driver's bind syntax.
+func (d *Database) rebind(query string) string {
+	if d.driver != DriverPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// WithTransaction runs fn in a transaction, nested calls join the outer one.
+func (d *Database) WithTransaction(ctx context.Context, fn func(ctx context.Context, tx db.Database) error) error {
+	if d.tx != nil {
+		return fn(ctx, d)
+	}
+	return d.withTx(ctx, func(tx *sql.Tx) error {
+		return fn(ctx, &Database{db: d.db, driver: d.driver, conn: tx, tx: tx})
+	})
+}
+
+// withTx runs fn in the current transaction or in a new one.
+func (d *Database) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if d.tx != nil {
+		return fn(d.tx)
+	}
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCourse(row scanner) (models.Course, error) {
+	var course models.Course
+	var archivedAt, deletedAt sql.NullTime
+	err := row.Scan(&course.ID, &course.Title, &course.Description, &course.Version, &archivedAt, &deletedAt)
+	course.ArchivedAt, course.DeletedAt = timePtr(archivedAt), timePtr(deletedAt)
+	return course, err
+}
+
+func scanLesson(row scanner) (models.Lesson, error) {
+	var lesson models.Lesson
+	var archivedAt, deletedAt sql.NullTime
+	err := row.Scan(&lesson.ID, &lesson.Title, &lesson.Lection, &lesson.Task, &lesson.EstimatedTime, &lesson.Version, &archivedAt, &deletedAt)
+	lesson.ArchivedAt, lesson.DeletedAt = timePtr(archivedAt), timePtr(deletedAt)
+	return lesson, err
+}
+
+func timePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// affected maps an update that touched no rows to db.ErrNotFound.
+func affected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return db.ErrNotFound
+	}
+	return nil
+}
+
+func courseExists(ctx context.Context, tx *sql.Tx, rebind func(string) string, id string) error {
+	var exists int
+	err := tx.QueryRowContext(ctx, rebind("SELECT 1 FROM courses WHERE id = ?"), id).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return db.ErrNotFound
+	}
+	return err
+}
+
+// versioned maps a conditional update of table that touched no rows to
+// db.ErrNotFound or db.ErrConflict.
+func (d *Database) versioned(ctx context.Context, table, id string, res sql.Result, err error) error {
+	if err := affected(res, err); !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+	var exists int
+	err = d.conn.QueryRowContext(ctx, d.rebind("SELECT 1 FROM "+table+" WHERE id = ?"), id).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return db.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return db.ErrConflict
+}
+
+// bumpCourse increments the course version after a lesson list change.
+func (d *Database) bumpCourse(ctx context.Context, tx *sql.Tx, id string) error {
+	_, err := tx.ExecContext(ctx, d.rebind("UPDATE courses SET version = version + 1 WHERE id = ?"), id)
+	return err
+}
+
+// USER DB HANDLERS
+
+func (d *Database) CreateUser(ctx context.Context, email, password string) error {
+	id := primitive.NewObjectID().Hex()
+	hashedPassword, _ := utils.HashPassword(password)
+	_, err := d.conn.ExecContext(ctx,
+		d.rebind("INSERT INTO users (id, email, password) VALUES (?, ?, ?)"),
+		id, email, hashedPassword)
+	return err
+}
+
+func (d *Database) GetUser(ctx context.Context, email string) (models.User, error) {
+	return d.getUser(ctx, "email", email)
+}
+
+func (d *Database) GetUserByChatID(ctx context.Context, chatID int64) (models.User, error) {
+	return d.getUser(ctx, "chat_id", chatID)
+}
+
+func (d *Database) UpdateUser(ctx context.Context, email string, chatID int64) error {
+	// A chat is bound to one user at a time, chat_id is unique.
+	return d.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx,
+			d.rebind("UPDATE users SET chat_id = NULL WHERE chat_id = ? AND email <> ?"),
+			chatID, email)
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx,
+			d.rebind("UPDATE users SET chat_id = ? WHERE email = ?"),
+			chatID, email)
+		return affected(res, err)
+	})
+}
+
+func (d *Database) GetUserCourses(ctx context.Context, chatId int64) ([]models.Course, error) {
+	user, err := d.getUser(ctx, "chat_id", chatId)
+	if err != nil {
+		return []models.Course{}, err
+	}
+	return d.userCourses(ctx, user.ID)
+}
+
+// EnrollUser enrolls the user into the course. The enrollments primary key
+// makes concurrent calls for the same pair create a single enrollment.
+// A dropped enrollment is reactivated.
+func (d *Database) EnrollUser(ctx context.Context, chatId int64, courseID string) (db.EnrollResult, error) {
+	user, err := d.getUser(ctx, "chat_id", chatId)
+	if err != nil {
+		return db.EnrollUnknown, err
+	}
+	course, err := d.GetCourse(ctx, courseID)
+	if err != nil {
+		return db.EnrollUnknown, err
+	}
+	if course.ArchivedAt != nil || course.DeletedAt != nil {
+		return db.EnrollUnknown, db.ErrArchived
+	}
+	now := time.Now().UTC()
+
+	res, err := d.conn.ExecContext(ctx,
+		d.rebind("UPDATE enrollments SET status = ?, enrolled_at = ? WHERE user_id = ? AND course_id = ? AND status = ?"),
+		models.EnrollmentActive, now, user.ID, courseID, models.EnrollmentDropped)
+	if err := affected(res, err); err == nil {
+		return db.Enrolled, nil
+	} else if !errors.Is(err, db.ErrNotFound) {
+		return db.EnrollUnknown, err
+	}
+
+	res, err = d.conn.ExecContext(ctx,
+		d.rebind("INSERT INTO enrollments (user_id, course_id, enrolled_at, status) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING"),
+		user.ID, courseID, now, models.EnrollmentActive)
+	if err := affected(res, err); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return db.AlreadyEnrolled, nil
+		}
+		return db.EnrollUnknown, err
+	}
+	return db.Enrolled, nil
+}
+
+func (d *Database) getUser(ctx context.Context, column string, value interface{}) (models.User, error) {
+	var user models.User
+	var chatID sql.NullInt64
+	err := d.conn.QueryRowContext(ctx,
+		d.rebind("SELECT id, chat_id, email, password FROM users WHERE "+column+" = ?"),
+		value).Scan(&user.ID, &chatID, &user.Email, &user.Password)
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, db.ErrNotFound
+	}
+	user.ChatID = chatID.Int64
+	return user, err
+}
+
+func (d *Database) userCourses(ctx context.Context, userID string) ([]models.Course, error) {
+	rows, err := d.conn.QueryContext(ctx, d.rebind(`SELECT c.id, c.title, c.description, c.version, c.archived_at, c.deleted_at
+FROM enrollments e JOIN courses c ON c.id = e.course_id
+WHERE e.user_id = ? AND e.status <> ? AND c.deleted_at IS NULL
+ORDER BY e.enrolled_at`), userID, models.EnrollmentDropped)
+	if err != nil {
+		return []models.Course{}, err
+	}
+	return d.scanCourses(ctx, rows)
+}
+
+// COURSES DB HANDLERS
+
+func (d *Database) GetCourse(ctx context.Context, id string) (models.Course, error) {
+	course, err := scanCourse(d.conn.QueryRowContext(ctx,
+		d.rebind("SELECT "+courseColumns+" FROM courses WHERE id = ?"), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return course, db.ErrNotFound
+	}
+	if err != nil {
+		return course, err
+	}
+	course.LessonIDs, err = d.courseLessonIDs(ctx, id)
+	return course, err
+}
+
+func (d *Database) GetAvailableCourse(ctx context.Context, chatId int64, id string) (models.Course, error) {
+	course, err := scanCourse(d.conn.QueryRowContext(ctx, d.rebind(`SELECT `+courseColumns+` FROM courses c
+WHERE c.id = ? AND c.deleted_at IS NULL AND (c.archived_at IS NULL OR EXISTS (
+    SELECT 1 FROM enrollments e JOIN users u ON u.id = e.user_id
+    WHERE e.course_id = c.id AND u.chat_id = ? AND e.status <> ?))`), id, chatId, models.EnrollmentDropped))
+	if errors.Is(err, sql.ErrNoRows) {
+		return course, db.ErrNotFound
+	}
+	if err != nil {
+		return course, err
+	}
+	course.LessonIDs, err = d.courseLessonIDs(ctx, id)
+	return course, err
+}
+
+func (d *Database) GetCourses(ctx context.Context) ([]models.Course, error) {
+	rows, err := d.conn.QueryContext(ctx, "SELECT "+courseColumns+" FROM courses WHERE "+availableFilter+" ORDER BY id")
+	if err != nil {
+		return []models.Course{}, err
+	}
+	return d.scanCourses(ctx, rows)
+}
+
+func (d *Database) ListCourses(ctx context.Context, query db.CourseQuery) (db.CoursePage, error) {
+	if query.Limit <= 0 {
+		query.Limit = db.DefaultLimit
+	}
+	column := "id"
+	if query.Sort == db.SortByTitle {
+		column = "title"
+	}
+
+	where := []string{availableFilter}
+	args := []interface{}{}
+	if query.Title != "" {
+		where = append(where, `LOWER(title) LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(strings.ToLower(query.Title))+"%")
+	}
+
+	var before bool
+	if query.Cursor != "" {
+		id, b, err := db.ParseCursor(query.Cursor)
+		if err != nil {
+			return db.CoursePage{}, err
+		}
+		before = b
+		boundary, err := d.GetCourse(ctx, id)
+		if err != nil {
+			return db.CoursePage{}, err
+		}
+		op := ">"
+		if query.Desc != before {
+			op = "<"
+		}
+		if column == "title" {
+			where = append(where, "(title "+op+" ? OR (title = ? AND id "+op+" ?))")
+			args = append(args, boundary.Title, boundary.Title, id)
+		} else {
+			where = append(where, "id "+op+" ?")
+			args = append(args, id)
+		}
+	}
+
+	// Pages before the cursor are fetched in reverse and flipped back.
+	dir := "ASC"
+	if query.Desc != before {
+		dir = "DESC"
+	}
+	order := column + " " + dir
+	if column != "id" {
+		order += ", id " + dir
+	}
+	args = append(args, query.Limit+1)
+
+	rows, err := d.conn.QueryContext(ctx, d.rebind(
+		"SELECT "+courseColumns+" FROM courses WHERE "+strings.Join(where, " AND ")+
+			" ORDER BY "+order+" LIMIT ?"), args...)
+	if err != nil {
+		return db.CoursePage{}, err
+	}
+	courses, err := d.scanCourses(ctx, rows)
+	if err != nil {
+		return db.CoursePage{}, err
+	}
+	if before {
+		for i, j := 0, len(courses)-1; i < j; i, j = i+1, j-1 {
+			courses[i], courses[j] = courses[j], courses[i]
+		}
+	}
+
+	return db.NewCoursePage(courses, query.Limit, query.Cursor, before), nil
+}
+
+// likeEscaper escapes LIKE wildcards in user input.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (d *Database) CreateCourse(ctx context.Context, title, description string, lessons []models.Lesson) (models.Course, error) {
+	id := primitive.NewObjectID().Hex()
+	course := models.Course{
+		ID:          id,
+		Title:       title,
+		Description: description,
+		LessonIDs:   make([]string, 0, len(lessons)),
+	}
+	for _, lesson := range lessons {
+		course.LessonIDs = append(course.LessonIDs, lesson.ID)
+	}
+	err := d.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx,
+			d.rebind("INSERT INTO courses (id, title, description) VALUES (?, ?, ?)"),
+			id, title, description)
+		if err != nil {
+			return err
+		}
+		for i, lesson := range lessons {
+			_, err := tx.ExecContext(ctx,
+				d.rebind("INSERT INTO course_lessons (course_id, lesson_id, position) VALUES (?, ?, ?)"),
+				id, lesson.ID, i)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return course, err
+}
+
+func (d *Database) SaveCourse(ctx context.Context, course models.Course) error {
+	return d.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, d.rebind(`INSERT INTO courses (id, title, description, version) VALUES (?, ?, ?, 1)
+ON CONFLICT (id) DO UPDATE SET title = excluded.title, description = excluded.description, version = courses.version + 1`),
+			course.ID, course.Title, course.Description)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, d.rebind("DELETE FROM course_lessons WHERE course_id = ?"), course.ID)
+		if err != nil {
+			return err
+		}
+		seen := make(map[string]bool, len(course.LessonIDs))
+		for i, lessonID := range course.LessonIDs {
+			if seen[lessonID] {
+				return db.ErrInvalidOrder
+			}
+			seen[lessonID] = true
+			var exists int
+			err := tx.QueryRowContext(ctx, d.rebind("SELECT 1 FROM lessons WHERE id = ?"), lessonID).Scan(&exists)
+			if errors.Is(err, sql.ErrNoRows) {
+				return db.ErrNotFound
+			}
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx,
+				d.rebind("INSERT INTO course_lessons (course_id, lesson_id, position) VALUES (?, ?, ?)"),
+				course.ID, lessonID, i)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Database) UpdateCourse(ctx context.Context, id string, version int, title, description string) error {
+	res, err := d.conn.ExecContext(ctx,
+		d.rebind("UPDATE courses SET title = ?, description = ?, version = version + 1 WHERE id = ? AND version = ?"),
+		title, description, id, version)
+	return d.versioned(ctx, "courses", id, res, err)
+}
+
+// DeleteCourse marks the course as deleted. Enrollments are kept,
+// so RestoreCourse brings the course back for enrolled users.
+func (d *Database) DeleteCourse(ctx context.Context, id string) error {
+	return d.mark(ctx, "courses", "deleted_at", id)
+}
+
+func (d *Database) ArchiveCourse(ctx context.Context, id string) error {
+	return d.mark(ctx, "courses", "archived_at", id)
+}
+
+func (d *Database) RestoreCourse(ctx context.Context, id string) error {
+	return d.restore(ctx, "courses", id)
+}
+
+func (d *Database) GetCourseLessons(ctx context.Context, id string) ([]models.Lesson, error) {
+	var exists int
+	err := d.conn.QueryRowContext(ctx, d.rebind("SELECT 1 FROM courses WHERE id = ?"), id).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return []models.Lesson{}, db.ErrNotFound
+	}
+	if err != nil {
+		return []models.Lesson{}, err
+	}
+	return d.courseLessons(ctx, id)
+}
+
+func (d *Database) AddCourseLesson(ctx context.Context, courseID, lessonID string) error {
+	lesson, err := d.GetLesson(ctx, lessonID)
+	if err != nil {
+		return err
+	}
+	if lesson.ArchivedAt != nil || lesson.DeletedAt != nil {
+		return db.ErrArchived
+	}
+	return d.withTx(ctx, func(tx *sql.Tx) error {
+		if err := courseExists(ctx, tx, d.rebind, courseID); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, d.rebind(`INSERT INTO course_lessons (course_id, lesson_id, position)
+SELECT CAST(? AS TEXT), CAST(? AS TEXT), COALESCE(MAX(position) + 1, 0) FROM course_lessons WHERE course_id = ?
+ON CONFLICT DO NOTHING`), courseID, lessonID, courseID)
+		if err := affected(res, err); err != nil {
+			if errors.Is(err, db.ErrNotFound) {
+				return nil
+			}
+			return err
+		}
+		return d.bumpCourse(ctx, tx, courseID)
+	})
+}
+
+func (d *Database) RemoveCourseLesson(ctx context.Context, courseID, lessonID string) error {
+	return d.withTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx,
+			d.rebind("DELETE FROM course_lessons WHERE course_id = ? AND lesson_id = ?"),
+			courseID, lessonID)
+		if err := affected(res, err); err != nil {
+			return err
+		}
+		return d.bumpCourse(ctx, tx, courseID)
+	})
+}
+
+func (d *Database) ReorderCourseLessons(ctx context.Context, courseID string, lessonIDs []string) error {
+	return d.withTx(ctx, func(tx *sql.Tx) error {
+		if err := courseExists(ctx, tx, d.rebind, courseID); err != nil {
+			return err
+		}
+		var count int
+		err := tx.QueryRowContext(ctx,
+			d.rebind("SELECT COUNT(*) FROM course_lessons WHERE course_id = ?"),
+			courseID).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count != len(lessonIDs) {
+			return db.ErrInvalidOrder
+		}
+		seen := make(map[string]bool, len(lessonIDs))
+		for i, id := range lessonIDs {
+			if seen[id] {
+				return db.ErrInvalidOrder
+			}
+			seen[id] = true
+			res, err := tx.ExecContext(ctx,
+				d.rebind("UPDATE course_lessons SET position = ? WHERE course_id = ? AND lesson_id = ?"),
+				i, courseID, id)
+			if err := affected(res, err); err != nil {
+				if errors.Is(err, db.ErrNotFound) {
+					return db.ErrInvalidOrder
+				}
+				return err
+			}
+		}
+		return d.bumpCourse(ctx, tx, courseID)
+	})
+}
+
+// scanCourses reads course rows and loads the lesson IDs of every course.
+func (d *Database) scanCourses(ctx context.Context, rows *sql.Rows) ([]models.Course, error) {
+	result := []models.Course{}
+	for rows.Next() {
+		course, err := scanCourse(rows)
+		if err != nil {
+			rows.Close()
+			return result, err
+		}
+		result = append(result, course)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	for start := 0; start < len(result); start += lessonIDsBatch {
+		batch := result[start:]
+		if len(batch) > lessonIDsBatch {
+			batch = batch[:lessonIDsBatch]
+		}
+		ids := make([]interface{}, len(batch))
+		for i, course := range batch {
+			ids[i] = course.ID
+		}
+		byCourse, err := d.coursesLessonIDs(ctx, ids)
+		if err != nil {
+			return result, err
+		}
+		for i := range batch {
+			batch[i].LessonIDs = byCourse[batch[i].ID]
+			if batch[i].LessonIDs == nil {
+				batch[i].LessonIDs = []string{}
+			}
+		}
+	}
+	return result, nil
+}
+
+// coursesLessonIDs returns the lesson IDs of the courses in one query.
+func (d *Database) coursesLessonIDs(ctx context.Context, courseIDs []interface{}) (map[string][]string, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(courseIDs)), ", ")
+	rows, err := d.conn.QueryContext(ctx, d.rebind(
+		"SELECT course_id, lesson_id FROM course_lessons WHERE course_id IN ("+placeholders+") ORDER BY course_id, position"),
+		courseIDs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string][]string, len(courseIDs))
+	for rows.Next() {
+		var courseID, lessonID string
+		if err := rows.Scan(&courseID, &lessonID); err != nil {
+			return nil, err
+		}
+		result[courseID] = append(result[courseID], lessonID)
+	}
+	return result, rows.Err()
+}
+
+func (d *Database) courseLessonIDs(ctx context.Context, courseID string) ([]string, error) {
+	rows, err := d.conn.QueryContext(ctx,
+		d.rebind("SELECT lesson_id FROM course_lessons WHERE course_id = ? ORDER BY position"),
+		courseID)
+	if err != nil {
+		return []string{}, err
+	}
+	defer rows.Close()
+
+	result := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return result, err
+		}
+		result = append(result, id)
+	}
+	return result, rows.Err()
+}
+
+func (d *Database) courseLessons(ctx context.Context, courseID string) ([]models.Lesson, error) {
+	rows, err := d.conn.QueryContext(ctx, d.rebind(`SELECT l.id, l.title, l.lection, l.task, l.estimated_time, l.version, l.archived_at, l.deleted_at
+FROM course_lessons cl JOIN lessons l ON l.id = cl.lesson_id
+WHERE cl.course_id = ? AND l.deleted_at IS NULL
+ORDER BY cl.position`), courseID)
+	if err != nil {
+		return []models.Lesson{}, err
+	}
+	defer rows.Close()
+
+	result := []models.Lesson{}
+	for rows.Next() {
+		lesson, err := scanLesson(rows)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, lesson)
+	}
+	return result, rows.Err()
+}
+
+// LESSONS DB HANDLERS
+
+func (d *Database) CreateLesson(ctx context.Context, title, lection, task string, estimated int) (models.Lesson, error) {
+	id := primitive.NewObjectID().Hex()
+	lesson := models.Lesson{
+		ID:            id,
+		Title:         title,
+		Lection:       lection,
+		Task:          task,
+		EstimatedTime: estimated,
+	}
+	_, err := d.conn.ExecContext(ctx,
+		d.rebind("INSERT INTO lessons (id, title, lection, task, estimated_time) VALUES (?, ?, ?, ?, ?)"),
+		lesson.ID, lesson.Title, lesson.Lection, lesson.Task, lesson.EstimatedTime)
+	return lesson, err
+}
+
+func (d *Database) GetLesson(ctx context.Context, id string) (models.Lesson, error) {
+	lesson, err := scanLesson(d.conn.QueryRowContext(ctx,
+		d.rebind("SELECT "+lessonColumns+" FROM lessons WHERE id = ?"), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return lesson, db.ErrNotFound
+	}
+	return lesson, err
+}
+
+func (d *Database) SaveLesson(ctx context.Context, lesson models.Lesson) error {
+	_, err := d.conn.ExecContext(ctx, d.rebind(`INSERT INTO lessons (id, title, lection, task, estimated_time, version) VALUES (?, ?, ?, ?, ?, 1)
+ON CONFLICT (id) DO UPDATE SET title = excluded.title, lection = excluded.lection, task = excluded.task, estimated_time = excluded.estimated_time,
+version = lessons.version + 1`),
+		lesson.ID, lesson.Title, lesson.Lection, lesson.Task, lesson.EstimatedTime)
+	return err
+}
+
+func (d *Database) UpdateLesson(ctx context.Context, id string, version int, title, lection, task string, estimated int) error {
+	res, err := d.conn.ExecContext(ctx,
+		d.rebind("UPDATE lessons SET title = ?, lection = ?, task = ?, estimated_time = ?, version = version + 1 WHERE id = ? AND version = ?"),
+		title, lection, task, estimated, id, version)
+	return d.versioned(ctx, "lessons", id, res, err)
+}
+
+// DeleteLesson marks the lesson as deleted. Course references are kept,
+// deleted lessons are skipped by GetCourseLessons until restored.
+func (d *Database) DeleteLesson(ctx context.Context, id string) error {
+	return d.mark(ctx, "lessons", "deleted_at", id)
+}
+
+func (d *Database) ArchiveLesson(ctx context.Context, id string) error {
+	return d.mark(ctx, "lessons", "archived_at", id)
+}
+
+func (d *Database) RestoreLesson(ctx context.Context, id string) error {
+	return d.restore(ctx, "lessons", id)
+}
+
+// mark sets a state timestamp, keeping the earlier one when already set.
+func (d *Database) mark(ctx context.Context, table, column, id string) error {
+	res, err := d.conn.ExecContext(ctx,
+		d.rebind("UPDATE "+table+" SET "+column+" = COALESCE("+column+", ?), version = version + 1 WHERE id = ?"),
+		time.Now().UTC(), id)
+	return affected(res, err)
+}
+
+func (d *Database) restore(ctx context.Context, table, id string) error {
+	res, err := d.conn.ExecContext(ctx,
+		d.rebind("UPDATE "+table+" SET archived_at = NULL, deleted_at = NULL, version = version + 1 WHERE id = ?"), id)
+	return affected(res, err)
+}
+
+// ENROLLMENTS DB HANDLERS
+
+func (d *Database) GetEnrollment(ctx context.Context, userID, courseID string) (models.Enrollment, error) {
+	var enrollment models.Enrollment
+	err := d.conn.QueryRowContext(ctx,
+		d.rebind("SELECT user_id, course_id, enrolled_at, status FROM enrollments WHERE user_id = ? AND course_id = ?"),
+		userID, courseID).Scan(&enrollment.UserID, &enrollment.CourseID, &enrollment.EnrolledAt, &enrollment.Status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return enrollment, db.ErrNotFound
+	}
+	return enrollment, err
+}
+
+func (d *Database) GetUserEnrollments(ctx context.Context, userID string) ([]models.Enrollment, error) {
+	return d.findEnrollments(ctx, "user_id", userID)
+}
+
+func (d *Database) GetCourseEnrollments(ctx context.Context, courseID string) ([]models.Enrollment, error) {
+	return d.findEnrollments(ctx, "course_id", courseID)
+}
+
+func (d *Database) UpdateEnrollmentStatus(ctx context.Context, userID, courseID string, status models.EnrollmentStatus) error {
+	res, err := d.conn.ExecContext(ctx,
+		d.rebind("UPDATE enrollments SET status = ? WHERE user_id = ? AND course_id = ?"),
+		status, userID, courseID)
+	return affected(res, err)
+}
+
+func (d *Database) findEnrollments(ctx context.Context, column, value string) ([]models.Enrollment, error) {
+	rows, err := d.conn.QueryContext(ctx,
+		d.rebind("SELECT user_id, course_id, enrolled_at, status FROM enrollments WHERE "+column+" = ? ORDER BY enrolled_at"),
+		value)
+	if err != nil {
+		return []models.Enrollment{}, err
+	}
+	defer rows.Close()
+
+	result := []models.Enrollment{}
+	for rows.Next() {
+		var enrollment models.Enrollment
+		if err := rows.Scan(&enrollment.UserID, &enrollment.CourseID, &enrollment.EnrolledAt, &enrollment.Status); err != nil {
+			return result, err
+		}
+		result = append(result, enrollment)
+	}
+	return result, rows.Err()
+}
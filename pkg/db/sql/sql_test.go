@@ -0,0 +1,34 @@
+package sql
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/db/dbtest"
+)
+
+func newSQLite(t *testing.T) *Database {
+	d, err := New(DriverSQLite, "file:"+filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestSQLite(t *testing.T) {
+	dbtest.Run(t, func(t *testing.T) db.Database {
+		d := newSQLite(t)
+		migrator, err := d.Migrator(io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := migrator.Up(context.Background(), 0); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
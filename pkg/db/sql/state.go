@@ -0,0 +1,58 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/models"
+)
+
+// GetChatState returns the dialog state of the chat, expired or not.
+func (d *Database) GetChatState(ctx context.Context, chatID int64) (models.ChatState, error) {
+	state := models.ChatState{ChatID: chatID}
+	var data string
+	err := d.conn.QueryRowContext(ctx,
+		d.rebind("SELECT state, data, expires_at, updated_at FROM chat_states WHERE chat_id = ?"), chatID).
+		Scan(&state.State, &data, &state.ExpiresAt, &state.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return state, db.ErrNotFound
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal([]byte(data), &state.Data)
+	return state, err
+}
+
+// SaveChatState creates or replaces the dialog state of the chat. There is
+// no TTL index as in Mongo, so states expired a day ago are removed on the way.
+func (d *Database) SaveChatState(ctx context.Context, state models.ChatState) error {
+	data, err := json.Marshal(state.Data)
+	if err != nil {
+		return err
+	}
+	if state.UpdatedAt.IsZero() {
+		state.UpdatedAt = time.Now()
+	}
+	_, err = d.conn.ExecContext(ctx, d.rebind("DELETE FROM chat_states WHERE expires_at < ?"),
+		time.Now().Add(-24*time.Hour).UTC())
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.ExecContext(ctx, d.rebind(`INSERT INTO chat_states (chat_id, state, data, expires_at, updated_at)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (chat_id) DO UPDATE SET state = excluded.state, data = excluded.data,
+    expires_at = excluded.expires_at, updated_at = excluded.updated_at`),
+		state.ChatID, state.State, string(data), state.ExpiresAt.UTC(), state.UpdatedAt.UTC())
+	return err
+}
+
+// DeleteChatState removes the dialog state of the chat.
+func (d *Database) DeleteChatState(ctx context.Context, chatID int64) error {
+	_, err := d.conn.ExecContext(ctx, d.rebind("DELETE FROM chat_states WHERE chat_id = ?"), chatID)
+	return err
+}
@@ -0,0 +1,27 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+)
+
+// BindTenant marks the database as the database of the tenant on its
+// first call. The tenant table holds a single row, a bound database keeps
+// its tenant.
+func (d *Database) BindTenant(ctx context.Context, tenantID string) error {
+	_, err := d.conn.ExecContext(ctx,
+		d.rebind("INSERT INTO tenant (id, tenant_id) VALUES (1, ?) ON CONFLICT (id) DO NOTHING"), tenantID)
+	if err != nil {
+		return err
+	}
+	var bound string
+	if err := d.conn.QueryRowContext(ctx, "SELECT tenant_id FROM tenant WHERE id = 1").Scan(&bound); err != nil {
+		return err
+	}
+	if bound != tenantID {
+		return fmt.Errorf("%w: %s", db.ErrTenantMismatch, bound)
+	}
+	return nil
+}
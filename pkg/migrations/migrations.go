@@ -0,0 +1,236 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+var (
+	ErrLocked       = errors.New("migrations are locked by another instance")
+	ErrIrreversible = errors.New("migration can not be rolled back")
+)
+
+// Migration is one versioned schema or data change.
+// Up and Down must be idempotent, a failed run may be repeated.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context) error
+	Down    func(ctx context.Context) error
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// Record is a migration stored as applied.
+type Record struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+// Store keeps applied migrations and the migration lock.
+type Store interface {
+	Applied(ctx context.Context) ([]Record, error)
+	Save(ctx context.Context, record Record) error
+	Delete(ctx context.Context, version int) error
+	// Lock returns ErrLocked when another owner holds an unexpired lock.
+	Lock(ctx context.Context, owner string, ttl time.Duration) error
+	Unlock(ctx context.Context, owner string) error
+}
+
+// Status of a registered migration.
+type Status struct {
+	Migration Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies registered migrations in version order.
+type Migrator struct {
+	store      Store
+	migrations []Migration
+	out        io.Writer
+	owner      string
+
+	// DryRun prints the plan without running or recording migrations.
+	DryRun bool
+	// LockTTL bounds how long a crashed instance blocks others. The lock
+	// is renewed every third of it while migrations run.
+	LockTTL time.Duration
+}
+
+// New creating a Migrator. Progress is written to out.
+func New(store Store, out io.Writer, migrations ...Migration) (*Migrator, error) {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	for i, m := range sorted {
+		if m.Version <= 0 || m.Up == nil {
+			return nil, fmt.Errorf("invalid migration %s", m)
+		}
+		if i > 0 && sorted[i-1].Version == m.Version {
+			return nil, fmt.Errorf("duplicate migration version %d", m.Version)
+		}
+	}
+
+	return &Migrator{
+		store:      store,
+		migrations: sorted,
+		out:        out,
+		owner:      owner(),
+		LockTTL:    10 * time.Minute,
+	}, nil
+}
+
+// Status lists registered migrations and whether they are applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		record, ok := applied[migration.Version]
+		result = append(result, Status{Migration: migration, Applied: ok, AppliedAt: record.AppliedAt})
+	}
+	return result, nil
+}
+
+// Up applies pending migrations up to and including target.
+// A target of 0 applies every pending migration.
+func (m *Migrator) Up(ctx context.Context, target int) error {
+	return m.locked(ctx, func(ctx context.Context) error {
+		applied, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if target > 0 && migration.Version > target {
+				break
+			}
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if m.DryRun {
+				fmt.Fprintf(m.out, "would apply %s\n", migration)
+				continue
+			}
+			fmt.Fprintf(m.out, "applying %s\n", migration)
+			if err := migration.Up(ctx); err != nil {
+				return fmt.Errorf("migration %s: %w", migration, err)
+			}
+			record := Record{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now().UTC()}
+			if err := m.store.Save(ctx, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Down rolls back applied migrations newer than target, newest first.
+func (m *Migrator) Down(ctx context.Context, target int) error {
+	return m.locked(ctx, func(ctx context.Context) error {
+		applied, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if migration.Version <= target {
+				break
+			}
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if migration.Down == nil {
+				return fmt.Errorf("migration %s: %w", migration, ErrIrreversible)
+			}
+			if m.DryRun {
+				fmt.Fprintf(m.out, "would roll back %s\n", migration)
+				continue
+			}
+			fmt.Fprintf(m.out, "rolling back %s\n", migration)
+			if err := migration.Down(ctx); err != nil {
+				return fmt.Errorf("migration %s: %w", migration, err)
+			}
+			if err := m.store.Delete(ctx, migration.Version); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int]Record, error) {
+	records, err := m.store.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]Record, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// locked runs fn holding the lock. fn is cancelled when the lock can not
+// be renewed, since another instance may take it over.
+func (m *Migrator) locked(ctx context.Context, fn func(ctx context.Context) error) error {
+	if err := m.store.Lock(ctx, m.owner, m.LockTTL); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	var lockErr error
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		lockErr = m.renew(ctx)
+		if lockErr != nil {
+			cancel()
+		}
+	}()
+
+	err := fn(ctx)
+	cancel()
+	<-renewed
+	if err := m.store.Unlock(context.Background(), m.owner); err != nil {
+		fmt.Fprintf(m.out, "unlock migrations: %s\n", err)
+	}
+	if lockErr != nil {
+		return fmt.Errorf("migration lock lost: %w", lockErr)
+	}
+	return err
+}
+
+// renew extends the lock until ctx is done. It returns the error of a
+// failed renewal.
+func (m *Migrator) renew(ctx context.Context) error {
+	if m.LockTTL <= 0 {
+		return nil
+	}
+	ticker := time.NewTicker(m.LockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := m.store.Lock(ctx, m.owner, m.LockTTL); err != nil && ctx.Err() == nil {
+				return err
+			}
+		}
+	}
+}
+
+// owner identifies this process as the lock holder.
+func owner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano())
+}
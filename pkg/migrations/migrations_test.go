@@ -0,0 +1,99 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore keeps migrations in memory. lost makes lock renewals fail.
+type memoryStore struct {
+	mu      sync.Mutex
+	applied map[int]Record
+	locks   int
+	lost    bool
+}
+
+func (s *memoryStore) Applied(ctx context.Context) ([]Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []Record
+	for _, record := range s.applied {
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (s *memoryStore) Save(ctx context.Context, record Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.applied[record.Version] = record
+	return nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.applied, version)
+	return nil
+}
+
+func (s *memoryStore) Lock(ctx context.Context, owner string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lost && s.locks > 0 {
+		return ErrLocked
+	}
+	s.locks++
+	return nil
+}
+
+func (s *memoryStore) Unlock(ctx context.Context, owner string) error {
+	return nil
+}
+
+// slow is a migration that runs until it is cancelled or d passes.
+func slow(d time.Duration) Migration {
+	return Migration{Version: 1, Name: "slow", Up: func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+			return nil
+		}
+	}}
+}
+
+func TestLockRenewed(t *testing.T) {
+	store := &memoryStore{applied: make(map[int]Record)}
+	migrator, err := New(store, io.Discard, slow(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator.LockTTL = 30 * time.Millisecond
+	if err := migrator.Up(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if store.locks < 3 {
+		t.Errorf("lock taken %d times, want it renewed", store.locks)
+	}
+}
+
+func TestLockLost(t *testing.T) {
+	store := &memoryStore{applied: make(map[int]Record), lost: true}
+	migrator, err := New(store, io.Discard, slow(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator.LockTTL = 30 * time.Millisecond
+	err = migrator.Up(context.Background(), 0)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("err = %v, want ErrLocked", err)
+	}
+	if len(store.applied) != 0 {
+		t.Error("migration recorded after the lock was lost")
+	}
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// AuditChange is the value of one field before and after a write.
+type AuditChange struct {
+	Before interface{} `json:"before,omitempty" bson:"before,omitempty"`
+	After  interface{} `json:"after,omitempty" bson:"after,omitempty"`
+}
+
+type AuditEntry struct {
+	ID       string                 `json:"id" bson:"_id"`
+	Actor    string                 `json:"actor" bson:"actor"`
+	Action   string                 `json:"action" bson:"action"`
+	Entity   string                 `json:"entity" bson:"entity"`
+	EntityID string                 `json:"entity_id" bson:"entity_id"`
+	Changes  map[string]AuditChange `json:"changes" bson:"changes"`
+	At       time.Time              `json:"at" bson:"at"`
+}
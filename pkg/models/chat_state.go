@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// ChatState is the step a chat has reached in a multi-step dialog, with
+// the answers collected so far.
+type ChatState struct {
+	ChatID    int64             `json:"chat_id" bson:"_id"`
+	State     string            `json:"state" bson:"state"`
+	Data      map[string]string `json:"data" bson:"data"`
+	ExpiresAt time.Time         `json:"expires_at" bson:"expires_at"`
+	UpdatedAt time.Time         `json:"updated_at" bson:"updated_at"`
+}
@@ -1,8 +1,13 @@
 package models
 
+import "time"
+
 type Course struct {
-	ID          string   `json:"id" bson:"_id"`
-	Title       string   `json:"title" bson:"title"`
-	Description string   `json:"description" bson:"description"`
-	Lessons     []Lesson `json:"lessons" bson:"lessons"`
+	ID          string     `json:"id" bson:"_id"`
+	Title       string     `json:"title" bson:"title"`
+	Description string     `json:"description" bson:"description"`
+	LessonIDs   []string   `json:"lesson_ids" bson:"lesson_ids"`
+	Version     int        `json:"version" bson:"version"`
+	ArchivedAt  *time.Time `json:"archived_at,omitempty" bson:"archived_at,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
 }
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+type EnrollmentStatus string
+
+const (
+	EnrollmentActive    EnrollmentStatus = "active"
+	EnrollmentCompleted EnrollmentStatus = "completed"
+	EnrollmentDropped   EnrollmentStatus = "dropped"
+)
+
+type Enrollment struct {
+	UserID     string           `json:"user_id" bson:"user_id"`
+	CourseID   string           `json:"course_id" bson:"course_id"`
+	EnrolledAt time.Time        `json:"enrolled_at" bson:"enrolled_at"`
+	Status     EnrollmentStatus `json:"status" bson:"status"`
+}
@@ -1,9 +1,14 @@
 package models
 
+import "time"
+
 type Lesson struct {
-	ID            string `json:"id" bson:"_id"`
-	Title         string `json:"title" bson:"title"`
-	Lection       string `json:"lection" bson:"lection"`
-	Task          string `json:"task" bson:"task"`
-	EstimatedTime int    `json:"time" bson:"time"`
+	ID            string     `json:"id" bson:"_id"`
+	Title         string     `json:"title" bson:"title"`
+	Lection       string     `json:"lection" bson:"lection"`
+	Task          string     `json:"task" bson:"task"`
+	EstimatedTime int        `json:"time" bson:"time"`
+	Version       int        `json:"version" bson:"version"`
+	ArchivedAt    *time.Time `json:"archived_at,omitempty" bson:"archived_at,omitempty"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
 }
@@ -0,0 +1,11 @@
+package models
+
+// Tenant is a school served by the process. Its profile is shown to the
+// users of its bot.
+type Tenant struct {
+	ID      string `json:"id" bson:"_id" yaml:"id"`
+	Name    string `json:"name" bson:"name" yaml:"name"`
+	Email   string `json:"email" bson:"email" yaml:"email"`
+	Phone   string `json:"phone" bson:"phone" yaml:"phone"`
+	Address string `json:"address" bson:"address" yaml:"address"`
+}
@@ -0,0 +1,56 @@
+// Package request carries values scoped to one bot update through the
+// context, down to the database calls made while handling it.
+package request
+
+import (
+	"context"
+	"log"
+)
+
+// User is the Telegram user who sent the update.
+type User struct {
+	ID       int64
+	UserName string
+}
+
+type (
+	updateIDKey struct{}
+	userKey     struct{}
+	loggerKey   struct{}
+)
+
+// WithUpdateID returns a context for handling the update with the ID.
+func WithUpdateID(ctx context.Context, id int) context.Context {
+	return context.WithValue(ctx, updateIDKey{}, id)
+}
+
+// UpdateIDFrom returns the update ID stored in the context.
+func UpdateIDFrom(ctx context.Context) (int, bool) {
+	id, ok := ctx.Value(updateIDKey{}).(int)
+	return id, ok
+}
+
+// WithUser returns a context for handling an update sent by user.
+func WithUser(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// UserFrom returns the user stored in the context.
+func UserFrom(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(userKey{}).(User)
+	return user, ok
+}
+
+// WithLogger returns a context whose messages are written to logger.
+func WithLogger(ctx context.Context, logger *log.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFrom returns the logger stored in the context, or the standard
+// logger when there is none.
+func LoggerFrom(ctx context.Context) *log.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*log.Logger); ok {
+		return logger
+	}
+	return log.Default()
+}
@@ -0,0 +1,221 @@
+package seed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/DanilLagunov/diploma/pkg/db"
+	"github.com/DanilLagunov/diploma/pkg/models"
+	"gopkg.in/yaml.v3"
+)
+
+// MaxIDLength keeps "/view <lesson> <course>" within Telegram's
+// 64 byte callback data limit.
+const MaxIDLength = 24
+
+var idPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// File is a course definition file. IDs are chosen by the author and stay
+// stable, so importing the file again updates the same courses.
+type File struct {
+	Courses []Course `yaml:"courses"`
+}
+
+// Course with its lessons in order.
+type Course struct {
+	ID          string   `yaml:"id"`
+	Title       string   `yaml:"title"`
+	Description string   `yaml:"description"`
+	Lessons     []Lesson `yaml:"lessons"`
+}
+
+// Lesson of a course. A lesson shared by several courses must be
+// defined the same way everywhere.
+type Lesson struct {
+	ID      string `yaml:"id"`
+	Title   string `yaml:"title"`
+	Lection string `yaml:"lection"`
+	Task    string `yaml:"task"`
+	// Time is the estimated time in minutes.
+	Time int `yaml:"time"`
+}
+
+func (l Lesson) model() models.Lesson {
+	return models.Lesson{ID: l.ID, Title: l.Title, Lection: l.Lection, Task: l.Task, EstimatedTime: l.Time}
+}
+
+// ValidationError lists every problem found in a file.
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid course file:\n  " + strings.Join(e, "\n  ")
+}
+
+// Read parses a YAML or JSON course file.
+func Read(path string) (File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+	return Decode(f)
+}
+
+// Decode parses a YAML or JSON course definition. Unknown fields are errors.
+func Decode(r io.Reader) (File, error) {
+	var file File
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return File{}, err
+	}
+	return file, nil
+}
+
+// Validate checks the file and returns a ValidationError with all problems.
+func (f File) Validate() error {
+	var problems ValidationError
+	courses := map[string]bool{}
+	lessons := map[string]Lesson{}
+	for i, course := range f.Courses {
+		at := fmt.Sprintf("courses[%d]", i)
+		problems = append(problems, checkID(at, course.ID)...)
+		if courses[course.ID] {
+			problems = append(problems, fmt.Sprintf("%s: duplicate course id %q", at, course.ID))
+		}
+		courses[course.ID] = true
+		if strings.TrimSpace(course.Title) == "" {
+			problems = append(problems, at+": title is required")
+		}
+
+		inCourse := map[string]bool{}
+		for j, lesson := range course.Lessons {
+			at := fmt.Sprintf("%s.lessons[%d]", at, j)
+			problems = append(problems, checkID(at, lesson.ID)...)
+			if inCourse[lesson.ID] {
+				problems = append(problems, fmt.Sprintf("%s: lesson %q is listed twice", at, lesson.ID))
+			}
+			inCourse[lesson.ID] = true
+			if other, ok := lessons[lesson.ID]; ok && other != lesson {
+				problems = append(problems, fmt.Sprintf("%s: lesson %q is defined differently elsewhere", at, lesson.ID))
+			}
+			lessons[lesson.ID] = lesson
+			if strings.TrimSpace(lesson.Title) == "" {
+				problems = append(problems, at+": title is required")
+			}
+			problems = append(problems, checkURL(at+".lection", lesson.Lection)...)
+			problems = append(problems, checkURL(at+".task", lesson.Task)...)
+			if lesson.Time <= 0 {
+				problems = append(problems, at+": time must be a positive number of minutes")
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+func checkID(at, id string) []string {
+	switch {
+	case id == "":
+		return []string{at + ": id is required"}
+	case len(id) > MaxIDLength || !idPattern.MatchString(id):
+		return []string{fmt.Sprintf("%s: id %q must be at most %d lowercase letters, digits, '-' or '_'", at, id, MaxIDLength)}
+	}
+	return nil
+}
+
+func checkURL(at, value string) []string {
+	u, err := url.ParseRequestURI(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return []string{fmt.Sprintf("%s: %q is not an http(s) URL", at, value)}
+	}
+	return nil
+}
+
+// Counts of imported items by outcome.
+type Counts struct {
+	Created   int
+	Updated   int
+	Unchanged int
+}
+
+// Result of an import.
+type Result struct {
+	Courses Counts
+	Lessons Counts
+}
+
+// Import validates the file and upserts its lessons and courses in one
+// transaction. Importing the same file again changes nothing. Courses and
+// lessons missing from the file are kept, archived ones stay archived.
+func Import(ctx context.Context, database db.Database, file File) (Result, error) {
+	if err := file.Validate(); err != nil {
+		return Result{}, err
+	}
+	var result Result
+	err := database.WithTransaction(ctx, func(ctx context.Context, tx db.Database) error {
+		result = Result{}
+		saved := map[string]bool{}
+		for _, course := range file.Courses {
+			ids := make([]string, 0, len(course.Lessons))
+			for _, lesson := range course.Lessons {
+				ids = append(ids, lesson.ID)
+				if saved[lesson.ID] {
+					continue
+				}
+				saved[lesson.ID] = true
+				if err := saveLesson(ctx, tx, lesson.model(), &result.Lessons); err != nil {
+					return fmt.Errorf("lesson %s: %w", lesson.ID, err)
+				}
+			}
+			model := models.Course{ID: course.ID, Title: course.Title, Description: course.Description, LessonIDs: ids}
+			if err := saveCourse(ctx, tx, model, &result.Courses); err != nil {
+				return fmt.Errorf("course %s: %w", course.ID, err)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+func saveLesson(ctx context.Context, database db.Database, lesson models.Lesson, counts *Counts) error {
+	current, err := database.GetLesson(ctx, lesson.ID)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		counts.Created++
+	case err != nil:
+		return err
+	case current.Title == lesson.Title && current.Lection == lesson.Lection &&
+		current.Task == lesson.Task && current.EstimatedTime == lesson.EstimatedTime:
+		counts.Unchanged++
+		return nil
+	default:
+		counts.Updated++
+	}
+	return database.SaveLesson(ctx, lesson)
+}
+
+func saveCourse(ctx context.Context, database db.Database, course models.Course, counts *Counts) error {
+	current, err := database.GetCourse(ctx, course.ID)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		counts.Created++
+	case err != nil:
+		return err
+	case current.Title == course.Title && current.Description == course.Description &&
+		strings.Join(current.LessonIDs, ",") == strings.Join(course.LessonIDs, ","):
+		counts.Unchanged++
+		return nil
+	default:
+		counts.Updated++
+	}
+	return database.SaveCourse(ctx, course)
+}
@@ -0,0 +1,209 @@
+package seed
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DanilLagunov/diploma/pkg/db/sql"
+)
+
+func newSQLite(t *testing.T) *sql.Database {
+	ctx := context.Background()
+	d, err := sql.New(sql.DriverSQLite, "file:"+filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	migrator, err := d.Migrator(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func lesson(id string) Lesson {
+	return Lesson{
+		ID:      id,
+		Title:   "Lesson " + id,
+		Lection: "https://example.com/" + id + "/lection",
+		Task:    "https://example.com/" + id + "/task",
+		Time:    30,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	long := strings.Repeat("a", MaxIDLength+1)
+	tests := []struct {
+		name string
+		file File
+		want []string
+	}{
+		{
+			name: "valid",
+			file: File{Courses: []Course{{ID: "algebra", Title: "Algebra", Lessons: []Lesson{lesson("fractions")}}}},
+		},
+		{
+			name: "course id and title",
+			file: File{Courses: []Course{{ID: "", Title: " "}, {ID: long, Title: "Long"}, {ID: "Bad id", Title: "Bad"}}},
+			want: []string{
+				"courses[0]: id is required",
+				"courses[0]: title is required",
+				`courses[1]: id "` + long + `" must be at most 24 lowercase letters, digits, '-' or '_'`,
+				`courses[2]: id "Bad id" must be at most 24 lowercase letters, digits, '-' or '_'`,
+			},
+		},
+		{
+			name: "duplicate course",
+			file: File{Courses: []Course{{ID: "algebra", Title: "Algebra"}, {ID: "algebra", Title: "Algebra 2"}}},
+			want: []string{`courses[1]: duplicate course id "algebra"`},
+		},
+		{
+			name: "lesson fields",
+			file: File{Courses: []Course{{ID: "algebra", Title: "Algebra", Lessons: []Lesson{
+				{ID: "fractions", Lection: "example.com/lection", Task: "ftp://example.com/task"},
+			}}}},
+			want: []string{
+				"courses[0].lessons[0]: title is required",
+				`courses[0].lessons[0].lection: "example.com/lection" is not an http(s) URL`,
+				`courses[0].lessons[0].task: "ftp://example.com/task" is not an http(s) URL`,
+				"courses[0].lessons[0]: time must be a positive number of minutes",
+			},
+		},
+		{
+			name: "lesson listed twice",
+			file: File{Courses: []Course{{ID: "algebra", Title: "Algebra", Lessons: []Lesson{lesson("fractions"), lesson("fractions")}}}},
+			want: []string{`courses[0].lessons[1]: lesson "fractions" is listed twice`},
+		},
+		{
+			name: "shared lesson defined differently",
+			file: File{Courses: []Course{
+				{ID: "algebra", Title: "Algebra", Lessons: []Lesson{lesson("fractions")}},
+				{ID: "geometry", Title: "Geometry", Lessons: []Lesson{func() Lesson {
+					l := lesson("fractions")
+					l.Time = 45
+					return l
+				}()}},
+			}},
+			want: []string{`courses[1].lessons[0]: lesson "fractions" is defined differently elsewhere`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.file.Validate()
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			var problems ValidationError
+			if !errors.As(err, &problems) {
+				t.Fatalf("Validate() = %v, want a ValidationError", err)
+			}
+			if strings.Join(problems, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("problems:\n%s\nwant:\n%s", strings.Join(problems, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	file, err := Decode(strings.NewReader(`
+courses:
+  - id: algebra
+    title: Algebra
+    lessons:
+      - id: fractions
+        title: Fractions
+        lection: https://example.com/lection
+        task: https://example.com/task
+        time: 30
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Courses) != 1 || len(file.Courses[0].Lessons) != 1 || file.Courses[0].Lessons[0].Time != 30 {
+		t.Errorf("Decode() = %+v", file)
+	}
+
+	// JSON is YAML too.
+	file, err = Decode(strings.NewReader(`{"courses": [{"id": "algebra", "title": "Algebra"}]}`))
+	if err != nil || len(file.Courses) != 1 {
+		t.Errorf("Decode(JSON) = %+v, %v", file, err)
+	}
+
+	if _, err := Decode(strings.NewReader("courses:\n  - id: algebra\n    name: Algebra\n")); err == nil {
+		t.Error("Decode accepted an unknown field")
+	}
+	if file, err := Decode(strings.NewReader("")); err != nil || len(file.Courses) != 0 {
+		t.Errorf("Decode(empty) = %+v, %v", file, err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	d := newSQLite(t)
+	file := File{Courses: []Course{
+		{ID: "algebra", Title: "Algebra", Lessons: []Lesson{lesson("fractions"), lesson("equations")}},
+		{ID: "geometry", Title: "Geometry", Lessons: []Lesson{lesson("fractions"), lesson("shapes")}},
+	}}
+
+	result, err := Import(ctx, d, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Result{Courses: Counts{Created: 2}, Lessons: Counts{Created: 3}}
+	if result != want {
+		t.Errorf("first Import = %+v, want %+v", result, want)
+	}
+	course, err := d.GetCourse(ctx, "geometry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(course.LessonIDs, ",") != "fractions,shapes" {
+		t.Errorf("geometry lessons = %v", course.LessonIDs)
+	}
+
+	result, err = Import(ctx, d, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = Result{Courses: Counts{Unchanged: 2}, Lessons: Counts{Unchanged: 3}}
+	if result != want {
+		t.Errorf("second Import = %+v, want %+v", result, want)
+	}
+
+	// The shared lesson changes in both courses, the reordered course is
+	// updated and the new lesson created.
+	fractions := lesson("fractions")
+	fractions.Time = 45
+	file.Courses[0].Lessons = []Lesson{lesson("equations"), fractions, lesson("roots")}
+	file.Courses[1].Lessons[0] = fractions
+	result, err = Import(ctx, d, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = Result{Courses: Counts{Updated: 1, Unchanged: 1}, Lessons: Counts{Created: 1, Updated: 1, Unchanged: 2}}
+	if result != want {
+		t.Errorf("changed Import = %+v, want %+v", result, want)
+	}
+	got, err := d.GetLesson(ctx, "fractions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.EstimatedTime != 45 {
+		t.Errorf("fractions time = %d, want 45", got.EstimatedTime)
+	}
+
+	file.Courses[0].Title = ""
+	if _, err := Import(ctx, d, file); !errors.As(err, new(ValidationError)) {
+		t.Errorf("Import of an invalid file = %v, want a ValidationError", err)
+	}
+}